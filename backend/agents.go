@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// Сколько живёт аренда задания без heartbeat агента
+	agentLeaseDuration = 30 * time.Second
+	// Как часто агенту рекомендуется присылать heartbeat
+	agentHeartbeatInterval = 10 * time.Second
+	// Как часто проверять истёкшие аренды
+	agentLeaseCheckInterval = 5 * time.Second
+	// Ожидание задания в long-poll по умолчанию и максимум
+	agentDefaultPollWait = 30 * time.Second
+	agentMaxPollWait     = 60 * time.Second
+)
+
+// Итог задания, который получает движок, ожидающий агента
+type agentJobResult struct {
+	ExitCode int
+	Err      error // задание не выполнено: процесс не запустился или аренда истекла
+}
+
+// Ожидание движком результата задания и хвост вывода для retry_on
+type agentJobWaiter struct {
+	done   chan agentJobResult
+	output *tailBuffer
+}
+
+var (
+	agentJobWaiters      = make(map[int]*agentJobWaiter)
+	agentJobWaitersMutex = sync.Mutex{}
+
+	// Закрывается при появлении нового задания, чтобы разбудить агентов в long-poll
+	agentJobsReady      = make(chan struct{})
+	agentJobsReadyMutex = sync.Mutex{}
+)
+
+// Агент в списке /api/agents
+type Agent struct {
+	AgentID  int      `json:"agent_id"`
+	Name     string   `json:"name"`
+	Labels   []string `json:"labels"`
+	Online   bool     `json:"online"` // агент обращался к серверу за время long-poll и аренды
+	LastSeen string   `json:"last_seen"`
+	JobIDs   []int    `json:"job_ids"` // задания, которые агент выполняет сейчас
+}
+
+// Задание, выданное агенту
+type agentJobLease struct {
+	JobID        int               `json:"job_id"`
+	TaskID       int               `json:"task_id"`
+	PipelineID   int               `json:"pipeline_id"`
+	TaskName     string            `json:"task_name"`
+	Command      string            `json:"command"`
+	Env          map[string]string `json:"env"`
+	LeaseSeconds int               `json:"lease_seconds"`
+}
+
+// Выполнение команды задачи агентом: задание ставится в очередь и ждёт, пока его
+// заберёт агент со всеми метками runs_on и сообщит результат. Повторы, таймауты
+// и отмена остаются за движком, как и для команд, выполняемых на сервере
+func runAgentJob(ctx context.Context, task *engineTask) (int, string, error) {
+	// Ожидание регистрируется под той же блокировкой, что и вставка: агент не сможет
+	// сообщить результат раньше, чем движок начнёт его ждать
+	waiter := &agentJobWaiter{done: make(chan agentJobResult, 1), output: &tailBuffer{limit: 64 * 1024}}
+	var jobID int
+	agentJobWaitersMutex.Lock()
+	err := db.QueryRow(`
+        INSERT INTO agent_job (task_id, labels, command) VALUES ($1, $2, $3) RETURNING job_id`,
+		task.TaskID, pqStringArray(task.RunsOn), task.Command).Scan(&jobID)
+	if err == nil {
+		agentJobWaiters[jobID] = waiter
+	}
+	agentJobWaitersMutex.Unlock()
+	if err != nil {
+		return -1, "", err
+	}
+	defer func() {
+		agentJobWaitersMutex.Lock()
+		delete(agentJobWaiters, jobID)
+		agentJobWaitersMutex.Unlock()
+	}()
+	notifyAgentJobs()
+	insertTaskLogs(task.TaskID, "Info", []string{fmt.Sprintf("Задание %d ожидает агента с метками %s", jobID, strings.Join(task.RunsOn, ", "))})
+
+	select {
+	case result := <-waiter.done:
+		return result.ExitCode, waiter.output.String(), result.Err
+	case <-ctx.Done():
+		_, reason := interruptStatus(ctx)
+		_, err := db.Exec(`
+            UPDATE agent_job SET status = 'Cancelled', finished_at = NOW(), error = $2
+            WHERE job_id = $1 AND status IN ('Queued', 'Leased')`, jobID, nilIfEmpty(reason))
+		if err != nil {
+			log.Printf("Ошибка отмены задания агента %d: %v", jobID, err)
+		}
+		return -1, waiter.output.String(), ctx.Err()
+	}
+}
+
+func notifyAgentJobs() {
+	agentJobsReadyMutex.Lock()
+	close(agentJobsReady)
+	agentJobsReady = make(chan struct{})
+	agentJobsReadyMutex.Unlock()
+}
+
+func agentJobsReadyChannel() chan struct{} {
+	agentJobsReadyMutex.Lock()
+	defer agentJobsReadyMutex.Unlock()
+	return agentJobsReady
+}
+
+// Передача результата задания ожидающему движку
+func finishAgentJobWaiter(jobID int, result agentJobResult) {
+	agentJobWaitersMutex.Lock()
+	waiter, ok := agentJobWaiters[jobID]
+	agentJobWaitersMutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case waiter.done <- result:
+	default:
+	}
+}
+
+// Фоновая горутина: задания, по которым агент перестал присылать heartbeat, завершаются
+// ошибкой, и движок решает, повторять ли задачу. Движок хранит ожидания в памяти, поэтому
+// после перезапуска сервера задания прошлого запуска отменяются
+func runAgentLeaseMonitor() {
+	_, err := db.Exec(`
+        UPDATE agent_job SET status = 'Cancelled', finished_at = NOW(), error = 'сервер перезапущен'
+        WHERE status IN ('Queued', 'Leased')`)
+	if err != nil {
+		log.Printf("Ошибка отмены заданий агентов: %v", err)
+	}
+
+	ticker := time.NewTicker(agentLeaseCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		expireAgentJobs(`lease_expires_at < NOW()`, "аренда задания истекла: агент перестал присылать heartbeat")
+	}
+}
+
+// Перевод выданных заданий, подходящих под условие, в Expired
+func expireAgentJobs(where string, reason string, args ...interface{}) {
+	rows, err := db.Query(`
+        UPDATE agent_job SET status = 'Expired', finished_at = NOW(), error = $1
+        WHERE status = 'Leased' AND `+where+`
+        RETURNING job_id, task_id`, append([]interface{}{reason}, args...)...)
+	if err != nil {
+		log.Printf("Ошибка при проверке аренды заданий: %v", err)
+		return
+	}
+	type expired struct{ JobID, TaskID int }
+	var jobs []expired
+	for rows.Next() {
+		var job expired
+		if err := rows.Scan(&job.JobID, &job.TaskID); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	rows.Close()
+
+	for _, job := range jobs {
+		insertTaskLogs(job.TaskID, "Error", []string{fmt.Sprintf("Задание %d: %s", job.JobID, reason)})
+		finishAgentJobWaiter(job.JobID, agentJobResult{ExitCode: -1, Err: errors.New(reason)})
+	}
+}
+
+// Проверка токена агента из заголовка Authorization: Bearer <token>.
+// Возвращает идентификатор и метки агента; при ошибке ответ уже отправлен
+func authenticateAgent(w http.ResponseWriter, r *http.Request) (int, []string, bool) {
+	agentID, err := strconv.Atoi(mux.Vars(r)["agent_id"])
+	if err != nil {
+		http.Error(w, "Некорректный agent_id", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	var tokenHash string
+	var labels pq.StringArray
+	err = db.QueryRow(`SELECT token_hash, labels FROM agent WHERE agent_id = $1`, agentID).Scan(&tokenHash, &labels)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	if err == sql.ErrNoRows || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(tokenHash)) != 1 {
+		http.Error(w, "Неверный токен агента", http.StatusUnauthorized)
+		return 0, nil, false
+	}
+	db.Exec(`UPDATE agent SET last_seen = NOW() WHERE agent_id = $1`, agentID)
+	return agentID, []string(labels), true
+}
+
+// Регистрация агента: POST /api/agents/register {"name": "build-1", "labels": ["linux", "docker"]}.
+// В заголовке X-Agent-Registration-Token должно прийти значение переменной окружения
+// AGENT_REGISTRATION_TOKEN; без неё регистрация отключена, так как агент получает
+// команды и переменные задач. В ответе - токен для остальных запросов агента
+func registerAgentHandler(w http.ResponseWriter, r *http.Request) {
+	expected := os.Getenv("AGENT_REGISTRATION_TOKEN")
+	if expected == "" {
+		http.Error(w, "Регистрация агентов отключена: не задан AGENT_REGISTRATION_TOKEN", http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Agent-Registration-Token")), []byte(expected)) != 1 {
+		http.Error(w, "Неверный токен регистрации агента", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		Labels []string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Неверные данные: нужно поле name", http.StatusBadRequest)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "Ошибка создания токена", http.StatusInternalServerError)
+		return
+	}
+
+	var agentID int
+	err = db.QueryRow(`
+        INSERT INTO agent (name, labels, token_hash, last_seen) VALUES ($1, $2, $3, NOW())
+        RETURNING agent_id`, strings.TrimSpace(req.Name), pqArray(req.Labels), hashToken(token)).Scan(&agentID)
+	if err != nil {
+		http.Error(w, "Ошибка регистрации агента", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Зарегистрирован агент %d (%s), метки: %s", agentID, req.Name, strings.Join(req.Labels, ", "))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent_id":          agentID,
+		"token":             token,
+		"lease_seconds":     int(agentLeaseDuration / time.Second),
+		"heartbeat_seconds": int(agentHeartbeatInterval / time.Second),
+	})
+}
+
+// Получение задания (long-poll): POST /api/agent/{agent_id}/lease?wait=30.
+// Отвечает заданием, как только появится подходящее, или 204 по истечении wait секунд
+func leaseAgentJobHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, labels, ok := authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	wait := agentDefaultPollWait
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > agentMaxPollWait {
+			http.Error(w, fmt.Sprintf("wait должен быть от 0 до %d секунд", int(agentMaxPollWait/time.Second)), http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	// Задания могут появиться и без уведомления (например, после отмены аренды другого агента)
+	recheck := time.NewTicker(agentLeaseCheckInterval)
+	defer recheck.Stop()
+	for {
+		ready := agentJobsReadyChannel()
+		job, err := leaseAgentJob(agentID, labels)
+		if err != nil {
+			log.Printf("Ошибка выдачи задания агенту %d: %v", agentID, err)
+			http.Error(w, "Ошибка выдачи задания", http.StatusInternalServerError)
+			return
+		}
+		if job != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(job)
+			return
+		}
+		select {
+		case <-ready:
+		case <-recheck.C:
+		case <-deadline.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Выдача агенту самого старого задания, все метки которого есть у агента
+func leaseAgentJob(agentID int, labels []string) (*agentJobLease, error) {
+	job := &agentJobLease{LeaseSeconds: int(agentLeaseDuration / time.Second)}
+	var agentName string
+	err := db.QueryRow(`
+        UPDATE agent_job j
+        SET status = 'Leased', agent_id = $1, started_at = NOW(),
+            lease_expires_at = NOW() + make_interval(secs => $3)
+        FROM task t, agent a
+        WHERE t.task_id = j.task_id AND a.agent_id = $1
+          AND j.job_id = (
+              SELECT job_id FROM agent_job
+              WHERE status = 'Queued' AND labels <@ $2::text[]
+              ORDER BY job_id
+              FOR UPDATE SKIP LOCKED
+              LIMIT 1)
+        RETURNING j.job_id, j.task_id, t.pipeline_id, t.name, j.command, a.name`,
+		agentID, pqArray(labels), job.LeaseSeconds).Scan(
+		&job.JobID, &job.TaskID, &job.PipelineID, &job.TaskName, &job.Command, &agentName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	job.Env = map[string]string{
+		"PIPELINE_ID": strconv.Itoa(job.PipelineID),
+		"TASK_ID":     strconv.Itoa(job.TaskID),
+		"TASK_NAME":   job.TaskName,
+	}
+	insertTaskLogs(job.TaskID, "Info", []string{fmt.Sprintf("Задание %d выполняет агент %d (%s)", job.JobID, agentID, agentName)})
+	return job, nil
+}
+
+// Heartbeat агента: POST /api/agent/{agent_id}/heartbeat {"job_ids": [1, 2]}.
+// Продлевает аренду перечисленных заданий; в ответе cancel - задания, которые
+// агенту больше не принадлежат (отменены или аренда истекла), их нужно остановить
+func agentHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, _, ok := authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		JobIDs []int `json:"job_ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Неверные данные", http.StatusBadRequest)
+			return
+		}
+	}
+
+	extended := make(map[int]bool)
+	if len(req.JobIDs) > 0 {
+		rows, err := db.Query(`
+            UPDATE agent_job SET lease_expires_at = NOW() + make_interval(secs => $3)
+            WHERE agent_id = $1 AND status = 'Leased' AND job_id = ANY($2)
+            RETURNING job_id`, agentID, pq.Array(req.JobIDs), int(agentLeaseDuration/time.Second))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var jobID int
+			if err := rows.Scan(&jobID); err == nil {
+				extended[jobID] = true
+			}
+		}
+		rows.Close()
+	}
+	cancel := []int{}
+	for _, jobID := range req.JobIDs {
+		if !extended[jobID] {
+			cancel = append(cancel, jobID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cancel":        cancel,
+		"lease_seconds": int(agentLeaseDuration / time.Second),
+	})
+}
+
+// Задача, которую агент выполняет по заданию; 409, если задание ему больше не принадлежит
+func leasedAgentJobTask(w http.ResponseWriter, r *http.Request, agentID int) (int, int, bool) {
+	jobID, err := strconv.Atoi(mux.Vars(r)["job_id"])
+	if err != nil {
+		http.Error(w, "Некорректный job_id", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	var taskID int
+	err = db.QueryRow(`
+        SELECT task_id FROM agent_job WHERE job_id = $1 AND agent_id = $2 AND status = 'Leased'`,
+		jobID, agentID).Scan(&taskID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Задание не выполняется этим агентом", http.StatusConflict)
+		return 0, 0, false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	return jobID, taskID, true
+}
+
+// Вывод задания: POST /api/agent/{agent_id}/jobs/{job_id}/logs {"lines": ["..."], "level": "Info"}.
+// Строки попадают в журнал задачи; присланный вывод тоже продлевает аренду
+func agentJobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, _, ok := authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	jobID, taskID, ok := leasedAgentJobTask(w, r, agentID)
+	if !ok {
+		return
+	}
+	var req struct {
+		Lines []string `json:"lines"`
+		Level string   `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверные данные", http.StatusBadRequest)
+		return
+	}
+	if req.Level == "" {
+		req.Level = "Info"
+	}
+	if !taskLogLevels[req.Level] {
+		http.Error(w, "level должен быть Info, Warning или Error", http.StatusBadRequest)
+		return
+	}
+
+	lines := make([]taskLogLine, len(req.Lines))
+	for i, message := range req.Lines {
+		lines[i] = taskLogLine{Level: req.Level, Message: message}
+	}
+	if _, err := appendTaskLogs(taskID, lines, true); err != nil {
+		http.Error(w, "Ошибка записи журнала", http.StatusInternalServerError)
+		return
+	}
+	db.Exec(`UPDATE agent_job SET lease_expires_at = NOW() + make_interval(secs => $2) WHERE job_id = $1`,
+		jobID, int(agentLeaseDuration/time.Second))
+
+	agentJobWaitersMutex.Lock()
+	waiter, ok := agentJobWaiters[jobID]
+	agentJobWaitersMutex.Unlock()
+	if ok {
+		for _, line := range req.Lines {
+			waiter.output.Write([]byte(line + "\n"))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Результат задания: POST /api/agent/{agent_id}/jobs/{job_id}/result {"exit_code": 0, "error": ""}.
+// error - команду не удалось запустить на агенте
+func agentJobResultHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, _, ok := authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	jobID, taskID, ok := leasedAgentJobTask(w, r, agentID)
+	if !ok {
+		return
+	}
+	var req struct {
+		ExitCode int    `json:"exit_code"`
+		Error    string `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверные данные", http.StatusBadRequest)
+		return
+	}
+	status := "Completed"
+	if req.ExitCode != 0 || req.Error != "" {
+		status = "Failed"
+	}
+
+	result, err := db.Exec(`
+        UPDATE agent_job SET status = $3, exit_code = $4, error = $5, finished_at = NOW()
+        WHERE job_id = $1 AND agent_id = $2 AND status = 'Leased'`,
+		jobID, agentID, status, req.ExitCode, nilIfEmpty(req.Error))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Задание не выполняется этим агентом", http.StatusConflict)
+		return
+	}
+
+	jobResult := agentJobResult{ExitCode: req.ExitCode}
+	if req.Error != "" {
+		jobResult.Err = errors.New(req.Error)
+		insertTaskLogs(taskID, "Error", []string{fmt.Sprintf("Задание %d: %s", jobID, req.Error)})
+	}
+	finishAgentJobWaiter(jobID, jobResult)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Список агентов: GET /api/agents
+func getAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+        SELECT a.agent_id, a.name, a.labels, a.last_seen,
+               COALESCE(a.last_seen > NOW() - make_interval(secs => $1), false),
+               ARRAY(SELECT job_id FROM agent_job j WHERE j.agent_id = a.agent_id AND j.status = 'Leased' ORDER BY job_id)
+        FROM agent a ORDER BY a.agent_id`, int((agentMaxPollWait+agentLeaseDuration)/time.Second))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	agents := []Agent{}
+	for rows.Next() {
+		var agent Agent
+		var labels pq.StringArray
+		var jobIDs pq.Int64Array
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&agent.AgentID, &agent.Name, &labels, &lastSeen, &agent.Online, &jobIDs); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		agent.Labels = []string(labels)
+		agent.LastSeen = formatTime(lastSeen)
+		agent.JobIDs = make([]int, len(jobIDs))
+		for i, id := range jobIDs {
+			agent.JobIDs[i] = int(id)
+		}
+		agents = append(agents, agent)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agents)
+}
+
+// Удаление агента: DELETE /api/agent/{agent_id}; его задания завершаются как с истёкшей арендой
+func deleteAgentHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, err := strconv.Atoi(mux.Vars(r)["agent_id"])
+	if err != nil {
+		http.Error(w, "Некорректный agent_id", http.StatusBadRequest)
+		return
+	}
+	expireAgentJobs(`agent_id = $2`, "агент удалён", agentID)
+
+	result, err := db.Exec(`DELETE FROM agent WHERE agent_id = $1`, agentID)
+	if err != nil {
+		http.Error(w, "Ошибка удаления агента", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Агент не найден", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
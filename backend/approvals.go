@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Решение по задаче-подтверждению для getTaskDetails
+type TaskApproval struct {
+	Decision  string `json:"decision"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	DecidedAt string `json:"decided_at"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+// Уровень доступа, который по умолчанию нужен для подтверждения
+const defaultApprovalLevel = "Admin"
+
+// Старшинство уровней access_control.permission_level: Admin может всё, что может Developer
+var permissionRank = map[string]int{
+	"Viewer":    1,
+	"Developer": 2,
+	"Admin":     3,
+}
+
+var (
+	// Задачи-подтверждения, решение по которым ждёт движок
+	approvalWaiters      = make(map[int]chan string)
+	approvalWaitersMutex = sync.Mutex{}
+)
+
+// Передаёт решение движку, если он ждёт подтверждения задачи
+func notifyApprovalWaiter(taskID int, status string) {
+	approvalWaitersMutex.Lock()
+	defer approvalWaitersMutex.Unlock()
+	if decisions, ok := approvalWaiters[taskID]; ok {
+		select {
+		case decisions <- status:
+		default:
+		}
+	}
+}
+
+// Выполнение задачи-подтверждения движком: задача переходит в WaitingForApproval
+// и не занимает рабочий слот, пока пользователь не подтвердит или не отклонит её
+func runApprovalTask(ctx context.Context, task *engineTask) taskResult {
+	decisions := make(chan string, 1)
+	approvalWaitersMutex.Lock()
+	approvalWaiters[task.TaskID] = decisions
+	approvalWaitersMutex.Unlock()
+	defer func() {
+		approvalWaitersMutex.Lock()
+		delete(approvalWaiters, task.TaskID)
+		approvalWaitersMutex.Unlock()
+	}()
+
+	waiting, status, err := markTaskWaitingForApproval(task.TaskID, task.ApprovalLevel)
+	if err != nil {
+		return taskResult{TaskID: task.TaskID, Status: "Failed", Err: err}
+	}
+	if !waiting {
+		// Решение приняли заранее или задачу остановили до запуска
+		return taskResult{TaskID: task.TaskID, Status: status}
+	}
+	sendTaskUpdate(task.TaskID)
+	sendPipelineUpdate(task.PipelineID)
+
+	select {
+	case status := <-decisions:
+		return taskResult{TaskID: task.TaskID, Status: status}
+	case <-ctx.Done():
+		status, reason := interruptStatus(ctx)
+		// Решение могло прийти одновременно с остановкой, тогда оно остаётся в силе
+		res, err := db.Exec(`
+            UPDATE task SET status = $1, end_time = NOW(), status_reason = $2
+            WHERE task_id = $3 AND status = 'WaitingForApproval'`, status, nilIfEmpty(reason), task.TaskID)
+		if err != nil {
+			return taskResult{TaskID: task.TaskID, Status: status, Err: err}
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = db.QueryRow(`SELECT status FROM task WHERE task_id = $1`, task.TaskID).Scan(&status)
+			return taskResult{TaskID: task.TaskID, Status: status, Err: err}
+		}
+		sendTaskUpdate(task.TaskID)
+		sendPipelineUpdate(task.PipelineID)
+		return taskResult{TaskID: task.TaskID, Status: status}
+	}
+}
+
+// Перевод ожидающей задачи в WaitingForApproval.
+// Если задача уже не в Pending, возвращает false и её текущий статус
+func markTaskWaitingForApproval(taskID int, level string) (bool, string, error) {
+	res, err := db.Exec(`
+        UPDATE task
+        SET status = 'WaitingForApproval', start_time = NOW(), end_time = NULL, status_reason = $2
+        WHERE task_id = $1 AND status = 'Pending'`, taskID, fmt.Sprintf("ожидает подтверждения (%s)", level))
+	if err != nil {
+		return false, "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, "WaitingForApproval", nil
+	}
+	var status string
+	err = db.QueryRow(`SELECT status FROM task WHERE task_id = $1`, taskID).Scan(&status)
+	return false, status, err
+}
+
+// Может ли пользователь принимать решение по задачам пайплайна с требуемым уровнем.
+// Записи access_control без pipeline_id действуют на все пайплайны
+func canApprove(q dbQuerier, userID, pipelineID int, requiredLevel string) (bool, error) {
+	rows, err := q.Query(`
+        SELECT permission_level FROM access_control
+        WHERE user_id = $1 AND (pipeline_id = $2 OR pipeline_id IS NULL)`, userID, pipelineID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var level string
+		if err := rows.Scan(&level); err != nil {
+			return false, err
+		}
+		if permissionRank[level] >= permissionRank[requiredLevel] {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Подтверждение задачи: зависимые задачи могут выполняться дальше
+func approveTaskHandler(w http.ResponseWriter, r *http.Request) {
+	decideApproval(w, r, "Approved")
+}
+
+// Отклонение задачи: задача завершается с ошибкой, зависимые задачи пропускаются
+func rejectTaskHandler(w http.ResponseWriter, r *http.Request) {
+	decideApproval(w, r, "Rejected")
+}
+
+// Общая часть approve/reject: проверка прав, смена статуса задачи и запись решения.
+// Решение принимает владелец токена из заголовка Authorization (см. issueUserTokenHandler)
+func decideApproval(w http.ResponseWriter, r *http.Request, decision string) {
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Некорректный task_id", http.StatusBadRequest)
+		return
+	}
+	userID, username, ok := authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	comment := r.FormValue("comment")
+
+	var pipelineID int
+	err = withTx(func(tx *sql.Tx) error {
+		var taskType, status, level string
+		err := tx.QueryRow(`
+            SELECT pipeline_id, task_type, COALESCE(status, 'Pending'), COALESCE(approval_level, $2)
+            FROM task WHERE task_id = $1 FOR UPDATE`, taskID, defaultApprovalLevel).Scan(&pipelineID, &taskType, &status, &level)
+		if err == sql.ErrNoRows {
+			return &requestError{http.StatusNotFound, "Задача не найдена"}
+		} else if err != nil {
+			return err
+		}
+		if taskType != "approval" {
+			return &requestError{http.StatusBadRequest, "Задача не требует подтверждения"}
+		}
+		if status != "WaitingForApproval" && status != "Pending" {
+			return &requestError{http.StatusConflict, fmt.Sprintf("Задача в статусе %s, решение уже принято", status)}
+		}
+
+		allowed, err := canApprove(tx, userID, pipelineID, level)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &requestError{http.StatusForbidden, fmt.Sprintf("Для решения нужен уровень доступа %s к пайплайну", level)}
+		}
+
+		if _, err := tx.Exec(`
+            INSERT INTO task_approval (task_id, decision, decided_by, decided_at, comment)
+            VALUES ($1, $2, $3, NOW(), $4)`, taskID, decision, userID, nilIfEmpty(comment)); err != nil {
+			return err
+		}
+
+		newStatus, reason, progress := "Completed", fmt.Sprintf("подтверждено пользователем %s", username), 100
+		if decision == "Rejected" {
+			newStatus, reason, progress = "Failed", fmt.Sprintf("отклонено пользователем %s", username), 0
+		}
+		if comment != "" {
+			reason += ": " + comment
+		}
+		_, err = tx.Exec(`
+            UPDATE task
+            SET status = $1, start_time = COALESCE(start_time, NOW()), end_time = NOW(),
+                progress_percentage = $2, status_reason = $3
+            WHERE task_id = $4`, newStatus, progress, reason, taskID)
+		return err
+	})
+	if appErr, ok := err.(*requestError); ok {
+		http.Error(w, appErr.Message, appErr.Code)
+		return
+	} else if err != nil {
+		log.Printf("Ошибка при принятии решения по задаче %d: %v", taskID, err)
+		http.Error(w, "Ошибка при сохранении решения", http.StatusInternalServerError)
+		return
+	}
+
+	status := "Completed"
+	if decision == "Rejected" {
+		status = "Failed"
+	}
+	notifyApprovalWaiter(taskID, status)
+	sendTaskUpdate(taskID)
+	sendPipelineUpdate(pipelineID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":  taskID,
+		"decision": decision,
+		"status":   status,
+	})
+}
+
+// История решений по задаче в порядке принятия
+func getTaskApprovals(taskID int) ([]TaskApproval, error) {
+	rows, err := db.Query(`
+        SELECT a.decision, COALESCE(a.decided_by, 0), COALESCE(u.username, ''), a.decided_at, COALESCE(a.comment, '')
+        FROM task_approval a
+        LEFT JOIN "user" u ON a.decided_by = u.user_id
+        WHERE a.task_id = $1
+        ORDER BY a.decided_at, a.approval_id`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvals := []TaskApproval{}
+	for rows.Next() {
+		var approval TaskApproval
+		var decidedAt sql.NullTime
+		if err := rows.Scan(&approval.Decision, &approval.UserID, &approval.Username, &decidedAt, &approval.Comment); err != nil {
+			return nil, err
+		}
+		approval.DecidedAt = formatTime(decidedAt)
+		approvals = append(approvals, approval)
+	}
+	return approvals, rows.Err()
+}
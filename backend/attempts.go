@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Одна попытка выполнения задачи для истории в getTaskDetails
+type TaskAttempt struct {
+	AttemptNumber int    `json:"attempt_number"`
+	Status        string `json:"status"`
+	StartTime     string `json:"start_time"`
+	EndTime       string `json:"end_time"`
+	ExitCode      *int   `json:"exit_code"`
+	ErrorMessage  string `json:"error_message,omitempty"`
+}
+
+// Политика повторов задачи из полей retries, retry_delay и retry_on
+type retryPolicy struct {
+	Retries    int
+	RetryDelay time.Duration
+	RetryOn    []string
+}
+
+// Максимальная пауза между попытками при экспоненциальном росте задержки
+const maxRetryDelay = 10 * time.Minute
+
+// Задержка перед повтором после попытки attempt: retry_delay * 2^(attempt-1)
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.RetryDelay
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// Нужно ли повторить задачу после неудачной попытки attempt.
+// Пустой retry_on означает повтор при любой ошибке; числовые значения сравниваются
+// с кодом выхода, остальные считаются регулярными выражениями по выводу команды
+func (p retryPolicy) shouldRetry(attempt, exitCode int, output string) bool {
+	if attempt > p.Retries {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, rule := range p.RetryOn {
+		if code, err := strconv.Atoi(rule); err == nil {
+			if code == exitCode {
+				return true
+			}
+			continue
+		}
+		if re, err := regexp.Compile(rule); err == nil && re.MatchString(output) {
+			return true
+		}
+	}
+	return false
+}
+
+// Открывает новую попытку выполнения задачи и возвращает её идентификатор и номер
+func startTaskAttempt(q dbQuerier, taskID int) (int, int, error) {
+	var attemptID, attemptNumber int
+	err := q.QueryRow(`
+        INSERT INTO task_attempt (task_id, attempt_number, status, start_time)
+        SELECT $1, COALESCE(MAX(attempt_number), 0) + 1, 'Running', NOW()
+        FROM task_attempt WHERE task_id = $1
+        RETURNING attempt_id, attempt_number`, taskID).Scan(&attemptID, &attemptNumber)
+	return attemptID, attemptNumber, err
+}
+
+// Закрывает попытку с итоговым статусом; каждая неудачная попытка или таймаут +1 к error_count
+func finishTaskAttempt(q dbQuerier, taskID, attemptID int, status string, exitCode *int, message string) error {
+	_, err := q.Exec(`
+        UPDATE task_attempt
+        SET status = $1, end_time = NOW(), exit_code = $2, error_message = $3
+        WHERE attempt_id = $4`, status, exitCode, nilIfEmpty(message), attemptID)
+	if err != nil {
+		return err
+	}
+
+	if status == "Failed" || status == "TimedOut" {
+		_, err = q.Exec(`
+        INSERT INTO task_metrics (task_id, error_count, warning_count)
+        VALUES ($1, 1, 0)
+        ON CONFLICT (task_id) DO UPDATE SET error_count = task_metrics.error_count + 1
+    `, taskID)
+	}
+	return err
+}
+
+// Закрывает последнюю открытую попытку задачи (для ручной смены статуса).
+// Если открытой попытки нет, она создаётся, чтобы история не теряла результат
+func finishOpenTaskAttempt(q dbQuerier, taskID int, status string, message string) error {
+	var attemptID int
+	err := q.QueryRow(`
+        SELECT attempt_id FROM task_attempt
+        WHERE task_id = $1 AND status = 'Running'
+        ORDER BY attempt_number DESC LIMIT 1`, taskID).Scan(&attemptID)
+	if err == sql.ErrNoRows {
+		attemptID, _, err = startTaskAttempt(q, taskID)
+	}
+	if err != nil {
+		return err
+	}
+	return finishTaskAttempt(q, taskID, attemptID, status, nil, message)
+}
+
+// История попыток задачи в порядке выполнения
+func getTaskAttempts(taskID int) ([]TaskAttempt, error) {
+	rows, err := db.Query(`
+        SELECT attempt_number, status, start_time, end_time, exit_code, COALESCE(error_message, '')
+        FROM task_attempt
+        WHERE task_id = $1
+        ORDER BY attempt_number`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []TaskAttempt{}
+	for rows.Next() {
+		var attempt TaskAttempt
+		var startTime, endTime sql.NullTime
+		var exitCode sql.NullInt32
+		if err := rows.Scan(&attempt.AttemptNumber, &attempt.Status, &startTime, &endTime, &exitCode, &attempt.ErrorMessage); err != nil {
+			return nil, err
+		}
+		attempt.StartTime = formatTime(startTime)
+		attempt.EndTime = formatTime(endTime)
+		attempt.ExitCode = nullIntPtr(exitCode)
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
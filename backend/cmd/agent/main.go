@@ -0,0 +1,369 @@
+// Агент для выполнения задач с runs_on на удалённой машине.
+//
+// Агент регистрируется на сервере со своими метками, забирает задания через
+// long-poll, выполняет команду через sh -c, отправляет вывод и результат,
+// а пока команда работает - heartbeat, продлевающий аренду задания.
+// Полученные при регистрации идентификатор и токен сохраняются в файл -state,
+// чтобы после перезапуска агент продолжал работать под той же записью.
+//
+//	AGENT_REGISTRATION_TOKEN=... go run ./cmd/agent -server http://localhost:8080 -name local -labels linux,docker
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Сервер ответил 401: токен больше не действует, нужно зарегистрироваться заново
+var errUnauthorized = errors.New("агент не авторизован")
+
+type agentClient struct {
+	server            string
+	name              string
+	labels            []string
+	registrationToken string
+	statePath         string
+	httpClient        *http.Client
+
+	agentID   int
+	token     string
+	heartbeat time.Duration
+}
+
+// Сохранённая регистрация агента
+type agentState struct {
+	Server           string `json:"server"`
+	AgentID          int    `json:"agent_id"`
+	Token            string `json:"token"`
+	HeartbeatSeconds int    `json:"heartbeat_seconds"`
+}
+
+type job struct {
+	JobID    int               `json:"job_id"`
+	TaskID   int               `json:"task_id"`
+	TaskName string            `json:"task_name"`
+	Command  string            `json:"command"`
+	Env      map[string]string `json:"env"`
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "адрес сервера")
+	hostname, _ := os.Hostname()
+	name := flag.String("name", hostname, "имя агента")
+	labels := flag.String("labels", "", "метки агента через запятую")
+	registrationToken := flag.String("registration-token", os.Getenv("AGENT_REGISTRATION_TOKEN"), "токен регистрации (AGENT_REGISTRATION_TOKEN сервера)")
+	statePath := flag.String("state", "agent-state.json", "файл для идентификатора и токена агента")
+	flag.Parse()
+
+	client := &agentClient{
+		server:            strings.TrimRight(*server, "/"),
+		name:              *name,
+		registrationToken: *registrationToken,
+		statePath:         *statePath,
+		httpClient:        &http.Client{Timeout: 90 * time.Second},
+	}
+	for _, label := range strings.Split(*labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			client.labels = append(client.labels, label)
+		}
+	}
+	client.run()
+}
+
+// Основной цикл: регистрация, получение заданий, выполнение. Ошибки сети
+// не останавливают агента, а откладывают следующую попытку
+func (c *agentClient) run() {
+	if err := c.loadState(); err != nil {
+		log.Printf("Сохранённая регистрация не прочитана: %v", err)
+	} else if c.token != "" {
+		log.Printf("Агент %d (%s) продолжает работу по сохранённой регистрации", c.agentID, c.name)
+	}
+	backoff := time.Second
+	for {
+		if c.token == "" {
+			if err := c.register(); err != nil {
+				log.Printf("Ошибка регистрации: %v", err)
+				backoff = sleepBackoff(backoff)
+				continue
+			}
+			log.Printf("Агент %d (%s) зарегистрирован, метки: %s", c.agentID, c.name, strings.Join(c.labels, ", "))
+		}
+
+		next, err := c.lease()
+		if errors.Is(err, errUnauthorized) {
+			c.token = ""
+			continue
+		}
+		if err != nil {
+			log.Printf("Ошибка получения задания: %v", err)
+			backoff = sleepBackoff(backoff)
+			continue
+		}
+		backoff = time.Second
+		if next != nil {
+			c.execute(next)
+		}
+	}
+}
+
+func sleepBackoff(backoff time.Duration) time.Duration {
+	time.Sleep(backoff)
+	if backoff < time.Minute {
+		backoff *= 2
+	}
+	return backoff
+}
+
+func (c *agentClient) register() error {
+	var resp struct {
+		AgentID          int    `json:"agent_id"`
+		Token            string `json:"token"`
+		HeartbeatSeconds int    `json:"heartbeat_seconds"`
+	}
+	headers := map[string]string{}
+	if c.registrationToken != "" {
+		headers["X-Agent-Registration-Token"] = c.registrationToken
+	}
+	body := map[string]interface{}{"name": c.name, "labels": c.labels}
+	if _, err := c.post("/api/agents/register", headers, body, &resp); err != nil {
+		return err
+	}
+	c.setRegistration(resp.AgentID, resp.Token, resp.HeartbeatSeconds)
+	if err := c.saveState(resp.HeartbeatSeconds); err != nil {
+		log.Printf("Регистрация не сохранена в %s: %v", c.statePath, err)
+	}
+	return nil
+}
+
+func (c *agentClient) setRegistration(agentID int, token string, heartbeatSeconds int) {
+	c.agentID, c.token = agentID, token
+	c.heartbeat = time.Duration(heartbeatSeconds) * time.Second
+	if c.heartbeat <= 0 {
+		c.heartbeat = 10 * time.Second
+	}
+}
+
+// Регистрация из файла состояния; регистрация на другом сервере не используется
+func (c *agentClient) loadState() error {
+	data, err := os.ReadFile(c.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state agentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Server == c.server && state.Token != "" {
+		c.setRegistration(state.AgentID, state.Token, state.HeartbeatSeconds)
+	}
+	return nil
+}
+
+// Файл содержит токен агента, поэтому доступен только владельцу
+func (c *agentClient) saveState(heartbeatSeconds int) error {
+	data, err := json.Marshal(agentState{Server: c.server, AgentID: c.agentID, Token: c.token, HeartbeatSeconds: heartbeatSeconds})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.statePath, data, 0600)
+}
+
+// Ожидание задания; nil без ошибки - заданий пока нет
+func (c *agentClient) lease() (*job, error) {
+	var next job
+	status, err := c.agentPost("/lease?wait=30", nil, &next)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Выполнение задания: вывод отправляется пачками, heartbeat продлевает аренду
+// и останавливает команду, если сервер отменил задание
+func (c *agentClient) execute(next *job) {
+	log.Printf("Задание %d: задача %d (%s)", next.JobID, next.TaskID, next.TaskName)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", next.Command)
+	cmd.Env = os.Environ()
+	for key, value := range next.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	setProcessGroup(cmd)
+	// Не ждать бесконечно процессов, унаследовавших вывод команды
+	cmd.WaitDelay = 5 * time.Second
+
+	if err := cmd.Start(); err != nil {
+		c.report(next.JobID, -1, err.Error())
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.streamLogs(next.JobID, reader)
+	}()
+	stopHeartbeat := make(chan struct{})
+	go c.heartbeatLoop(next.JobID, cancel, stopHeartbeat)
+
+	err := cmd.Wait()
+	writer.Close()
+	wg.Wait()
+	close(stopHeartbeat)
+
+	if ctx.Err() != nil {
+		log.Printf("Задание %d отменено сервером", next.JobID)
+		return
+	}
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		c.report(next.JobID, -1, err.Error())
+		return
+	}
+	c.report(next.JobID, exitCode, "")
+}
+
+// Отправка вывода команды строками, не чаще раза в секунду или по 100 строк
+func (c *agentClient) streamLogs(jobID int, reader io.Reader) {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		// Дочитываем вывод, чтобы команда не заблокировалась на записи
+		io.Copy(io.Discard, reader)
+		close(lines)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var batch []string
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		path := fmt.Sprintf("/jobs/%d/logs", jobID)
+		if _, err := c.agentPost(path, map[string]interface{}{"lines": batch}, nil); err != nil {
+			log.Printf("Ошибка отправки вывода задания %d: %v", jobID, err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) >= 100 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (c *agentClient) heartbeatLoop(jobID int, cancel context.CancelFunc, stop chan struct{}) {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var resp struct {
+			Cancel []int `json:"cancel"`
+		}
+		if _, err := c.agentPost("/heartbeat", map[string]interface{}{"job_ids": []int{jobID}}, &resp); err != nil {
+			log.Printf("Ошибка heartbeat: %v", err)
+			continue
+		}
+		for _, id := range resp.Cancel {
+			if id == jobID {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (c *agentClient) report(jobID int, exitCode int, errMessage string) {
+	path := fmt.Sprintf("/jobs/%d/result", jobID)
+	body := map[string]interface{}{"exit_code": exitCode, "error": errMessage}
+	if _, err := c.agentPost(path, body, nil); err != nil {
+		log.Printf("Ошибка отправки результата задания %d: %v", jobID, err)
+		return
+	}
+	log.Printf("Задание %d завершено, код выхода %d", jobID, exitCode)
+}
+
+// Запрос к /api/agent/{agent_id}<path> с токеном агента
+func (c *agentClient) agentPost(path string, body interface{}, out interface{}) (int, error) {
+	headers := map[string]string{"Authorization": "Bearer " + c.token}
+	return c.post(fmt.Sprintf("/api/agent/%d%s", c.agentID, path), headers, body, out)
+}
+
+func (c *agentClient) post(path string, headers map[string]string, body interface{}, out interface{}) (int, error) {
+	payload := []byte("{}")
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, c.server+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return resp.StatusCode, errUnauthorized
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// Группы процессов есть только в Unix; здесь при отмене останавливается сам sh,
+// а от зависших дочерних процессов защищает cmd.WaitDelay
+func setProcessGroup(cmd *exec.Cmd) {}
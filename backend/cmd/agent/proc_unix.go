@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Команда запускается в своей группе процессов, и при таймауте или отмене
+// останавливается вся группа, а не только sh: иначе дочерний процесс, держащий
+// вывод, не даст cmd.Wait() завершиться
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
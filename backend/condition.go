@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Условия when задачи. Грамматика:
+//
+//	expr    := and ('||' and)*
+//	and     := unary ('&&' unary)*
+//	unary   := '!' unary | compare
+//	compare := value (('==' | '!=') value | 'in' value)?
+//	value   := '(' expr ')' | 'строка' | "строка" | [значение, ...] | name | call
+//	name    := on_success | on_failure | always | true | false | tags | vars.NAME
+//	call    := success() | failure() | cancelled() | always() | status('задача')
+//
+// success() - все задачи из depends_on завершились успешно (поведение по умолчанию),
+// failure() - хотя бы одна завершилась с Failed или TimedOut, cancelled() - хотя бы
+// одна отменена, status('имя') - статус задачи из depends_on, tags - теги самой задачи,
+// vars.NAME - переменная пайплайна
+
+// Значение выражения условия: строка, логическое значение или список строк
+type conditionValue struct {
+	kind conditionKind
+	str  string
+	flag bool
+	list []string
+}
+
+type conditionKind int
+
+const (
+	conditionString conditionKind = iota
+	conditionBool
+	conditionList
+)
+
+func (v conditionValue) truthy() bool {
+	switch v.kind {
+	case conditionBool:
+		return v.flag
+	case conditionList:
+		return len(v.list) > 0
+	}
+	return v.str != ""
+}
+
+// Данные, доступные условию при вычислении
+type conditionContext struct {
+	Upstream  map[string]string // статусы задач из depends_on по имени
+	Variables map[string]string
+	Tags      []string
+}
+
+// Разобранное условие when
+type taskCondition struct {
+	root      conditionNode
+	Variables []string // имена vars.NAME, на которые ссылается условие
+	Tasks     []string // имена задач из status('...')
+}
+
+type conditionNode func(ctx *conditionContext) (conditionValue, error)
+
+// Вычисление условия: true - задачу нужно выполнить
+func (c *taskCondition) eval(ctx *conditionContext) (bool, error) {
+	value, err := c.root(ctx)
+	if err != nil {
+		return false, err
+	}
+	return value.truthy(), nil
+}
+
+// Разбор условия when; ошибка содержит позицию символа в выражении
+func parseCondition(source string) (*taskCondition, error) {
+	tokens, err := tokenizeCondition(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens, condition: &taskCondition{}}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != conditionTokenEnd {
+		return nil, fmt.Errorf("позиция %d: неожиданный %q", tok.pos+1, tok.text)
+	}
+	p.condition.root = root
+	return p.condition, nil
+}
+
+type conditionTokenKind int
+
+const (
+	conditionTokenEnd conditionTokenKind = iota
+	conditionTokenName
+	conditionTokenString
+	conditionTokenOperator
+)
+
+var conditionOperators = map[string]bool{
+	"&&": true, "||": true, "==": true, "!=": true, "!": true, "(": true, ")": true, "[": true, "]": true, ",": true,
+}
+
+type conditionToken struct {
+	kind conditionTokenKind
+	text string
+	pos  int
+}
+
+func tokenizeCondition(source string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("позиция %d: незакрытая строка", i+1)
+			}
+			tokens = append(tokens, conditionToken{kind: conditionTokenString, text: string(runes[i+1 : end]), pos: i})
+			i = end + 1
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_' || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, conditionToken{kind: conditionTokenName, text: string(runes[i:end]), pos: i})
+			i = end
+		default:
+			text := string(r)
+			if i+1 < len(runes) {
+				if pair := string(runes[i : i+2]); pair == "&&" || pair == "||" || pair == "==" || pair == "!=" {
+					text = pair
+				}
+			}
+			if !conditionOperators[text] {
+				return nil, fmt.Errorf("позиция %d: недопустимый символ %q", i+1, text)
+			}
+			tokens = append(tokens, conditionToken{kind: conditionTokenOperator, text: text, pos: i})
+			i += len([]rune(text))
+		}
+	}
+	return append(tokens, conditionToken{kind: conditionTokenEnd, text: "конец выражения", pos: len(runes)}), nil
+}
+
+type conditionParser struct {
+	tokens    []conditionToken
+	pos       int
+	condition *taskCondition
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() conditionToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != conditionTokenEnd {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *conditionParser) accept(operator string) bool {
+	if tok := p.peek(); tok.kind == conditionTokenOperator && tok.text == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) expect(operator string) error {
+	if !p.accept(operator) {
+		tok := p.peek()
+		return fmt.Errorf("позиция %d: ожидается %q, найден %q", tok.pos+1, operator, tok.text)
+	}
+	return nil
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode(left, right, false)
+	}
+	return left, nil
+}
+
+// Логическое || (or = true) или && с вычислением по короткой схеме
+func logicalNode(left, right conditionNode, or bool) conditionNode {
+	return func(ctx *conditionContext) (conditionValue, error) {
+		l, err := left(ctx)
+		if err != nil {
+			return conditionValue{}, err
+		}
+		if l.truthy() == or {
+			return conditionValue{kind: conditionBool, flag: or}, nil
+		}
+		r, err := right(ctx)
+		if err != nil {
+			return conditionValue{}, err
+		}
+		return conditionValue{kind: conditionBool, flag: r.truthy()}, nil
+	}
+}
+
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *conditionContext) (conditionValue, error) {
+			v, err := operand(ctx)
+			return conditionValue{kind: conditionBool, flag: !v.truthy()}, err
+		}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *conditionParser) parseCompare() (conditionNode, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	switch {
+	case tok.kind == conditionTokenOperator && (tok.text == "==" || tok.text == "!="):
+		p.next()
+		right, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		negate := tok.text == "!="
+		return func(ctx *conditionContext) (conditionValue, error) {
+			l, err := left(ctx)
+			if err != nil {
+				return conditionValue{}, err
+			}
+			r, err := right(ctx)
+			if err != nil {
+				return conditionValue{}, err
+			}
+			if l.kind == conditionList || r.kind == conditionList {
+				return conditionValue{}, fmt.Errorf("списки нельзя сравнивать через %s, используйте in", tok.text)
+			}
+			equal := l.kind == r.kind && l.str == r.str && l.flag == r.flag
+			return conditionValue{kind: conditionBool, flag: equal != negate}, nil
+		}, nil
+	case tok.kind == conditionTokenName && tok.text == "in":
+		p.next()
+		right, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *conditionContext) (conditionValue, error) {
+			l, err := left(ctx)
+			if err != nil {
+				return conditionValue{}, err
+			}
+			r, err := right(ctx)
+			if err != nil {
+				return conditionValue{}, err
+			}
+			if r.kind != conditionList {
+				return conditionValue{}, fmt.Errorf("справа от in ожидается список")
+			}
+			return conditionValue{kind: conditionBool, flag: containsString(r.list, l.str)}, nil
+		}, nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseValue() (conditionNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case conditionTokenString:
+		value := conditionValue{kind: conditionString, str: tok.text}
+		return constantNode(value), nil
+	case conditionTokenOperator:
+		switch tok.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			var items []string
+			for !p.accept("]") {
+				if len(items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item := p.next()
+				if item.kind != conditionTokenString {
+					return nil, fmt.Errorf("позиция %d: элементы списка должны быть строками", item.pos+1)
+				}
+				items = append(items, item.text)
+			}
+			return constantNode(conditionValue{kind: conditionList, list: items}), nil
+		}
+	case conditionTokenName:
+		if p.accept("(") {
+			return p.parseCall(tok)
+		}
+		return p.parseName(tok)
+	}
+	return nil, fmt.Errorf("позиция %d: неожиданный %q", tok.pos+1, tok.text)
+}
+
+func constantNode(value conditionValue) conditionNode {
+	return func(*conditionContext) (conditionValue, error) {
+		return value, nil
+	}
+}
+
+func boolNode(fn func(ctx *conditionContext) bool) conditionNode {
+	return func(ctx *conditionContext) (conditionValue, error) {
+		return conditionValue{kind: conditionBool, flag: fn(ctx)}, nil
+	}
+}
+
+// Проверки статусов задач из depends_on
+func upstreamSucceeded(ctx *conditionContext) bool {
+	for _, status := range ctx.Upstream {
+		if status != "Completed" {
+			return false
+		}
+	}
+	return true
+}
+
+func upstreamHasStatus(statuses ...string) func(ctx *conditionContext) bool {
+	return func(ctx *conditionContext) bool {
+		for _, status := range ctx.Upstream {
+			if containsString(statuses, status) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (p *conditionParser) parseName(tok conditionToken) (conditionNode, error) {
+	switch tok.text {
+	case "true", "false":
+		return constantNode(conditionValue{kind: conditionBool, flag: tok.text == "true"}), nil
+	case "on_success":
+		return boolNode(upstreamSucceeded), nil
+	case "on_failure":
+		return boolNode(upstreamHasStatus("Failed", "TimedOut")), nil
+	case "always":
+		return constantNode(conditionValue{kind: conditionBool, flag: true}), nil
+	case "tags":
+		return func(ctx *conditionContext) (conditionValue, error) {
+			return conditionValue{kind: conditionList, list: ctx.Tags}, nil
+		}, nil
+	}
+	if strings.HasPrefix(tok.text, "vars.") && yamlVariableName.MatchString(strings.TrimPrefix(tok.text, "vars.")) {
+		name := strings.TrimPrefix(tok.text, "vars.")
+		p.condition.Variables = append(p.condition.Variables, name)
+		return func(ctx *conditionContext) (conditionValue, error) {
+			value, ok := ctx.Variables[name]
+			if !ok {
+				return conditionValue{}, fmt.Errorf("переменная %q не объявлена", name)
+			}
+			return conditionValue{kind: conditionString, str: value}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("позиция %d: неизвестное имя %q", tok.pos+1, tok.text)
+}
+
+func (p *conditionParser) parseCall(tok conditionToken) (conditionNode, error) {
+	switch tok.text {
+	case "success", "failure", "cancelled", "always":
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		switch tok.text {
+		case "success":
+			return boolNode(upstreamSucceeded), nil
+		case "failure":
+			return boolNode(upstreamHasStatus("Failed", "TimedOut")), nil
+		case "cancelled":
+			return boolNode(upstreamHasStatus("Cancelled")), nil
+		}
+		return constantNode(conditionValue{kind: conditionBool, flag: true}), nil
+	case "status":
+		arg := p.next()
+		if arg.kind != conditionTokenString {
+			return nil, fmt.Errorf("позиция %d: status() ожидает имя задачи в кавычках", arg.pos+1)
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		p.condition.Tasks = append(p.condition.Tasks, arg.text)
+		return func(ctx *conditionContext) (conditionValue, error) {
+			status, ok := ctx.Upstream[arg.text]
+			if !ok {
+				return conditionValue{}, fmt.Errorf("задача %q не входит в depends_on", arg.text)
+			}
+			return conditionValue{kind: conditionString, str: status}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("позиция %d: неизвестная функция %s()", tok.pos+1, tok.text)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConditionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "позиция 1: неожиданный \"конец выражения\""},
+		{"'abc", "позиция 1: незакрытая строка"},
+		{"on_success & always", "позиция 12: недопустимый символ \"&\""},
+		{"on_success always", "позиция 12: неожиданный \"always\""},
+		{"(on_success", "позиция 12: ожидается \")\", найден \"конец выражения\""},
+		{"unknown", "позиция 1: неизвестное имя \"unknown\""},
+		{"vars.1X == 'a'", "позиция 1: неизвестное имя \"vars.1X\""},
+		{"foo()", "позиция 1: неизвестная функция foo()"},
+		{"status(build)", "позиция 8: status() ожидает имя задачи в кавычках"},
+		{"success(x)", "позиция 9: ожидается \")\", найден \"x\""},
+		{"'a' in ['b' 'c']", "позиция 13: ожидается \",\", найден \"c\""},
+		{"'a' in ['b', c]", "позиция 14: элементы списка должны быть строками"},
+		{"vars.ENV ==", "позиция 12: неожиданный \"конец выражения\""},
+	}
+	for _, tt := range tests {
+		_, err := parseCondition(tt.source)
+		if err == nil {
+			t.Errorf("parseCondition(%q): ожидалась ошибка %q", tt.source, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("parseCondition(%q) = %q, ожидалось %q", tt.source, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestParseConditionReferences(t *testing.T) {
+	condition, err := parseCondition("vars.ENV == 'prod' && status('build') == 'Completed' || vars.REGION in ['eu'] && status('test') != 'Failed'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ENV", "REGION"}; !reflect.DeepEqual(condition.Variables, want) {
+		t.Errorf("Variables = %v, ожидалось %v", condition.Variables, want)
+	}
+	if want := []string{"build", "test"}; !reflect.DeepEqual(condition.Tasks, want) {
+		t.Errorf("Tasks = %v, ожидалось %v", condition.Tasks, want)
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	ctx := &conditionContext{
+		Upstream:  map[string]string{"build": "Completed", "test": "Failed"},
+		Variables: map[string]string{"ENV": "prod", "EMPTY": ""},
+		Tags:      []string{"deploy", "linux"},
+	}
+	succeeded := &conditionContext{Upstream: map[string]string{"build": "Completed"}}
+	cancelled := &conditionContext{Upstream: map[string]string{"build": "Cancelled"}}
+	timedOut := &conditionContext{Upstream: map[string]string{"build": "TimedOut"}}
+
+	tests := []struct {
+		source string
+		ctx    *conditionContext
+		want   bool
+	}{
+		{"true", ctx, true},
+		{"false", ctx, false},
+		{"always", ctx, true},
+		{"always()", cancelled, true},
+		{"on_success", ctx, false},
+		{"on_success", succeeded, true},
+		{"success()", succeeded, true},
+		{"on_failure", ctx, true},
+		{"failure()", succeeded, false},
+		{"failure()", timedOut, true},
+		{"cancelled()", cancelled, true},
+		{"cancelled()", ctx, false},
+		{"status('build') == 'Completed'", ctx, true},
+		{"status('test') == \"Failed\"", ctx, true},
+		{"status('test') != 'Failed'", ctx, false},
+		{"vars.ENV == 'prod'", ctx, true},
+		{"vars.ENV != 'prod'", ctx, false},
+		{"vars.EMPTY", ctx, false},
+		{"vars.ENV", ctx, true},
+		{"vars.ENV in ['dev', 'prod']", ctx, true},
+		{"vars.ENV in []", ctx, false},
+		{"'deploy' in tags", ctx, true},
+		{"'windows' in tags", ctx, false},
+		{"tags", ctx, true},
+		{"tags", succeeded, false},
+		{"true == 'true'", ctx, false},
+		{"true == true", ctx, true},
+		// ! связывает сильнее &&, && сильнее ||
+		{"!false && false", ctx, false},
+		{"!(false && false)", ctx, true},
+		{"!!true", ctx, true},
+		{"!vars.ENV == 'prod'", ctx, false},
+		{"true || false && false", ctx, true},
+		{"(true || false) && false", ctx, false},
+		{"false && false || true", ctx, true},
+		{"false || false || !false", ctx, true},
+		// Короткая схема: правая часть с ошибкой не вычисляется
+		{"true || vars.MISSING == 'x'", ctx, true},
+		{"false && status('deploy') == 'x'", ctx, false},
+	}
+	for _, tt := range tests {
+		condition, err := parseCondition(tt.source)
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", tt.source, err)
+			continue
+		}
+		got, err := condition.eval(tt.ctx)
+		if err != nil {
+			t.Errorf("eval(%q): %v", tt.source, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("eval(%q) = %v, ожидалось %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestConditionEvalErrors(t *testing.T) {
+	ctx := &conditionContext{
+		Upstream:  map[string]string{"build": "Completed"},
+		Variables: map[string]string{"ENV": "prod"},
+		Tags:      []string{"linux"},
+	}
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"vars.MISSING == 'x'", "переменная \"MISSING\" не объявлена"},
+		{"status('deploy') == 'Completed'", "задача \"deploy\" не входит в depends_on"},
+		{"tags == ['linux']", "списки нельзя сравнивать через ==, используйте in"},
+		{"'linux' in vars.ENV", "справа от in ожидается список"},
+		{"!vars.MISSING", "переменная \"MISSING\" не объявлена"},
+	}
+	for _, tt := range tests {
+		condition, err := parseCondition(tt.source)
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", tt.source, err)
+			continue
+		}
+		_, err = condition.eval(ctx)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("eval(%q): ошибка %v, ожидалось %q", tt.source, err, tt.want)
+		}
+	}
+}
+
+func TestEvaluateTaskCondition(t *testing.T) {
+	// build и lint - зависимости deploy
+	newGraph := func() *taskGraph {
+		graph := newTaskGraph(1)
+		graph.deps[3] = []int{1, 2}
+		return graph
+	}
+	newTasks := func(build, lint string) map[int]*engineTask {
+		return map[int]*engineTask{
+			1: {TaskID: 1, Name: "build", Status: build},
+			2: {TaskID: 2, Name: "lint", Status: lint},
+		}
+	}
+	parse := func(source string) *taskCondition {
+		condition, err := parseCondition(source)
+		if err != nil {
+			t.Fatalf("parseCondition(%q): %v", source, err)
+		}
+		return condition
+	}
+
+	tests := []struct {
+		name       string
+		build      string
+		lint       string
+		task       engineTask
+		wantRun    bool
+		wantStatus string
+		wantReason string
+	}{
+		{"по умолчанию все успешны", "Completed", "Completed", engineTask{}, true, "", ""},
+		{"по умолчанию зависимость упала", "Completed", "Failed", engineTask{}, false, "Skipped", "\"lint\" завершилась со статусом Failed"},
+		{"по умолчанию зависимость пропущена", "Skipped", "Completed", engineTask{}, false, "Skipped", "\"build\" завершилась со статусом Skipped"},
+		{"по умолчанию отмена важнее ошибки", "Failed", "Cancelled", engineTask{}, false, "Cancelled", "\"lint\" завершилась со статусом Cancelled"},
+		{"always после ошибки", "Failed", "Completed", engineTask{When: "always()", Condition: parse("always()")}, true, "", ""},
+		{"on_failure без ошибок", "Completed", "Completed", engineTask{When: "on_failure", Condition: parse("on_failure")}, false, "Skipped", "условие when \"on_failure\" не выполнено"},
+		{"status зависимости", "Completed", "Failed", engineTask{When: "status('lint') == 'Failed'", Condition: parse("status('lint') == 'Failed'")}, true, "", ""},
+		{"переменная", "Completed", "Completed", engineTask{When: "vars.ENV == 'prod'", Condition: parse("vars.ENV == 'prod'")}, true, "", ""},
+		{"теги задачи", "Completed", "Completed", engineTask{When: "'gpu' in tags", Condition: parse("'gpu' in tags"), Tags: []string{"linux"}}, false, "Skipped", "не выполнено"},
+		{"ошибка вычисления", "Completed", "Completed", engineTask{When: "vars.NOPE == 'x'", Condition: parse("vars.NOPE == 'x'")}, false, "Skipped", "ошибка в условии when"},
+		{"ошибка разбора", "Completed", "Completed", engineTask{When: "((", ConditionErr: errors.New("позиция 3")}, false, "Skipped", "некорректное условие when \"((\": позиция 3"},
+	}
+	for _, tt := range tests {
+		task := tt.task
+		task.TaskID, task.Name = 3, "deploy"
+		run, status, reason := evaluateTaskCondition(newGraph(), newTasks(tt.build, tt.lint), &task, map[string]string{"ENV": "prod"})
+		if run != tt.wantRun || status != tt.wantStatus || !strings.Contains(reason, tt.wantReason) {
+			t.Errorf("%s: (%v, %q, %q), ожидалось (%v, %q, ...%q...)", tt.name, run, status, reason, tt.wantRun, tt.wantStatus, tt.wantReason)
+		}
+	}
+}
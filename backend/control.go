@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Остановка задачи со статусом TimedOut или Cancelled. Задачу движка прерывает сам движок,
+// задачу, которую ведут вручную через /api/task/update, завершаем здесь.
+// Зависимые задачи после отмены тоже отменяются, после таймаута - пропускаются.
+// Возвращает false, если задача уже не выполняется и не ожидает запуска
+func stopTask(taskID, pipelineID int, status, reason string) bool {
+	if interruptTask(taskID, status, reason) {
+		return true
+	}
+
+	// Таймаут бывает только у выполняющейся задачи, отменить можно и ожидающую
+	allowed := []string{"Running", "WaitingForApproval"}
+	if status == "Cancelled" {
+		allowed = append(allowed, "Pending")
+	}
+	var previous string
+	err := db.QueryRow(`
+        UPDATE task t SET status = $2, end_time = CASE WHEN t.status = 'Running' THEN NOW() END, status_reason = $3
+        FROM (SELECT task_id, status FROM task WHERE task_id = $1 FOR UPDATE) old
+        WHERE t.task_id = old.task_id AND old.status = ANY($4::text[])
+        RETURNING old.status`, taskID, status, reason, pq.Array(allowed)).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.Printf("Ошибка при переводе задачи %d в %s: %v", taskID, status, err)
+		return false
+	}
+	if previous == "Running" {
+		if err := finishOpenTaskAttempt(db, taskID, status, reason); err != nil {
+			log.Printf("Ошибка при завершении попытки задачи %d: %v", taskID, err)
+		}
+	}
+	sendTaskUpdate(taskID)
+
+	// Задачи движка, которые ещё ждут запуска, движок остановит сам, когда дойдёт до них
+	graph, err := loadPipelineGraph(db, pipelineID)
+	if err != nil {
+		log.Printf("Ошибка при загрузке графа пайплайна %d: %v", pipelineID, err)
+		return true
+	}
+	downstreamStatus := "Skipped"
+	if status == "Cancelled" {
+		downstreamStatus = "Cancelled"
+	}
+	if err := markPendingTasks(graph.downstream(taskID), downstreamStatus, reason); err != nil {
+		log.Printf("Ошибка при остановке задач, зависящих от задачи %d: %v", taskID, err)
+	}
+	sendPipelineUpdate(pipelineID)
+	return true
+}
+
+// Остановка пайплайна со статусом TimedOut или Cancelled: выполняющиеся задачи
+// получают тот же статус, ожидающие - Skipped при таймауте и Cancelled при отмене
+func stopPipeline(pipelineID int, status, reason string) {
+	if interruptPipeline(pipelineID, status, reason) {
+		return
+	}
+
+	rows, err := db.Query(`SELECT task_id FROM task WHERE pipeline_id = $1 AND status = 'Running'`, pipelineID)
+	if err != nil {
+		log.Printf("Ошибка при получении задач пайплайна %d: %v", pipelineID, err)
+		return
+	}
+	var running []int
+	for rows.Next() {
+		var taskID int
+		if err := rows.Scan(&taskID); err == nil {
+			running = append(running, taskID)
+		}
+	}
+	rows.Close()
+	for _, taskID := range running {
+		stopTask(taskID, pipelineID, status, reason)
+	}
+
+	var pending []int
+	rows, err = db.Query(`SELECT task_id FROM task WHERE pipeline_id = $1 AND status = 'Pending'`, pipelineID)
+	if err != nil {
+		log.Printf("Ошибка при получении задач пайплайна %d: %v", pipelineID, err)
+		return
+	}
+	for rows.Next() {
+		var taskID int
+		if err := rows.Scan(&taskID); err == nil {
+			pending = append(pending, taskID)
+		}
+	}
+	rows.Close()
+	pendingStatus := "Skipped"
+	if status == "Cancelled" {
+		pendingStatus = "Cancelled"
+	}
+	if err := markPendingTasks(pending, pendingStatus, reason); err != nil {
+		log.Printf("Ошибка при остановке задач пайплайна %d: %v", pipelineID, err)
+	}
+
+	if err := setPipelineStatus(pipelineID, status, reason); err != nil {
+		log.Printf("Ошибка при переводе пайплайна %d в %s: %v", pipelineID, status, err)
+	}
+}
+
+// Ошибка обработки запроса внутри транзакции, которую нужно вернуть клиенту с HTTP-статусом
+type requestError struct {
+	Code    int
+	Message string
+}
+
+func (e *requestError) Error() string { return e.Message }
+
+// Причина отмены из параметра reason или текст по умолчанию
+func cancelReason(r *http.Request, fallback string) string {
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return reason
+	}
+	return fallback
+}
+
+// Статус пайплайна по идентификатору из пути запроса; пишет ошибку в ответ, если не найден
+func pipelineStatusFromPath(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	pipelineID, err := strconv.Atoi(mux.Vars(r)["pipeline_id"])
+	if err != nil {
+		http.Error(w, "Некорректный pipeline_id", http.StatusBadRequest)
+		return 0, "", false
+	}
+	var status string
+	err = db.QueryRow(`SELECT status FROM pipeline WHERE pipeline_id = $1`, pipelineID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Pipeline not found", http.StatusNotFound)
+		return 0, "", false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, "", false
+	}
+	return pipelineID, status, true
+}
+
+// Отмена пайплайна: выполняющиеся и ожидающие задачи переходят в Cancelled
+func cancelPipelineHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, status, ok := pipelineStatusFromPath(w, r)
+	if !ok {
+		return
+	}
+	if status != "Running" && status != "Paused" && status != "Pending" {
+		http.Error(w, fmt.Sprintf("Пайплайн в статусе %s нельзя отменить", status), http.StatusConflict)
+		return
+	}
+
+	stopPipeline(pipelineID, "Cancelled", cancelReason(r, "пайплайн отменён пользователем"))
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Пайплайн отменён")
+}
+
+// Пауза планировщика: новые задачи пайплайна не запускаются, выполняющиеся дорабатывают
+func pausePipelineHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, status, ok := pipelineStatusFromPath(w, r)
+	if !ok {
+		return
+	}
+	if status != "Running" || !pausePipelineExecution(pipelineID, true) {
+		http.Error(w, "Пайплайн не выполняется", http.StatusConflict)
+		return
+	}
+
+	if err := setPipelineStatus(pipelineID, "Paused", cancelReason(r, "")); err != nil {
+		http.Error(w, "Ошибка при обновлении статуса пайплайна", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Пайплайн приостановлен")
+}
+
+// Снятие паузы. Если движок не выполняет пайплайн (например, после перезапуска сервера),
+// выполнение начинается заново с незавершённых задач
+func resumePipelineHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, status, ok := pipelineStatusFromPath(w, r)
+	if !ok {
+		return
+	}
+	if status != "Paused" {
+		http.Error(w, "Пайплайн не на паузе", http.StatusConflict)
+		return
+	}
+
+	if pausePipelineExecution(pipelineID, false) {
+		// Время начала сохраняется: пауза - часть выполнения пайплайна
+		if err := markPipelineResumed(pipelineID); err != nil {
+			http.Error(w, "Ошибка при обновлении статуса пайплайна", http.StatusInternalServerError)
+			return
+		}
+	} else if err := startPipelineExecution(pipelineID, true); err != nil && err != errPipelineAlreadyRunning {
+		http.Error(w, "Ошибка запуска пайплайна", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Выполнение пайплайна продолжено")
+}
+
+// Отмена одной задачи; зависимые от неё задачи тоже отменяются
+func cancelTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Некорректный task_id", http.StatusBadRequest)
+		return
+	}
+
+	var pipelineID int
+	err = db.QueryRow(`SELECT pipeline_id FROM task WHERE task_id = $1`, taskID).Scan(&pipelineID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка при получении pipeline_id задачи", http.StatusInternalServerError)
+		return
+	}
+
+	if !stopTask(taskID, pipelineID, "Cancelled", cancelReason(r, "задача отменена пользователем")) {
+		http.Error(w, "Задача уже завершена", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Задача отменена")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Образ alpine не содержит базы часовых поясов, поэтому она встраивается в бинарник
+	_ "time/tzdata"
+)
+
+// Разобранное cron-выражение из пяти полей: минута, час, день месяца, месяц, день недели.
+// Каждое поле - битовая маска допустимых значений
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // поле начинается с * (*, */2): при обоих ограниченных полях достаточно совпадения одного
+}
+
+// Границы и имена значений поля cron
+type cronField struct {
+	Name     string
+	Min, Max int
+	Names    map[string]int
+}
+
+var cronFields = []cronField{
+	{Name: "минута", Min: 0, Max: 59},
+	{Name: "час", Min: 0, Max: 23},
+	{Name: "день месяца", Min: 1, Max: 31},
+	{Name: "месяц", Min: 1, Max: 12, Names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	// 7 - тоже воскресенье
+	{Name: "день недели", Min: 0, Max: 7, Names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+// Сокращённые записи расписаний
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Разбор cron-выражения: "*/15 9-18 * * mon-fri", списки через запятую,
+// диапазоны, шаги, имена месяцев и дней недели, а также @daily и другие сокращения
+func parseCron(expression string) (*cronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	if macro, ok := cronMacros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+	parts := strings.Fields(expression)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("ожидается %d полей cron, получено %d", len(cronFields), len(parts))
+	}
+
+	masks := make([]uint64, len(parts))
+	for i, part := range parts {
+		mask, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		masks[i] = mask
+	}
+	// Воскресенье можно записать как 0 и как 7
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	return &cronSchedule{
+		minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		domAny: strings.HasPrefix(parts[2], "*"), dowAny: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+func parseCronField(value string, field cronField) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(value, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			rangePart = item[:i]
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("некорректный шаг %q в поле \"%s\"", item, field.Name)
+			}
+		}
+
+		low, high := field.Min, field.Max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = cronValue(bounds[0], field); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = cronValue(bounds[1], field); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/10" - с 5 до конца диапазона с шагом 10
+				high = field.Max
+			}
+			if low > high {
+				return 0, fmt.Errorf("некорректный диапазон %q в поле \"%s\"", rangePart, field.Name)
+			}
+		}
+		for v := low; v <= high; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func cronValue(value string, field cronField) (int, error) {
+	if n, ok := field.Names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < field.Min || n > field.Max {
+		return 0, fmt.Errorf("значение %q вне диапазона %d-%d в поле \"%s\"", value, field.Min, field.Max, field.Name)
+	}
+	return n, nil
+}
+
+// Ближайшее время срабатывания строго после after в часовом поясе after.
+// Нулевое время, если выражение не срабатывает в ближайшие пять лет (например, 31 февраля).
+// Поиск идёт по показаниям часов, поэтому при переводе часов назад повторный час
+// не срабатывает второй раз, а время, пропущенное при переводе вперёд, сдвигается на
+// длину перехода (02:30 -> 03:30)
+func (s *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	// Показания часов в поясе after, записанные в UTC, где нет переходов
+	wall := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := wall.AddDate(5, 0, 0)
+
+	for wall.Before(limit) {
+		if s.month&(1<<uint(wall.Month())) == 0 {
+			wall = time.Date(wall.Year(), wall.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(wall) {
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(wall.Hour())) == 0 {
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.minute&(1<<uint(wall.Minute())) == 0 {
+			wall = wall.Add(time.Minute)
+			continue
+		}
+		// Показания повторного часа, которые after уже прошёл, пропускаются
+		if t := wallClockTime(wall, loc); t.After(after) {
+			return t
+		}
+		wall = wall.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// Момент, когда часы в поясе loc показывают wall. Повторяющиеся показания дают
+// первый из моментов, которые выберет time.Date; показания, пропущенные при переводе
+// часов вперёд, отсчитываются по смещению до перехода и попадают после него
+func wallClockTime(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, loc)
+	if t.Hour() == wall.Hour() && t.Minute() == wall.Minute() {
+		return t
+	}
+	_, offset := time.Date(wall.Year(), wall.Month(), wall.Day()-1, wall.Hour(), wall.Minute(), 0, 0, loc).Zone()
+	return wall.Add(-time.Duration(offset) * time.Second).In(loc)
+}
+
+// Совпадение дня: если ограничены и день месяца, и день недели, достаточно одного из них
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Времена срабатывания в интервале (from, to]; сохраняются только последние limit
+func (s *cronSchedule) between(from, to time.Time, limit int) []time.Time {
+	var times []time.Time
+	for t := s.next(from); !t.IsZero() && !t.After(to); t = s.next(t) {
+		times = append(times, t)
+		if len(times) > limit {
+			times = times[1:]
+		}
+	}
+	return times
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"* * * *", "ожидается 5 полей cron, получено 4"},
+		{"60 * * * *", "значение \"60\" вне диапазона 0-59 в поле \"минута\""},
+		{"* 24 * * *", "вне диапазона 0-23 в поле \"час\""},
+		{"* * 0 * *", "вне диапазона 1-31 в поле \"день месяца\""},
+		{"* * * 13 *", "вне диапазона 1-12 в поле \"месяц\""},
+		{"* * * * 8", "вне диапазона 0-7 в поле \"день недели\""},
+		{"*/0 * * * *", "некорректный шаг \"*/0\" в поле \"минута\""},
+		{"*/x * * * *", "некорректный шаг \"*/x\" в поле \"минута\""},
+		{"30-10 * * * *", "некорректный диапазон \"30-10\" в поле \"минута\""},
+		{"* * * * fri-mon", "некорректный диапазон \"fri-mon\" в поле \"день недели\""},
+		{"* * * foo *", "значение \"foo\" вне диапазона 1-12 в поле \"месяц\""},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.expression)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseCron(%q): ошибка %v, ожидалось %q", tt.expression, err, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := time.UTC
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, utc)
+	}
+	// 2024-01-01 - понедельник
+	start := at(2024, 1, 1, 0, 0)
+
+	tests := []struct {
+		expression string
+		after      time.Time
+		want       time.Time
+	}{
+		{"* * * * *", start, at(2024, 1, 1, 0, 1)},
+		{"* * * * *", start.Add(30 * time.Second), at(2024, 1, 1, 0, 1)},
+		{"*/15 * * * *", at(2024, 1, 1, 0, 15), at(2024, 1, 1, 0, 30)},
+		{"5/20 * * * *", at(2024, 1, 1, 0, 45), at(2024, 1, 1, 1, 5)},
+		{"10-20/5 * * * *", at(2024, 1, 1, 0, 16), at(2024, 1, 1, 0, 20)},
+		{"0 9-18 * * *", at(2024, 1, 1, 18, 30), at(2024, 1, 2, 9, 0)},
+		{"0,30 8 * * *", at(2024, 1, 1, 8, 0), at(2024, 1, 1, 8, 30)},
+		{"0 0 1 * *", start, at(2024, 2, 1, 0, 0)},
+		{"0 0 29 2 *", start, at(2024, 2, 29, 0, 0)},
+		{"0 0 29 2 *", at(2024, 3, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+		{"@daily", start, at(2024, 1, 2, 0, 0)},
+		{"@hourly", start, at(2024, 1, 1, 1, 0)},
+		{"@weekly", start, at(2024, 1, 7, 0, 0)},
+		{"@yearly", start, at(2025, 1, 1, 0, 0)},
+		// Имена месяцев и дней недели без учёта регистра
+		{"0 12 * JUN *", start, at(2024, 6, 1, 12, 0)},
+		{"0 9 * * mon-fri", at(2024, 1, 5, 10, 0), at(2024, 1, 8, 9, 0)},
+		{"0 9 * * Sat,sun", start, at(2024, 1, 6, 9, 0)},
+		// 7 и 0 - воскресенье
+		{"0 0 * * 7", start, at(2024, 1, 7, 0, 0)},
+		{"0 0 * * 0", start, at(2024, 1, 7, 0, 0)},
+		{"0 0 * * 5-7", start, at(2024, 1, 5, 0, 0)},
+		// Ограничены день месяца и день недели: достаточно одного (13-е или пятница)
+		{"0 0 13 * fri", start, at(2024, 1, 5, 0, 0)},
+		{"0 0 13 * fri", at(2024, 1, 12, 0, 0), at(2024, 1, 13, 0, 0)},
+		// Поле, начинающееся с *, не ограничивает день: нужны оба совпадения
+		{"0 0 */1 * fri", start, at(2024, 1, 5, 0, 0)},
+		{"0 0 */2 * fri", start, at(2024, 1, 5, 0, 0)},
+		{"0 0 */2 * fri", at(2024, 1, 5, 0, 0), at(2024, 1, 19, 0, 0)},
+		{"0 0 13 * */1", start, at(2024, 1, 13, 0, 0)},
+		// Несуществующая дата
+		{"0 0 31 2 *", start, time.Time{}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expression)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expression, err)
+			continue
+		}
+		if got := schedule.next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("%q.next(%s) = %s, ожидалось %s", tt.expression, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+
+	// 2024-03-10 02:00 EST -> 03:00 EDT: 02:30 не существует и сдвигается на 03:30
+	schedule, _ := parseCron("30 2 * * *")
+	after := time.Date(2024, 3, 10, 0, 0, 0, 0, ny)
+	want := time.Date(2024, 3, 10, 3, 30, 0, 0, ny)
+	if got := schedule.next(after); !got.Equal(want) {
+		t.Errorf("переход вперёд: %s, ожидалось %s", got, want)
+	}
+	if got, want := schedule.next(want), time.Date(2024, 3, 11, 2, 30, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("после перехода вперёд: %s, ожидалось %s", got, want)
+	}
+
+	// Каждую минуту в час перехода вперёд: без повторов и без движения назад
+	schedule, _ = parseCron("* * * * *")
+	prev := time.Date(2024, 3, 10, 1, 58, 0, 0, ny)
+	for i := 0; i < 5; i++ {
+		next := schedule.next(prev)
+		if !next.After(prev) || next.Sub(prev) > time.Minute {
+			t.Fatalf("каждую минуту после %s: %s", prev, next)
+		}
+		prev = next
+	}
+
+	// 2024-11-03 02:00 EDT -> 01:00 EST: 01:30 наступает дважды, срабатывание одно
+	schedule, _ = parseCron("30 1 * * *")
+	first := schedule.next(time.Date(2024, 11, 3, 0, 0, 0, 0, ny))
+	if first.Hour() != 1 || first.Minute() != 30 || first.Day() != 3 {
+		t.Fatalf("переход назад: %s", first)
+	}
+	if got, want := schedule.next(first), time.Date(2024, 11, 4, 1, 30, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("повторный 01:30: %s, ожидалось %s", got, want)
+	}
+	// Запуск внутри повторного часа не возвращает время из прошлого
+	secondPass := first.Add(time.Hour)
+	if got, want := schedule.next(secondPass), time.Date(2024, 11, 4, 1, 30, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("после повторного 01:30: %s, ожидалось %s", got, want)
+	}
+}
+
+func TestCronBetween(t *testing.T) {
+	schedule, _ := parseCron("0 * * * *")
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC)
+
+	// Интервал (from, to]: from не входит, to входит
+	got := schedule.between(from, to, 100)
+	if len(got) != 5 || !got[0].Equal(from.Add(time.Hour)) || !got[4].Equal(to) {
+		t.Errorf("between = %v", got)
+	}
+	// Сохраняются последние limit срабатываний
+	got = schedule.between(from, to, 2)
+	if len(got) != 2 || !got[0].Equal(to.Add(-time.Hour)) || !got[1].Equal(to) {
+		t.Errorf("between с limit = %v", got)
+	}
+	if got := schedule.between(from, from.Add(30*time.Minute), 100); len(got) != 0 {
+		t.Errorf("between без срабатываний = %v", got)
+	}
+}
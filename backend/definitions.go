@@ -0,0 +1,491 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Определение пайплайна: шаблон, из которого создаются запуски (строки pipeline)
+type PipelineDefinition struct {
+	DefinitionID  int                 `json:"definition_id"`
+	Name          string              `json:"name"`
+	Description   string              `json:"description"`
+	LatestVersion int                 `json:"latest_version"`
+	RunCount      int                 `json:"run_count"`
+	CreatedAt     string              `json:"created_at"`
+	Versions      []DefinitionVersion `json:"versions,omitempty"`
+	Runs          []PipelineRun       `json:"runs,omitempty"`
+}
+
+// Версия YAML определения
+type DefinitionVersion struct {
+	Version   int    `json:"version"`
+	CreatedAt string `json:"created_at"`
+	YAML      string `json:"yaml,omitempty"`
+}
+
+// Запуск определения со своими задачами, временем и метриками
+type PipelineRun struct {
+	PipelineID   int               `json:"pipeline_id"`
+	RunNumber    int               `json:"run_number"`
+	Version      int               `json:"version"`
+	Status       string            `json:"status"`
+	StartTime    string            `json:"start_time"`
+	EndTime      string            `json:"end_time"`
+	Variables    map[string]string `json:"variables,omitempty"`
+	ScheduleID   *int              `json:"schedule_id,omitempty"` // расписание, создавшее запуск
+	TriggerID    *int              `json:"trigger_id,omitempty"`  // триггер webhook, создавший запуск
+	Branch       string            `json:"branch,omitempty"`
+	CommitSHA    string            `json:"commit_sha,omitempty"`
+	CommitAuthor string            `json:"commit_author,omitempty"`
+}
+
+// Сохраняет YAML как новую версию определения с именем pipeline.name.
+// Определение создаётся при первой загрузке; каждая загрузка, даже с тем же YAML,
+// создаёт новую неизменяемую версию. Возвращает идентификатор определения и номер версии
+func saveDefinitionVersion(tx *sql.Tx, yamlData *YamlPipeline, content string) (int, int, error) {
+	var definitionID int
+	err := tx.QueryRow(`SELECT definition_id FROM pipeline_definition WHERE name = $1 FOR UPDATE`, yamlData.Pipeline.Name).Scan(&definitionID)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(`
+            INSERT INTO pipeline_definition (name, description) VALUES ($1, $2)
+            RETURNING definition_id`, yamlData.Pipeline.Name, yamlData.Pipeline.Description).Scan(&definitionID)
+	} else if err == nil {
+		_, err = tx.Exec(`UPDATE pipeline_definition SET description = $1 WHERE definition_id = $2`, yamlData.Pipeline.Description, definitionID)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Вместе с YAML сохраняются версии include без version, чтобы эта версия
+	// определения и дальше разбиралась так же, как при загрузке
+	var includeVersions interface{}
+	if len(yamlData.IncludeVersions) > 0 {
+		encoded, err := json.Marshal(yamlData.IncludeVersions)
+		if err != nil {
+			return 0, 0, err
+		}
+		includeVersions = string(encoded)
+	}
+	var version int
+	err = tx.QueryRow(`
+        INSERT INTO pipeline_definition_version (definition_id, version, yaml, include_versions)
+        SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3
+        FROM pipeline_definition_version WHERE definition_id = $1
+        RETURNING version`, definitionID, content, includeVersions).Scan(&version)
+	return definitionID, version, err
+}
+
+// Загрузка YAML версии определения; version = 0 означает последнюю версию.
+// overrides переопределяют переменные определения для создаваемого запуска
+func loadDefinitionVersion(q dbQuerier, definitionID, version int, overrides map[string]string) (*YamlPipeline, int, error) {
+	var content string
+	var includeVersionsJSON []byte
+	err := q.QueryRow(`
+        SELECT version, yaml, include_versions FROM pipeline_definition_version
+        WHERE definition_id = $1 AND ($2 = 0 OR version = $2)
+        ORDER BY version DESC LIMIT 1`, definitionID, version).Scan(&version, &content, &includeVersionsJSON)
+	if err != nil {
+		return nil, 0, err
+	}
+	var includeVersions map[string]int
+	if includeVersionsJSON != nil {
+		if err := json.Unmarshal(includeVersionsJSON, &includeVersions); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	yamlData, err := parsePipelineYAML([]byte(content), yamlParseOptions{
+		Overrides:       overrides,
+		Definitions:     q,
+		IncludeVersions: includeVersions,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return yamlData, version, nil
+}
+
+// Создание запуска определения: строка pipeline с очередным run_number и экземпляры задач.
+// В новом запуске (fresh) все задачи ожидают выполнения, иначе статусы берутся из YAML
+func createPipelineRun(tx *sql.Tx, yamlData *YamlPipeline, definitionID, version int, fresh bool) (int, error) {
+	pipelineTimeout, _ := parseYamlDuration(yamlData.Pipeline.Timeout)
+
+	// Блокировка определения, чтобы параллельные запуски не получили одинаковый run_number
+	if _, err := tx.Exec(`SELECT 1 FROM pipeline_definition WHERE definition_id = $1 FOR UPDATE`, definitionID); err != nil {
+		return 0, err
+	}
+
+	var pipelineID int
+	err := tx.QueryRow(`
+        INSERT INTO pipeline (name, description, status, max_parallel, timeout_seconds, definition_id, definition_version, run_number, variables)
+        SELECT $1, $2, 'Pending', $3, $4, $5, $6, COALESCE(MAX(run_number), 0) + 1, $7
+        FROM pipeline WHERE definition_id = $5
+        RETURNING pipeline_id`,
+		yamlData.Pipeline.Name, yamlData.Pipeline.Description, nilIfZero(yamlData.Pipeline.MaxParallel),
+		nilIfZero(int(pipelineTimeout/time.Second)), definitionID, version, stringMapJSON(yamlData.Pipeline.Variables),
+	).Scan(&pipelineID)
+	if err != nil {
+		return 0, err
+	}
+
+	taskNameToID := make(map[string]int)
+	currentTime := time.Now()
+
+	for i, t := range yamlData.Pipeline.Tasks {
+		status, progress := t.Status, t.Progress
+		if fresh || status == "" {
+			status, progress = "Pending", 0
+		}
+
+		var startTime, endTime interface{}
+		switch status {
+		case "Running":
+			startTime = currentTime
+		case "Completed", "Failed":
+			startTime = currentTime
+			endTime = currentTime
+		}
+
+		var assignedTo interface{}
+		if t.Assignee != "" {
+			var userID int
+			if err := tx.QueryRow(`SELECT user_id FROM "user" WHERE username = $1`, t.Assignee).Scan(&userID); err == nil {
+				assignedTo = userID
+			}
+		}
+
+		retryDelay, _ := parseYamlDuration(t.RetryDelay)
+		timeout, _ := parseYamlDuration(t.Timeout)
+		taskType := t.Type
+		if taskType == "" {
+			taskType = "command"
+		}
+
+		// tags в Go []string соответствуют TEXT[] в PostgreSQL
+		var taskID int
+		err = tx.QueryRow(`
+            INSERT INTO task (pipeline_id, name, description, status, "order", progress_percentage, assigned_to, start_time, end_time, tags, command,
+                              retries, retry_delay_seconds, retry_on, timeout_seconds, task_type, approval_level, matrix_group, matrix_values, condition, runs_on)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21) RETURNING task_id`,
+			pipelineID, t.Name, t.Description, status, i+1, progress, assignedTo, startTime, endTime, pqStringArray(t.Tags), nilIfEmpty(t.shellCommand()),
+			t.Retries, int(retryDelay/time.Second), pqStringArray(t.RetryOn), nilIfZero(int(timeout/time.Second)), taskType, nilIfEmpty(t.ApprovalLevel),
+			nilIfEmpty(t.MatrixGroup), stringMapJSON(t.MatrixValues), nilIfEmpty(t.When), pqStringArray(t.RunsOn),
+		).Scan(&taskID)
+		if err != nil {
+			return 0, err
+		}
+		taskNameToID[t.Name] = taskID
+
+		// Если статус Failed, прибавляем +1 к error_count
+		errorCount := 0
+		if status == "Failed" {
+			errorCount = 1
+		}
+		_, err = tx.Exec(`
+            INSERT INTO task_metrics (task_id, error_count, warning_count)
+            VALUES ($1, $2, 0)`, taskID, errorCount)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var edges []dependencyEdge
+	for _, t := range yamlData.Pipeline.Tasks {
+		for _, depName := range t.DependsOn {
+			edges = append(edges, dependencyEdge{TaskID: taskNameToID[t.Name], DependsOnID: taskNameToID[depName]})
+		}
+	}
+	if err := applyDependencyChanges(tx, pipelineID, edges, nil); err != nil {
+		return 0, err
+	}
+	return pipelineID, nil
+}
+
+// Список определений пайплайнов с числом запусков
+func getDefinitionsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+        SELECT d.definition_id, d.name, COALESCE(d.description, ''), d.created_at,
+               COALESCE((SELECT MAX(version) FROM pipeline_definition_version v WHERE v.definition_id = d.definition_id), 0),
+               (SELECT COUNT(*) FROM pipeline p WHERE p.definition_id = d.definition_id)
+        FROM pipeline_definition d
+        ORDER BY d.definition_id`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	definitions := []PipelineDefinition{}
+	for rows.Next() {
+		var definition PipelineDefinition
+		var createdAt sql.NullTime
+		if err := rows.Scan(&definition.DefinitionID, &definition.Name, &definition.Description, &createdAt,
+			&definition.LatestVersion, &definition.RunCount); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		definition.CreatedAt = formatTime(createdAt)
+		definitions = append(definitions, definition)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(definitions)
+}
+
+// Определение пайплайна с историей версий и запусков
+func getDefinitionHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+
+	var definition PipelineDefinition
+	var createdAt sql.NullTime
+	err = db.QueryRow(`
+        SELECT definition_id, name, COALESCE(description, ''), created_at
+        FROM pipeline_definition WHERE definition_id = $1`, definitionID).Scan(
+		&definition.DefinitionID, &definition.Name, &definition.Description, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Определение не найдено", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	definition.CreatedAt = formatTime(createdAt)
+
+	definition.Versions, err = getDefinitionVersions(definitionID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки версий определения", http.StatusInternalServerError)
+		return
+	}
+	if n := len(definition.Versions); n > 0 {
+		definition.LatestVersion = definition.Versions[n-1].Version
+	}
+
+	definition.Runs, err = getDefinitionRuns(definitionID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки запусков определения", http.StatusInternalServerError)
+		return
+	}
+	definition.RunCount = len(definition.Runs)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(definition)
+}
+
+// Версии определения по возрастанию номера
+func getDefinitionVersions(definitionID int) ([]DefinitionVersion, error) {
+	rows, err := db.Query(`
+        SELECT version, created_at FROM pipeline_definition_version
+        WHERE definition_id = $1 ORDER BY version`, definitionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []DefinitionVersion{}
+	for rows.Next() {
+		var version DefinitionVersion
+		var createdAt sql.NullTime
+		if err := rows.Scan(&version.Version, &createdAt); err != nil {
+			return nil, err
+		}
+		version.CreatedAt = formatTime(createdAt)
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// Запуски определения по возрастанию номера
+func getDefinitionRuns(definitionID int) ([]PipelineRun, error) {
+	rows, err := db.Query(`
+        SELECT pipeline_id, run_number, definition_version, status, start_time, end_time, variables, schedule_id,
+               trigger_id, COALESCE(branch, ''), COALESCE(commit_sha, ''), COALESCE(commit_author, '')
+        FROM pipeline WHERE definition_id = $1 ORDER BY run_number`, definitionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []PipelineRun{}
+	for rows.Next() {
+		var run PipelineRun
+		var startTime, endTime sql.NullTime
+		var variables []byte
+		var scheduleID, triggerID sql.NullInt32
+		if err := rows.Scan(&run.PipelineID, &run.RunNumber, &run.Version, &run.Status, &startTime, &endTime, &variables, &scheduleID,
+			&triggerID, &run.Branch, &run.CommitSHA, &run.CommitAuthor); err != nil {
+			return nil, err
+		}
+		run.ScheduleID = nullIntPtr(scheduleID)
+		run.TriggerID = nullIntPtr(triggerID)
+		if variables != nil {
+			if err := json.Unmarshal(variables, &run.Variables); err != nil {
+				return nil, fmt.Errorf("переменные запуска %d: %v", run.PipelineID, err)
+			}
+		}
+		run.StartTime = formatTime(startTime)
+		run.EndTime = formatTime(endTime)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// Новый запуск определения ("запустить снова"): создаёт запуск #N из последней
+// версии YAML (или версии из параметра version) и сразу начинает его выполнение
+func runDefinitionHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		if version, err = strconv.Atoi(v); err != nil || version <= 0 {
+			http.Error(w, "Некорректный version", http.StatusBadRequest)
+			return
+		}
+	}
+
+	yamlData, version, err := loadDefinitionVersion(db, definitionID, version, variableOverrides(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Версия определения не найдена", http.StatusNotFound)
+		return
+	} else if validationErr, ok := err.(*YamlValidationError); ok {
+		writeYamlValidationError(w, validationErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка загрузки определения", http.StatusInternalServerError)
+		return
+	}
+
+	var pipelineID, runNumber int
+	err = withTx(func(tx *sql.Tx) error {
+		var err error
+		pipelineID, err = createPipelineRun(tx, yamlData, definitionID, version, true)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(`SELECT run_number FROM pipeline WHERE pipeline_id = $1`, pipelineID).Scan(&runNumber)
+	})
+	if err != nil {
+		writeDependencyError(w, err, "Ошибка создания запуска")
+		return
+	}
+
+	sendPipelineUpdate(pipelineID)
+	if err := startPipelineExecution(pipelineID, false); err != nil {
+		log.Printf("Ошибка запуска пайплайна %d: %v", pipelineID, err)
+		http.Error(w, "Ошибка запуска пайплайна", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       fmt.Sprintf("Запуск #%d создан", runNumber),
+		"pipeline_id":   pipelineID,
+		"definition_id": definitionID,
+		"version":       version,
+		"run_number":    runNumber,
+	})
+}
+
+// Задача в плане импорта для dry_run
+type plannedTask struct {
+	Name      string   `json:"name"`
+	Order     int      `json:"order"`
+	Status    string   `json:"status"`
+	Type      string   `json:"type"`
+	DependsOn []string `json:"depends_on"`
+	Stage     int      `json:"stage"` // номер волны выполнения: задачи одной волны могут идти параллельно
+}
+
+// Граф запуска в том виде, в каком он записан в транзакции: задачи, зависимости,
+// волны выполнения и порядок, в котором их запустит движок
+func planPipelineRun(tx *sql.Tx, pipelineID int) (map[string]interface{}, error) {
+	var name, description string
+	var runNumber int
+	var maxParallel, timeoutSeconds sql.NullInt32
+	err := tx.QueryRow(`
+        SELECT name, COALESCE(description, ''), run_number, max_parallel, timeout_seconds
+        FROM pipeline WHERE pipeline_id = $1`, pipelineID).Scan(&name, &description, &runNumber, &maxParallel, &timeoutSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	graph, err := loadPipelineGraph(tx, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	order, err := graph.topologicalOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT task_id, COALESCE(status, 'Pending'), task_type FROM task WHERE pipeline_id = $1`, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[int][2]string)
+	for rows.Next() {
+		var taskID int
+		var status, taskType string
+		if err := rows.Scan(&taskID, &status, &taskType); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		statuses[taskID] = [2]string{status, taskType}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stages := make(map[int]int)
+	tasks := make([]plannedTask, 0, len(order))
+	executionOrder := make([]string, 0, len(order))
+	for _, taskID := range order {
+		task := plannedTask{
+			Name:      graph.taskName(taskID),
+			Order:     graph.nodes[taskID].Order,
+			Status:    statuses[taskID][0],
+			Type:      statuses[taskID][1],
+			DependsOn: []string{},
+			Stage:     1,
+		}
+		for _, depID := range graph.deps[taskID] {
+			task.DependsOn = append(task.DependsOn, graph.taskName(depID))
+			if stages[depID]+1 > task.Stage {
+				task.Stage = stages[depID] + 1
+			}
+		}
+		stages[taskID] = task.Stage
+		tasks = append(tasks, task)
+		executionOrder = append(executionOrder, task.Name)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].Order < tasks[j].Order })
+
+	return map[string]interface{}{
+		"pipeline": map[string]interface{}{
+			"name":            name,
+			"description":     description,
+			"run_number":      runNumber,
+			"max_parallel":    nullIntPtr(maxParallel),
+			"timeout_seconds": nullIntPtr(timeoutSeconds),
+		},
+		"tasks":           tasks,
+		"execution_order": executionOrder,
+	}, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Ребро графа зависимостей: задача TaskID ждёт завершения DependsOnID
+type dependencyEdge struct {
+	TaskID      int `json:"task_id"`
+	DependsOnID int `json:"depends_on_task_id"`
+}
+
+// Разбор параметров task_id и depends_on из строки запроса
+func parseDependencyEdge(r *http.Request) (dependencyEdge, error) {
+	var edge dependencyEdge
+	taskID, err := strconv.Atoi(r.URL.Query().Get("task_id"))
+	if err != nil {
+		return edge, err
+	}
+	dependsOnID, err := strconv.Atoi(r.URL.Query().Get("depends_on"))
+	if err != nil {
+		return edge, err
+	}
+	edge.TaskID = taskID
+	edge.DependsOnID = dependsOnID
+	return edge, nil
+}
+
+// Получение списка задач, от которых зависит задача
+func getTaskDependencies(taskID int) ([]int, error) {
+	rows, err := db.Query(`SELECT depends_on_task_id FROM task_dependency WHERE task_id = $1 ORDER BY depends_on_task_id`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := []int{}
+	for rows.Next() {
+		var depID int
+		if err := rows.Scan(&depID); err != nil {
+			return nil, err
+		}
+		deps = append(deps, depID)
+	}
+	return deps, rows.Err()
+}
+
+// Добавление одной зависимости между задачами
+func addDependencyHandler(w http.ResponseWriter, r *http.Request) {
+	edge, err := parseDependencyEdge(r)
+	if err != nil {
+		http.Error(w, "Некорректный task_id или depends_on", http.StatusBadRequest)
+		return
+	}
+
+	var pipelineID int
+	err = db.QueryRow(`SELECT pipeline_id FROM task WHERE task_id = $1`, edge.TaskID).Scan(&pipelineID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка при получении pipeline_id задачи", http.StatusInternalServerError)
+		return
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		return applyDependencyChanges(tx, pipelineID, []dependencyEdge{edge}, nil)
+	})
+	if err != nil {
+		writeDependencyError(w, err, "Ошибка при создании зависимости задачи")
+		return
+	}
+
+	deps, err := getTaskDependencies(edge.TaskID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении зависимостей задачи", http.StatusInternalServerError)
+		return
+	}
+
+	sendPipelineUpdate(pipelineID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":    edge.TaskID,
+		"depends_on": deps,
+	})
+}
+
+// Удаление одной зависимости между задачами
+func removeDependencyHandler(w http.ResponseWriter, r *http.Request) {
+	edge, err := parseDependencyEdge(r)
+	if err != nil {
+		http.Error(w, "Некорректный task_id или depends_on", http.StatusBadRequest)
+		return
+	}
+
+	var pipelineID int
+	err = db.QueryRow(`SELECT pipeline_id FROM task WHERE task_id = $1`, edge.TaskID).Scan(&pipelineID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка при получении pipeline_id задачи", http.StatusInternalServerError)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM task_dependency WHERE task_id = $1 AND depends_on_task_id = $2)`, edge.TaskID, edge.DependsOnID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Ошибка при получении зависимостей задачи", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Зависимость не найдена", http.StatusNotFound)
+		return
+	}
+
+	err = withTx(func(tx *sql.Tx) error {
+		return applyDependencyChanges(tx, pipelineID, nil, []dependencyEdge{edge})
+	})
+	if err != nil {
+		writeDependencyError(w, err, "Ошибка при удалении зависимости задачи")
+		return
+	}
+
+	deps, err := getTaskDependencies(edge.TaskID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении зависимостей задачи", http.StatusInternalServerError)
+		return
+	}
+
+	sendPipelineUpdate(pipelineID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":    edge.TaskID,
+		"depends_on": deps,
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Структурированная разница между двумя версиями определения.
+// Задачи сопоставляются по имени после подключения include, extends и matrix,
+// поэтому переименование задачи выглядит как удаление и добавление
+type DefinitionDiff struct {
+	DefinitionID int           `json:"definition_id"`
+	From         int           `json:"from"`
+	To           int           `json:"to"`
+	Pipeline     []FieldChange `json:"pipeline"`
+	Tasks        TaskDiff      `json:"tasks"`
+	Edges        EdgeDiff      `json:"edges"`
+}
+
+// Изменение значения поля; пустая строка - поле не задано
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type TaskDiff struct {
+	Added   []string     `json:"added"`
+	Removed []string     `json:"removed"`
+	Changed []TaskChange `json:"changed"`
+}
+
+// Изменённая задача: поля и теги; зависимости отражаются в EdgeDiff
+type TaskChange struct {
+	Name        string        `json:"name"`
+	Fields      []FieldChange `json:"fields,omitempty"`
+	TagsAdded   []string      `json:"tags_added,omitempty"`
+	TagsRemoved []string      `json:"tags_removed,omitempty"`
+}
+
+// Ребро графа зависимостей: задача To зависит от задачи From
+type DependencyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type EdgeDiff struct {
+	Added   []DependencyEdge `json:"added"`
+	Removed []DependencyEdge `json:"removed"`
+}
+
+// Сравнение версий определения: GET /api/definition/{definition_id}/diff?from=1&to=2.
+// По умолчанию to - последняя версия, from - предыдущая перед to
+func getDefinitionDiffHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	from, to := 0, 0
+	for name, target := range map[string]*int{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(name); value != "" {
+			if *target, err = strconv.Atoi(value); err != nil || *target <= 0 {
+				http.Error(w, fmt.Sprintf("Некорректный %s", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	newer, to, err := loadDefinitionVersion(db, definitionID, to, nil)
+	if err != nil {
+		writeDefinitionVersionError(w, err)
+		return
+	}
+	if from == 0 {
+		from = to - 1
+	}
+	if from <= 0 {
+		http.Error(w, "У определения только одна версия, сравнивать не с чем", http.StatusBadRequest)
+		return
+	}
+	older, from, err := loadDefinitionVersion(db, definitionID, from, nil)
+	if err != nil {
+		writeDefinitionVersionError(w, err)
+		return
+	}
+
+	diff := diffPipelines(older, newer)
+	diff.DefinitionID, diff.From, diff.To = definitionID, from, to
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// YAML одной версии определения: GET /api/definition/{definition_id}/version/{version}
+func getDefinitionVersionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	definitionID, err := strconv.Atoi(vars["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	versionNumber, err := strconv.Atoi(vars["version"])
+	if err != nil || versionNumber <= 0 {
+		http.Error(w, "Некорректный version", http.StatusBadRequest)
+		return
+	}
+
+	var version DefinitionVersion
+	var createdAt sql.NullTime
+	err = db.QueryRow(`
+        SELECT version, yaml, created_at FROM pipeline_definition_version
+        WHERE definition_id = $1 AND version = $2`, definitionID, versionNumber).Scan(
+		&version.Version, &version.YAML, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Версия определения не найдена", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	version.CreatedAt = formatTime(createdAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+func writeDefinitionVersionError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Версия определения не найдена", http.StatusNotFound)
+	} else if validationErr, ok := err.(*YamlValidationError); ok {
+		writeYamlValidationError(w, validationErr)
+	} else {
+		http.Error(w, "Ошибка загрузки определения", http.StatusInternalServerError)
+	}
+}
+
+// Разница между разобранными версиями: поля пайплайна, задачи, рёбра зависимостей
+func diffPipelines(older, newer *YamlPipeline) DefinitionDiff {
+	diff := DefinitionDiff{
+		Pipeline: []FieldChange{},
+		Tasks:    TaskDiff{Added: []string{}, Removed: []string{}, Changed: []TaskChange{}},
+		Edges:    EdgeDiff{Added: []DependencyEdge{}, Removed: []DependencyEdge{}},
+	}
+	diff.Pipeline = diffFields(pipelineDiffFields(older), pipelineDiffFields(newer))
+
+	oldTasks := make(map[string]YamlTask)
+	for _, task := range older.Pipeline.Tasks {
+		oldTasks[task.Name] = task
+	}
+	newTasks := make(map[string]YamlTask)
+	for _, task := range newer.Pipeline.Tasks {
+		newTasks[task.Name] = task
+	}
+
+	for _, task := range newer.Pipeline.Tasks {
+		previous, ok := oldTasks[task.Name]
+		if !ok {
+			diff.Tasks.Added = append(diff.Tasks.Added, task.Name)
+			continue
+		}
+		change := TaskChange{
+			Name:        task.Name,
+			Fields:      diffFields(taskDiffFields(previous), taskDiffFields(task)),
+			TagsAdded:   subtractStrings(task.Tags, previous.Tags),
+			TagsRemoved: subtractStrings(previous.Tags, task.Tags),
+		}
+		if len(change.Fields) > 0 || len(change.TagsAdded) > 0 || len(change.TagsRemoved) > 0 {
+			diff.Tasks.Changed = append(diff.Tasks.Changed, change)
+		}
+	}
+	for _, task := range older.Pipeline.Tasks {
+		if _, ok := newTasks[task.Name]; !ok {
+			diff.Tasks.Removed = append(diff.Tasks.Removed, task.Name)
+		}
+	}
+
+	oldEdges := dependencyEdges(older.Pipeline.Tasks)
+	newEdges := dependencyEdges(newer.Pipeline.Tasks)
+	diff.Edges.Added = subtractEdges(newEdges, oldEdges)
+	diff.Edges.Removed = subtractEdges(oldEdges, newEdges)
+	return diff
+}
+
+// Поле и его значение в виде строки; порядок полей задаёт порядок в ответе
+type diffField struct {
+	Name  string
+	Value string
+}
+
+func pipelineDiffFields(yamlData *YamlPipeline) []diffField {
+	fields := []diffField{
+		{"name", yamlData.Pipeline.Name},
+		{"description", yamlData.Pipeline.Description},
+		{"max_parallel", intDiffValue(yamlData.Pipeline.MaxParallel)},
+		{"timeout", yamlData.Pipeline.Timeout},
+	}
+	names := make([]string, 0, len(yamlData.Pipeline.Variables))
+	for name := range yamlData.Pipeline.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, diffField{"variables." + name, yamlData.Pipeline.Variables[name]})
+	}
+	return fields
+}
+
+func taskDiffFields(task YamlTask) []diffField {
+	return []diffField{
+		{"description", task.Description},
+		{"status", task.Status},
+		{"progress_percentage", intDiffValue(task.Progress)},
+		{"assignee", task.Assignee},
+		{"type", task.Type},
+		{"approval_level", task.ApprovalLevel},
+		{"command", task.Command},
+		{"script", task.Script},
+		{"retries", intDiffValue(task.Retries)},
+		{"retry_delay", task.RetryDelay},
+		{"retry_on", strings.Join(task.RetryOn, ", ")},
+		{"timeout", task.Timeout},
+		{"when", task.When},
+		{"runs_on", strings.Join(task.RunsOn, ", ")},
+		{"matrix_group", task.MatrixGroup},
+	}
+}
+
+func intDiffValue(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+// Изменённые поля: сначала в порядке newer, затем поля, которые есть только в older
+func diffFields(older, newer []diffField) []FieldChange {
+	changes := []FieldChange{}
+	oldValues := make(map[string]string)
+	for _, field := range older {
+		oldValues[field.Name] = field.Value
+	}
+	seen := make(map[string]bool)
+	for _, field := range newer {
+		seen[field.Name] = true
+		if previous := oldValues[field.Name]; previous != field.Value {
+			changes = append(changes, FieldChange{Field: field.Name, From: previous, To: field.Value})
+		}
+	}
+	for _, field := range older {
+		if !seen[field.Name] && field.Value != "" {
+			changes = append(changes, FieldChange{Field: field.Name, From: field.Value})
+		}
+	}
+	return changes
+}
+
+func dependencyEdges(tasks []YamlTask) []DependencyEdge {
+	var edges []DependencyEdge
+	for _, task := range tasks {
+		for _, dependency := range task.DependsOn {
+			edges = append(edges, DependencyEdge{From: dependency, To: task.Name})
+		}
+	}
+	return edges
+}
+
+// Рёбра из edges, которых нет в exclude
+func subtractEdges(edges, exclude []DependencyEdge) []DependencyEdge {
+	excluded := make(map[DependencyEdge]bool)
+	for _, edge := range exclude {
+		excluded[edge] = true
+	}
+	result := []DependencyEdge{}
+	for _, edge := range edges {
+		if !excluded[edge] {
+			result = append(result, edge)
+		}
+	}
+	return result
+}
+
+// Строки из values, которых нет в exclude
+func subtractStrings(values, exclude []string) []string {
+	var result []string
+	for _, value := range values {
+		if !containsString(exclude, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Задача в том виде, в котором её видит движок выполнения
+type engineTask struct {
+	TaskID        int
+	PipelineID    int
+	Name          string
+	Status        string
+	Type          string // command или approval
+	ApprovalLevel string
+	Command       string
+	Retry         retryPolicy
+	Tags          []string
+	When          string         // исходный текст условия when
+	Condition     *taskCondition // nil - выполнять после успешного завершения зависимостей
+	ConditionErr  error          // ошибка разбора условия, сохранённого в базе
+	RunsOn        []string       // метки агента; пусто - команда выполняется на сервере
+}
+
+// Выполнение пайплайна движком: функция остановки и состояние паузы планировщика
+type pipelineExecution struct {
+	cancel context.CancelCauseFunc
+	mu     sync.Mutex
+	paused bool
+	wake   chan struct{} // сигнал планировщику, что пауза снята или поставлена
+	resume bool          // продолжение прерванного запуска: время начала пайплайна сохраняется
+	rerun  bool          // повторный запуск части пайплайна: выполняются только задачи в Pending
+}
+
+func (e *pipelineExecution) isPaused() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.paused
+}
+
+func (e *pipelineExecution) setPaused(paused bool) {
+	e.mu.Lock()
+	e.paused = paused
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+var (
+	// Пайплайны, которые сейчас выполняет движок
+	runningPipelines      = make(map[int]*pipelineExecution)
+	runningPipelinesMutex = sync.Mutex{}
+
+	// Задачи, которые сейчас выполняет движок (включая паузы между попытками)
+	runningTasks      = make(map[int]context.CancelCauseFunc)
+	runningTasksMutex = sync.Mutex{}
+)
+
+// Причина принудительной остановки выполнения: итоговый статус и пояснение
+type executionInterrupt struct {
+	Status string
+	Reason string
+}
+
+func (e *executionInterrupt) Error() string {
+	return e.Reason
+}
+
+// Итоговый статус и причина для выполнения, контекст которого был отменён
+func interruptStatus(ctx context.Context) (string, string) {
+	var interrupt *executionInterrupt
+	if errors.As(context.Cause(ctx), &interrupt) {
+		return interrupt.Status, interrupt.Reason
+	}
+	return "Failed", "выполнение прервано"
+}
+
+// Прерывает задачу, если её выполняет движок. Возвращает false, если задача
+// выполняется не движком и её статус нужно менять напрямую
+func interruptTask(taskID int, status, reason string) bool {
+	runningTasksMutex.Lock()
+	defer runningTasksMutex.Unlock()
+	cancel, ok := runningTasks[taskID]
+	if ok {
+		cancel(&executionInterrupt{Status: status, Reason: reason})
+	}
+	return ok
+}
+
+// Прерывает выполнение пайплайна движком, аналогично interruptTask
+func interruptPipeline(pipelineID int, status, reason string) bool {
+	runningPipelinesMutex.Lock()
+	defer runningPipelinesMutex.Unlock()
+	execution, ok := runningPipelines[pipelineID]
+	if ok {
+		execution.cancel(&executionInterrupt{Status: status, Reason: reason})
+	}
+	return ok
+}
+
+// Пайплайны, которые сейчас выполняет движок этого сервера
+func enginePipelineIDs() []int {
+	runningPipelinesMutex.Lock()
+	defer runningPipelinesMutex.Unlock()
+	pipelineIDs := make([]int, 0, len(runningPipelines))
+	for pipelineID := range runningPipelines {
+		pipelineIDs = append(pipelineIDs, pipelineID)
+	}
+	return pipelineIDs
+}
+
+// Ставит или снимает паузу планировщика пайплайна, если его выполняет движок
+func pausePipelineExecution(pipelineID int, paused bool) bool {
+	runningPipelinesMutex.Lock()
+	defer runningPipelinesMutex.Unlock()
+	execution, ok := runningPipelines[pipelineID]
+	if ok {
+		execution.setPaused(paused)
+	}
+	return ok
+}
+
+// Глобальный лимит одновременно выполняемых задач по всем пайплайнам (MAX_WORKERS)
+var workerSlots = make(chan struct{}, globalWorkerLimit())
+
+func globalWorkerLimit() int {
+	if limit, err := strconv.Atoi(os.Getenv("MAX_WORKERS")); err == nil && limit > 0 {
+		return limit
+	}
+	return 4
+}
+
+var errPipelineAlreadyRunning = errors.New("пайплайн уже выполняется")
+
+// Запуск выполнения пайплайна
+func runPipelineHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.Atoi(mux.Vars(r)["pipeline_id"])
+	if err != nil {
+		http.Error(w, "Некорректный pipeline_id", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pipeline WHERE pipeline_id = $1)`, pipelineID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Pipeline not found", http.StatusNotFound)
+		return
+	}
+
+	if err := startPipelineExecution(pipelineID, false); err == errPipelineAlreadyRunning {
+		http.Error(w, "Пайплайн уже выполняется", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка запуска пайплайна", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Выполнение пайплайна запущено")
+}
+
+// Регистрирует выполнение пайплайна и запускает его в отдельной горутине.
+// resume означает продолжение уже начатого запуска, а не новый запуск
+func startPipelineExecution(pipelineID int, resume bool) error {
+	return launchPipelineExecution(pipelineID, &pipelineExecution{resume: resume})
+}
+
+// Повторный запуск части пайплайна: задачи, которые нужно выполнить заново, уже
+// переведены в Pending, остальные сохраняют свои статусы (в том числе упавшие)
+func startPipelineRerun(pipelineID int) error {
+	return launchPipelineExecution(pipelineID, &pipelineExecution{resume: true, rerun: true})
+}
+
+func launchPipelineExecution(pipelineID int, execution *pipelineExecution) error {
+	runningPipelinesMutex.Lock()
+	defer runningPipelinesMutex.Unlock()
+
+	if _, running := runningPipelines[pipelineID]; running {
+		return errPipelineAlreadyRunning
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	execution.cancel = cancel
+	execution.wake = make(chan struct{}, 1)
+	runningPipelines[pipelineID] = execution
+
+	go func() {
+		defer func() {
+			runningPipelinesMutex.Lock()
+			delete(runningPipelines, pipelineID)
+			runningPipelinesMutex.Unlock()
+			cancel(nil)
+		}()
+		if err := executePipeline(ctx, execution, pipelineID); err != nil {
+			log.Printf("Ошибка выполнения пайплайна %d: %v", pipelineID, err)
+		}
+	}()
+	return nil
+}
+
+// Результат выполнения одной задачи, который рабочая горутина возвращает планировщику
+type taskResult struct {
+	TaskID int
+	Status string
+	Err    error
+}
+
+// Выполнение задач пайплайна по графу task_dependency. Когда все зависимости задачи
+// завершены, проверяется её условие when: по умолчанию задача запускается, если все
+// зависимости в статусе Completed, иначе получает Skipped (Cancelled, если зависимость
+// отменена). Независимые ветви выполняются параллельно в пределах max_parallel
+// пайплайна и глобального лимита рабочих горутин. На паузе новые задачи не запускаются,
+// запущенные дорабатывают. При прерывании пайплайна оставшиеся задачи пропускаются или отменяются
+func executePipeline(ctx context.Context, execution *pipelineExecution, pipelineID int) error {
+	graph, err := loadPipelineGraph(db, pipelineID)
+	if err != nil {
+		return err
+	}
+	order, err := graph.topologicalOrder()
+	if err != nil {
+		setPipelineStatus(pipelineID, "Failed", err.Error())
+		return err
+	}
+	tasks, err := loadEngineTasks(pipelineID)
+	if err != nil {
+		return err
+	}
+
+	var maxParallel int
+	var variablesJSON []byte
+	err = db.QueryRow(`SELECT COALESCE(max_parallel, 0), variables FROM pipeline WHERE pipeline_id = $1`, pipelineID).Scan(&maxParallel, &variablesJSON)
+	if err != nil {
+		return err
+	}
+	variables := make(map[string]string)
+	if variablesJSON != nil {
+		if err := json.Unmarshal(variablesJSON, &variables); err != nil {
+			err = fmt.Errorf("некорректные переменные пайплайна: %v", err)
+			setPipelineStatus(pipelineID, "Failed", err.Error())
+			return err
+		}
+	}
+	if maxParallel <= 0 {
+		maxParallel = len(order)
+	}
+
+	// Всё, что не завершено успешно, снова ждёт выполнения. При повторном запуске части
+	// пайплайна нужные задачи уже сброшены, а остальные сохраняют свои итоги
+	if !execution.rerun {
+		_, err = db.Exec(`
+            UPDATE task
+            SET status = 'Pending', start_time = NULL, end_time = NULL, exit_code = NULL, status_reason = NULL,
+                progress_percentage = 0
+            WHERE pipeline_id = $1 AND status <> 'Completed'`, pipelineID)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.Status != "Completed" {
+				task.Status = "Pending"
+			}
+		}
+	}
+
+	if execution.resume {
+		err = markPipelineResumed(pipelineID)
+	} else {
+		err = setPipelineStatus(pipelineID, "Running", "")
+	}
+	if err != nil {
+		return err
+	}
+
+	results := make(chan taskResult)
+	running := 0
+	failed := false
+	// Упавшие задачи, не попавшие в повторный запуск, оставляют пайплайн в Failed
+	for _, task := range tasks {
+		if task.Status != "Pending" && task.Status != "Completed" && task.Status != "Skipped" {
+			failed = true
+		}
+	}
+
+	for {
+		if ctx.Err() == nil && !execution.isPaused() {
+			for _, taskID := range order {
+				if running >= maxParallel {
+					break
+				}
+				task, ok := tasks[taskID]
+				if !ok || task.Status != "Pending" || !dependenciesFinished(graph, tasks, taskID) {
+					continue
+				}
+				// Порядок топологический, поэтому пропуск задачи сразу учитывается зависимыми от неё
+				if run, status, reason := evaluateTaskCondition(graph, tasks, task, variables); !run {
+					stopEngineTasks(tasks, []int{taskID}, status, reason)
+					continue
+				}
+				task.Status = "Running"
+				running++
+				go func(task *engineTask) {
+					results <- runEngineTask(ctx, task)
+				}(task)
+			}
+		}
+
+		if running == 0 {
+			if ctx.Err() == nil && execution.isPaused() && hasPendingTasks(tasks) {
+				// Пауза без выполняющихся задач: ждём снятия паузы или остановки
+				select {
+				case <-execution.wake:
+				case <-ctx.Done():
+				}
+				continue
+			}
+			break
+		}
+
+		var result taskResult
+		select {
+		case result = <-results:
+		case <-execution.wake:
+			continue
+		}
+		running--
+		tasks[result.TaskID].Status = result.Status
+		if result.Err != nil {
+			log.Printf("Ошибка выполнения задачи %d: %v", result.TaskID, result.Err)
+		}
+		// Зависимые задачи решаются на следующем проходе по их условиям when
+		if result.Status != "Completed" && result.Status != "Skipped" {
+			failed = true
+		}
+	}
+
+	if ctx.Err() != nil {
+		status, reason := interruptStatus(ctx)
+		pendingStatus := "Skipped"
+		if status == "Cancelled" {
+			pendingStatus = "Cancelled"
+		}
+		stopEngineTasks(tasks, order, pendingStatus, reason)
+		return setPipelineStatus(pipelineID, status, reason)
+	}
+	if failed {
+		return setPipelineStatus(pipelineID, "Failed", "")
+	}
+	return setPipelineStatus(pipelineID, "Completed", "")
+}
+
+// Переводит ещё не запущенные задачи из списка в Skipped или Cancelled
+func stopEngineTasks(tasks map[int]*engineTask, taskIDs []int, status, reason string) {
+	var stopped []int
+	for _, taskID := range taskIDs {
+		if task, ok := tasks[taskID]; ok && task.Status == "Pending" {
+			task.Status = status
+			stopped = append(stopped, taskID)
+		}
+	}
+	if err := markPendingTasks(stopped, status, reason); err != nil {
+		log.Printf("Ошибка при переводе задач %v в %s: %v", stopped, status, err)
+	}
+}
+
+// Остались ли задачи, ожидающие запуска
+func hasPendingTasks(tasks map[int]*engineTask) bool {
+	for _, task := range tasks {
+		if task.Status == "Pending" {
+			return true
+		}
+	}
+	return false
+}
+
+// Все ли задачи, от которых зависит taskID, завершены (с любым итоговым статусом)
+func dependenciesFinished(graph *taskGraph, tasks map[int]*engineTask, taskID int) bool {
+	for _, depID := range graph.deps[taskID] {
+		dep, ok := tasks[depID]
+		if !ok {
+			return false
+		}
+		switch dep.Status {
+		case "Pending", "Running", "WaitingForApproval":
+			return false
+		}
+	}
+	return true
+}
+
+// Решение о запуске задачи, все зависимости которой завершены. Возвращает false,
+// итоговый статус и причину, если задачу нужно пропустить
+func evaluateTaskCondition(graph *taskGraph, tasks map[int]*engineTask, task *engineTask, variables map[string]string) (bool, string, string) {
+	if task.ConditionErr != nil {
+		return false, "Skipped", fmt.Sprintf("некорректное условие when %q: %v", task.When, task.ConditionErr)
+	}
+
+	upstream := make(map[string]string)
+	for _, depID := range graph.deps[task.TaskID] {
+		upstream[tasks[depID].Name] = tasks[depID].Status
+	}
+
+	if task.Condition == nil {
+		// По умолчанию: отмена распространяется на зависимые задачи, иначе они пропускаются
+		for _, depID := range graph.deps[task.TaskID] {
+			if dep := tasks[depID]; dep.Status == "Cancelled" {
+				return false, "Cancelled", fmt.Sprintf("задача %q завершилась со статусом %s", dep.Name, dep.Status)
+			}
+		}
+		for _, depID := range graph.deps[task.TaskID] {
+			if dep := tasks[depID]; dep.Status != "Completed" {
+				return false, "Skipped", fmt.Sprintf("задача %q завершилась со статусом %s", dep.Name, dep.Status)
+			}
+		}
+		return true, "", ""
+	}
+
+	run, err := task.Condition.eval(&conditionContext{Upstream: upstream, Variables: variables, Tags: task.Tags})
+	if err != nil {
+		return false, "Skipped", fmt.Sprintf("ошибка в условии when %q: %v", task.When, err)
+	}
+	if !run {
+		return false, "Skipped", fmt.Sprintf("условие when %q не выполнено", task.When)
+	}
+	return true, "", ""
+}
+
+// Выполнение одной задачи в рабочей горутине с учётом политики повторов.
+// Между попытками задача остаётся в Running, а слот рабочей горутины освобождается.
+// Пока задача выполняется, её можно прервать через interruptTask
+func runEngineTask(ctx context.Context, task *engineTask) taskResult {
+	taskCtx, cancel := context.WithCancelCause(ctx)
+	runningTasksMutex.Lock()
+	runningTasks[task.TaskID] = cancel
+	runningTasksMutex.Unlock()
+	defer func() {
+		runningTasksMutex.Lock()
+		delete(runningTasks, task.TaskID)
+		runningTasksMutex.Unlock()
+		cancel(nil)
+	}()
+
+	if task.Type == "approval" {
+		return runApprovalTask(taskCtx, task)
+	}
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case workerSlots <- struct{}{}:
+		case <-taskCtx.Done():
+			status, reason := interruptStatus(taskCtx)
+			if attempt == 1 {
+				// Задача так и не начала выполняться
+				if status != "Cancelled" {
+					status = "Skipped"
+				}
+				markPendingTasks([]int{task.TaskID}, status, reason)
+				return taskResult{TaskID: task.TaskID, Status: status}
+			}
+			return finishEngineTask(task, status, nil, reason)
+		}
+		result, retry := runTaskAttempt(taskCtx, task, attempt)
+		<-workerSlots
+
+		if !retry {
+			return result
+		}
+
+		select {
+		case <-time.After(task.Retry.delay(attempt)):
+		case <-taskCtx.Done():
+			status, reason := interruptStatus(taskCtx)
+			return finishEngineTask(task, status, nil, reason)
+		}
+	}
+}
+
+// Одна попытка выполнения задачи. Возвращает итог задачи и признак того,
+// что после паузы нужно сделать ещё одну попытку
+func runTaskAttempt(ctx context.Context, task *engineTask, attempt int) (taskResult, bool) {
+	if attempt == 1 {
+		started, status, err := markTaskRunning(task.TaskID)
+		if err != nil {
+			return taskResult{TaskID: task.TaskID, Status: "Failed", Err: err}, false
+		}
+		if !started {
+			// Статус задачи изменили извне до запуска (например, задачу отменили)
+			return taskResult{TaskID: task.TaskID, Status: status}, false
+		}
+	}
+	attemptID, _, err := startTaskAttempt(db, task.TaskID)
+	if err != nil {
+		result := finishEngineTask(task, "Failed", nil, err.Error())
+		result.Err = err
+		return result, false
+	}
+	sendTaskUpdate(task.TaskID)
+	sendPipelineUpdate(task.PipelineID)
+
+	exitCode, output, runErr := runTaskCommand(ctx, task)
+	status := "Completed"
+	message := ""
+	if ctx.Err() != nil {
+		// Выполнение прервано извне (таймаут и т.п.), повторов не будет
+		status, message = interruptStatus(ctx)
+	} else if runErr != nil || exitCode != 0 {
+		status = "Failed"
+		message = fmt.Sprintf("код выхода %d", exitCode)
+		if runErr != nil {
+			message = runErr.Error()
+		}
+	}
+	if status != "Completed" {
+		log.Printf("Задача %d (%s), попытка %d: %s", task.TaskID, task.Name, attempt, message)
+	}
+
+	if err := finishTaskAttempt(db, task.TaskID, attemptID, status, &exitCode, message); err != nil {
+		result := finishEngineTask(task, "Failed", &exitCode, err.Error())
+		result.Err = err
+		return result, false
+	}
+
+	if status == "Failed" && task.Retry.shouldRetry(attempt, exitCode, output) {
+		sendTaskUpdate(task.TaskID)
+		return taskResult{TaskID: task.TaskID, Status: "Running"}, true
+	}
+	if status == "Completed" {
+		message = ""
+	}
+	return finishEngineTask(task, status, &exitCode, message), false
+}
+
+// Фиксация итогового статуса задачи с причиной и рассылка обновлений
+func finishEngineTask(task *engineTask, status string, exitCode *int, reason string) taskResult {
+	err := markTaskFinished(task.TaskID, status, exitCode, reason)
+	sendTaskUpdate(task.TaskID)
+	sendPipelineUpdate(task.PipelineID)
+	return taskResult{TaskID: task.TaskID, Status: status, Err: err}
+}
+
+// Загрузка задач пайплайна с командами для выполнения
+func loadEngineTasks(pipelineID int) (map[int]*engineTask, error) {
+	rows, err := db.Query(`
+        SELECT task_id, pipeline_id, name, COALESCE(status, 'Pending'), task_type, COALESCE(approval_level, $2),
+               COALESCE(command, ''), COALESCE(retries, 0), COALESCE(retry_delay_seconds, 0), retry_on,
+               tags, COALESCE(condition, ''), runs_on
+        FROM task WHERE pipeline_id = $1`, pipelineID, defaultApprovalLevel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := make(map[int]*engineTask)
+	for rows.Next() {
+		task := &engineTask{}
+		var retryDelaySeconds int
+		var retryOn, tags, runsOn pq.StringArray
+		if err := rows.Scan(&task.TaskID, &task.PipelineID, &task.Name, &task.Status, &task.Type, &task.ApprovalLevel,
+			&task.Command, &task.Retry.Retries, &retryDelaySeconds, &retryOn, &tags, &task.When, &runsOn); err != nil {
+			return nil, err
+		}
+		task.Retry.RetryDelay = time.Duration(retryDelaySeconds) * time.Second
+		task.Retry.RetryOn = []string(retryOn)
+		task.Tags = []string(tags)
+		task.RunsOn = []string(runsOn)
+		if task.When != "" {
+			task.Condition, task.ConditionErr = parseCondition(task.When)
+		}
+		tasks[task.TaskID] = task
+	}
+	return tasks, rows.Err()
+}
+
+// Запуск команды задачи через оболочку. Задача без команды считается выполненной,
+// задача с runs_on передаётся агенту с подходящими метками.
+// Возвращает код выхода процесса и хвост его вывода, ошибка означает, что процесс
+// не удалось запустить
+func runTaskCommand(ctx context.Context, task *engineTask) (int, string, error) {
+	if task.Command == "" {
+		return 0, "", nil
+	}
+	if len(task.RunsOn) > 0 {
+		return runAgentJob(ctx, task)
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", task.Command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PIPELINE_ID=%d", task.PipelineID),
+		fmt.Sprintf("TASK_ID=%d", task.TaskID),
+		"TASK_NAME="+task.Name,
+	)
+	// Хвост вывода нужен для retry_on, весь вывод построчно уходит в журнал задачи
+	output := &tailBuffer{limit: 64 * 1024}
+	logWriter := newTaskLogWriter(task.TaskID)
+	defer logWriter.Close()
+	combined := io.MultiWriter(output, logWriter)
+	cmd.Stdout = combined
+	cmd.Stderr = combined
+	setProcessGroup(cmd)
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), output.String(), nil
+	}
+	if err != nil {
+		return -1, output.String(), err
+	}
+	return 0, output.String(), nil
+}
+
+// Буфер, который хранит только последние limit байт вывода команды
+type tailBuffer struct {
+	mu    sync.Mutex
+	limit int
+	data  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = b.data[len(b.data)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.data)
+}
+
+// Перевод ожидающей задачи в Running с чистыми временными метками.
+// Если задача уже не в Pending, возвращает false и её текущий статус
+func markTaskRunning(taskID int) (bool, string, error) {
+	res, err := db.Exec(`
+        UPDATE task
+        SET status = 'Running', start_time = NOW(), end_time = NULL, exit_code = NULL, status_reason = NULL
+        WHERE task_id = $1 AND status = 'Pending'`, taskID)
+	if err != nil {
+		return false, "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, "Running", nil
+	}
+	var status string
+	err = db.QueryRow(`SELECT status FROM task WHERE task_id = $1`, taskID).Scan(&status)
+	return false, status, err
+}
+
+// Завершение задачи с сохранением кода выхода последней попытки и причины статуса
+func markTaskFinished(taskID int, status string, exitCode *int, reason string) error {
+	progress := 0
+	if status == "Completed" {
+		progress = 100
+	}
+	_, err := db.Exec(`
+        UPDATE task
+        SET status = $1, end_time = NOW(), exit_code = COALESCE($2, exit_code),
+            progress_percentage = GREATEST(progress_percentage, $3), status_reason = $4
+        WHERE task_id = $5`, status, exitCode, progress, nilIfEmpty(reason), taskID)
+	return err
+}
+
+// Возврат пайплайна в Running без сброса времени начала
+func markPipelineResumed(pipelineID int) error {
+	_, err := db.Exec(`
+        UPDATE pipeline
+        SET status = 'Running', start_time = COALESCE(start_time, NOW()), end_time = NULL, status_reason = NULL
+        WHERE pipeline_id = $1`, pipelineID)
+	if err != nil {
+		return err
+	}
+	sendPipelineUpdate(pipelineID)
+	return nil
+}
+
+// Перевод ожидающих задач в Skipped или Cancelled с указанием причины
+func markPendingTasks(taskIDs []int, status, reason string) error {
+	if len(taskIDs) == 0 {
+		return nil
+	}
+	rows, err := db.Query(`
+        UPDATE task
+        SET status = $2, status_reason = $3, start_time = NULL, end_time = NULL
+        WHERE task_id = ANY($1::int[]) AND status = 'Pending'
+        RETURNING task_id, pipeline_id`, pq.Array(taskIDs), status, nilIfEmpty(reason))
+	if err != nil {
+		return err
+	}
+
+	var skipped []int
+	pipelines := make(map[int]bool)
+	for rows.Next() {
+		var taskID, pipelineID int
+		if err := rows.Scan(&taskID, &pipelineID); err != nil {
+			rows.Close()
+			return err
+		}
+		skipped = append(skipped, taskID)
+		pipelines[pipelineID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, taskID := range skipped {
+		sendTaskUpdate(taskID)
+	}
+	for pipelineID := range pipelines {
+		sendPipelineUpdate(pipelineID)
+	}
+	return nil
+}
+
+// Обновление статуса пайплайна движком с временными метками, причиной и рассылкой через WebSocket
+func setPipelineStatus(pipelineID int, status, reason string) error {
+	var err error
+	switch status {
+	case "Running":
+		_, err = db.Exec(`UPDATE pipeline SET status = $1, start_time = NOW(), end_time = NULL, status_reason = NULL WHERE pipeline_id = $2`, status, pipelineID)
+	case "Paused":
+		_, err = db.Exec(`UPDATE pipeline SET status = $1, status_reason = $2 WHERE pipeline_id = $3`, status, nilIfEmpty(reason), pipelineID)
+	default:
+		_, err = db.Exec(`UPDATE pipeline SET status = $1, end_time = NOW(), status_reason = $2 WHERE pipeline_id = $3`, status, nilIfEmpty(reason), pipelineID)
+	}
+	if err != nil {
+		return err
+	}
+	sendPipelineUpdate(pipelineID)
+	return nil
+}
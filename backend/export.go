@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// Длительность в секундах в формате YAML: "2h", "5m" или "45s"
+func formatYamlDuration(seconds int) string {
+	switch {
+	case seconds <= 0:
+		return ""
+	case seconds%3600 == 0:
+		return fmt.Sprintf("%dh", seconds/3600)
+	case seconds%60 == 0:
+		return fmt.Sprintf("%dm", seconds/60)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+// Сборка YamlPipeline из пайплайна в базе данных в том формате, который принимает
+// uploadPipelineYAMLHandler: повторный импорт результата даёт тот же пайплайн
+func exportPipelineYAML(q dbQuerier, pipelineID int) (*YamlPipeline, error) {
+	var yamlData YamlPipeline
+	var maxParallel, timeoutSeconds sql.NullInt32
+	var variables []byte
+	err := q.QueryRow(`
+        SELECT name, COALESCE(description, ''), max_parallel, timeout_seconds, variables
+        FROM pipeline WHERE pipeline_id = $1`, pipelineID).Scan(
+		&yamlData.Pipeline.Name, &yamlData.Pipeline.Description, &maxParallel, &timeoutSeconds, &variables)
+	if err != nil {
+		return nil, err
+	}
+	if variables != nil {
+		if err := json.Unmarshal(variables, &yamlData.Pipeline.Variables); err != nil {
+			return nil, fmt.Errorf("переменные пайплайна %d: %v", pipelineID, err)
+		}
+	}
+	yamlData.Pipeline.MaxParallel = int(maxParallel.Int32)
+	yamlData.Pipeline.Timeout = formatYamlDuration(int(timeoutSeconds.Int32))
+
+	graph, err := loadPipelineGraph(q, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`
+        SELECT t.task_id, t.name, COALESCE(t.description, ''), COALESCE(t.status, 'Pending'), t.progress_percentage,
+               COALESCE(u.username, ''), t.tags, COALESCE(t.command, ''), COALESCE(t.retries, 0),
+               COALESCE(t.retry_delay_seconds, 0), t.retry_on, COALESCE(t.timeout_seconds, 0),
+               t.task_type, COALESCE(t.approval_level, ''), COALESCE(t.condition, ''), t.runs_on,
+               COALESCE(t.matrix_group, ''), t.matrix_values
+        FROM task t
+        LEFT JOIN "user" u ON t.assigned_to = u.user_id
+        WHERE t.pipeline_id = $1
+        ORDER BY t."order", t.task_id`, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t YamlTask
+		var taskID, retryDelaySeconds, timeoutSeconds int
+		var tags, retryOn, runsOn pq.StringArray
+		var command string
+		var matrixValues []byte
+		if err := rows.Scan(&taskID, &t.Name, &t.Description, &t.Status, &t.Progress,
+			&t.Assignee, &tags, &command, &t.Retries,
+			&retryDelaySeconds, &retryOn, &timeoutSeconds,
+			&t.Type, &t.ApprovalLevel, &t.When, &runsOn,
+			&t.MatrixGroup, &matrixValues); err != nil {
+			return nil, err
+		}
+		// Развёрнутые задачи matrix выгружаются по отдельности, но сохраняют группу и значения осей
+		if matrixValues != nil {
+			if err := json.Unmarshal(matrixValues, &t.MatrixValues); err != nil {
+				return nil, err
+			}
+		}
+		t.Tags = []string(tags)
+		t.RetryOn = []string(retryOn)
+		t.RunsOn = []string(runsOn)
+		t.RetryDelay = formatYamlDuration(retryDelaySeconds)
+		t.Timeout = formatYamlDuration(timeoutSeconds)
+		// Многострочные команды выгружаются как script, чтобы файл оставался читаемым
+		if strings.Contains(command, "\n") {
+			t.Script = command
+		} else {
+			t.Command = command
+		}
+		// command - тип по умолчанию, его не пишем
+		if t.Type == "command" {
+			t.Type = ""
+		}
+		for _, depID := range graph.deps[taskID] {
+			t.DependsOn = append(t.DependsOn, graph.taskName(depID))
+		}
+		yamlData.Pipeline.Tasks = append(yamlData.Pipeline.Tasks, escapeTaskVariables(t))
+	}
+	return &yamlData, rows.Err()
+}
+
+// Значения задачи запуска уже содержат подставленные переменные; оставшиеся
+// в них ${VAR} при экспорте экранируются
+func escapeTaskVariables(t YamlTask) YamlTask {
+	t.Name = escapeVariables(t.Name)
+	t.Description = escapeVariables(t.Description)
+	t.Command = escapeVariables(t.Command)
+	t.Script = escapeVariables(t.Script)
+	for i := range t.Tags {
+		t.Tags[i] = escapeVariables(t.Tags[i])
+	}
+	for i := range t.DependsOn {
+		t.DependsOn[i] = escapeVariables(t.DependsOn[i])
+	}
+	for i := range t.RunsOn {
+		t.RunsOn[i] = escapeVariables(t.RunsOn[i])
+	}
+	return t
+}
+
+// Выгрузка пайплайна в YAML
+func exportPipelineYAMLHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.Atoi(mux.Vars(r)["pipeline_id"])
+	if err != nil {
+		http.Error(w, "Некорректный pipeline_id", http.StatusBadRequest)
+		return
+	}
+
+	yamlData, err := exportPipelineYAML(db, pipelineID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Pipeline not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка выгрузки пайплайна", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(yamlData); err != nil {
+		http.Error(w, "Ошибка формирования YAML", http.StatusInternalServerError)
+		return
+	}
+	encoder.Close()
+
+	w.Header().Set("Content-Type", "application/x-yaml; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pipeline-%d.yaml"`, pipelineID))
+	w.Write(buf.Bytes())
+}
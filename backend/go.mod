@@ -6,10 +6,12 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/websocket v1.5.3 // добавлена версия
 	github.com/jackc/pgx/v4 v4.18.3
-
 )
 
-require github.com/go-yaml/yaml v2.1.0+incompatible
+require (
+	github.com/lib/pq v1.10.4
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
@@ -19,7 +21,6 @@ require (
 	github.com/jackc/pgproto3/v2 v2.3.3 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
 	github.com/jackc/pgtype v1.14.4 // indirect
-	github.com/lib/pq v1.10.4 // indirect
 	golang.org/x/crypto v0.29.0 // indirect
 	golang.org/x/text v0.20.0 // indirect
 )
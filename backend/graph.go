@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Коды ошибок валидации графа зависимостей
+const (
+	graphErrSelfDependency    = "self_dependency"
+	graphErrCycle             = "cycle"
+	graphErrCrossPipeline     = "cross_pipeline"
+	graphErrDanglingReference = "dangling_reference"
+)
+
+// Общий интерфейс для *sql.DB и *sql.Tx
+type dbQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Одна проблема в графе с перечнем задач, которые к ней привели
+type GraphIssue struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	TaskIDs []int    `json:"task_ids,omitempty"`
+	Tasks   []string `json:"tasks"`
+}
+
+// Ошибка валидации графа, содержит все найденные проблемы
+type GraphValidationError struct {
+	Issues []GraphIssue `json:"issues"`
+}
+
+func (e *GraphValidationError) Error() string {
+	messages := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		messages[i] = issue.Message
+	}
+	return "некорректный граф зависимостей: " + strings.Join(messages, "; ")
+}
+
+// Узел графа: задача и пайплайн, к которому она относится
+type graphNode struct {
+	TaskID     int
+	Name       string
+	PipelineID int
+	Order      int
+}
+
+// Граф зависимостей пайплайна: deps[task] - задачи, от которых зависит task
+type taskGraph struct {
+	pipelineID int
+	nodes      map[int]graphNode
+	deps       map[int][]int
+}
+
+func newTaskGraph(pipelineID int) *taskGraph {
+	return &taskGraph{
+		pipelineID: pipelineID,
+		nodes:      make(map[int]graphNode),
+		deps:       make(map[int][]int),
+	}
+}
+
+func (g *taskGraph) addNode(node graphNode) {
+	g.nodes[node.TaskID] = node
+}
+
+func (g *taskGraph) hasEdge(edge dependencyEdge) bool {
+	for _, depID := range g.deps[edge.TaskID] {
+		if depID == edge.DependsOnID {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *taskGraph) addEdge(edge dependencyEdge) {
+	if !g.hasEdge(edge) {
+		g.deps[edge.TaskID] = append(g.deps[edge.TaskID], edge.DependsOnID)
+	}
+}
+
+// Все рёбра графа в детерминированном порядке
+func (g *taskGraph) edges() []dependencyEdge {
+	var edges []dependencyEdge
+	for _, taskID := range g.sortedTaskIDs() {
+		for _, depID := range g.deps[taskID] {
+			edges = append(edges, dependencyEdge{TaskID: taskID, DependsOnID: depID})
+		}
+	}
+	return edges
+}
+
+func (g *taskGraph) removeEdge(edge dependencyEdge) {
+	deps := g.deps[edge.TaskID]
+	for i, depID := range deps {
+		if depID == edge.DependsOnID {
+			g.deps[edge.TaskID] = append(deps[:i:i], deps[i+1:]...)
+			return
+		}
+	}
+}
+
+// Отсортированный список задач графа, чтобы результат обходов был детерминированным
+func (g *taskGraph) sortedTaskIDs() []int {
+	ids := make([]int, 0, len(g.nodes))
+	for id, node := range g.nodes {
+		if node.PipelineID == g.pipelineID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (g *taskGraph) taskName(taskID int) string {
+	if node, ok := g.nodes[taskID]; ok && node.Name != "" {
+		return node.Name
+	}
+	return fmt.Sprintf("#%d", taskID)
+}
+
+func (g *taskGraph) issue(code, message string, taskIDs ...int) GraphIssue {
+	names := make([]string, len(taskIDs))
+	for i, id := range taskIDs {
+		names[i] = g.taskName(id)
+	}
+	return GraphIssue{Code: code, Message: message, TaskIDs: taskIDs, Tasks: names}
+}
+
+// Проверка графа: петли, ссылки на несуществующие задачи и задачи других пайплайнов, циклы
+func (g *taskGraph) validate() error {
+	var issues []GraphIssue
+
+	for _, taskID := range g.sortedTaskIDs() {
+		for _, depID := range g.deps[taskID] {
+			dep, ok := g.nodes[depID]
+			switch {
+			case depID == taskID:
+				issues = append(issues, g.issue(graphErrSelfDependency,
+					fmt.Sprintf("задача %q зависит сама от себя", g.taskName(taskID)), taskID))
+			case !ok:
+				issues = append(issues, g.issue(graphErrDanglingReference,
+					fmt.Sprintf("задача %q ссылается на несуществующую задачу %s", g.taskName(taskID), g.taskName(depID)), taskID, depID))
+			case dep.PipelineID != g.pipelineID:
+				issues = append(issues, g.issue(graphErrCrossPipeline,
+					fmt.Sprintf("задача %q зависит от задачи %q из другого пайплайна", g.taskName(taskID), dep.Name), taskID, depID))
+			}
+		}
+	}
+
+	for _, cycle := range g.findCycles() {
+		names := make([]string, len(cycle))
+		for i, id := range cycle {
+			names[i] = fmt.Sprintf("%q", g.taskName(id))
+		}
+		issues = append(issues, g.issue(graphErrCycle,
+			"циклическая зависимость: "+strings.Join(names, " -> ")+" -> "+names[0], cycle...))
+	}
+
+	if len(issues) > 0 {
+		return &GraphValidationError{Issues: issues}
+	}
+	return nil
+}
+
+// Проверка только добавляемых рёбер (они уже добавлены в граф): те же проблемы, что
+// в validate, но цикл ищется лишь через новое ребро. Уже сохранённые некорректные
+// рёбра пайплайна не мешают записи, которая их не касается
+func (g *taskGraph) validateEdges(edges []dependencyEdge) error {
+	var issues []GraphIssue
+	for _, edge := range edges {
+		taskID, depID := edge.TaskID, edge.DependsOnID
+		dep, ok := g.nodes[depID]
+		switch {
+		case depID == taskID:
+			issues = append(issues, g.issue(graphErrSelfDependency,
+				fmt.Sprintf("задача %q зависит сама от себя", g.taskName(taskID)), taskID))
+		case !ok:
+			issues = append(issues, g.issue(graphErrDanglingReference,
+				fmt.Sprintf("задача %q ссылается на несуществующую задачу %s", g.taskName(taskID), g.taskName(depID)), taskID, depID))
+		case dep.PipelineID != g.pipelineID:
+			issues = append(issues, g.issue(graphErrCrossPipeline,
+				fmt.Sprintf("задача %q зависит от задачи %q из другого пайплайна", g.taskName(taskID), dep.Name), taskID, depID))
+		default:
+			// Ребро замыкает цикл, если зависимость сама (транзитивно) зависит от задачи
+			path := g.dependencyPath(depID, taskID)
+			if path == nil {
+				continue
+			}
+			// Порядок выполнения: задача -> ... -> зависимость -> задача
+			cycle := make([]int, len(path))
+			names := make([]string, len(path))
+			for i, id := range path {
+				cycle[len(path)-1-i] = id
+				names[len(path)-1-i] = fmt.Sprintf("%q", g.taskName(id))
+			}
+			issues = append(issues, g.issue(graphErrCycle,
+				"циклическая зависимость: "+strings.Join(names, " -> ")+" -> "+names[0], cycle...))
+		}
+	}
+	if len(issues) > 0 {
+		return &GraphValidationError{Issues: issues}
+	}
+	return nil
+}
+
+// Кратчайшая цепочка зависимостей от задачи from до задачи to внутри пайплайна
+// (from, её зависимость, ..., to) или nil, если from не зависит от to
+func (g *taskGraph) dependencyPath(from, to int) []int {
+	previous := map[int]int{from: from}
+	queue := []int{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == to {
+			var path []int
+			for id := to; id != from; id = previous[id] {
+				path = append(path, id)
+			}
+			path = append(path, from)
+			for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+				path[l], path[r] = path[r], path[l]
+			}
+			return path
+		}
+		for _, depID := range g.deps[current] {
+			if node, ok := g.nodes[depID]; !ok || node.PipelineID != g.pipelineID {
+				continue
+			}
+			if _, seen := previous[depID]; !seen {
+				previous[depID] = current
+				queue = append(queue, depID)
+			}
+		}
+	}
+	return nil
+}
+
+// Поиск циклов обходом в глубину. Петли и рёбра вне пайплайна проверяются отдельно
+func (g *taskGraph) findCycles() [][]int {
+	const (
+		white = iota
+		grey
+		black
+	)
+	color := make(map[int]int)
+	var stack []int
+	var cycles [][]int
+
+	var visit func(id int)
+	visit = func(id int) {
+		color[id] = grey
+		stack = append(stack, id)
+		for _, depID := range g.deps[id] {
+			if depID == id {
+				continue
+			}
+			if node, ok := g.nodes[depID]; !ok || node.PipelineID != g.pipelineID {
+				continue
+			}
+			switch color[depID] {
+			case white:
+				visit(depID)
+			case grey:
+				// Обратное ребро: цикл - это часть стека от depID до текущей задачи
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == depID {
+						cycle := append([]int(nil), stack[i:]...)
+						// Разворачиваем, чтобы цикл читался в порядке выполнения: зависимость -> зависимая задача
+						for l, r := 0, len(cycle)-1; l < r; l, r = l+1, r-1 {
+							cycle[l], cycle[r] = cycle[r], cycle[l]
+						}
+						cycles = append(cycles, cycle)
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[id] = black
+	}
+
+	for _, id := range g.sortedTaskIDs() {
+		if color[id] == white {
+			visit(id)
+		}
+	}
+	return cycles
+}
+
+// Топологический порядок задач пайплайна (алгоритм Кана): каждая задача идёт после
+// всех своих зависимостей, среди готовых задач первой берётся задача с меньшим "order"
+func (g *taskGraph) topologicalOrder() ([]int, error) {
+	ids := g.sortedTaskIDs()
+	sort.SliceStable(ids, func(i, j int) bool {
+		return g.nodes[ids[i]].Order < g.nodes[ids[j]].Order
+	})
+
+	remaining := make(map[int]int, len(ids))
+	dependents := make(map[int][]int)
+	for _, id := range ids {
+		for _, depID := range g.deps[id] {
+			if node, ok := g.nodes[depID]; ok && node.PipelineID == g.pipelineID {
+				remaining[id]++
+				dependents[depID] = append(dependents[depID], id)
+			}
+		}
+	}
+
+	order := make([]int, 0, len(ids))
+	done := make(map[int]bool, len(ids))
+	for len(order) < len(ids) {
+		progressed := false
+		for _, id := range ids {
+			if done[id] || remaining[id] > 0 {
+				continue
+			}
+			done[id] = true
+			order = append(order, id)
+			for _, next := range dependents[id] {
+				remaining[next]--
+			}
+			progressed = true
+			break
+		}
+		if !progressed {
+			return nil, g.validate()
+		}
+	}
+	return order, nil
+}
+
+// Все задачи пайплайна, которые прямо или транзитивно зависят от taskID
+func (g *taskGraph) downstream(taskID int) []int {
+	dependents := make(map[int][]int)
+	for _, id := range g.sortedTaskIDs() {
+		for _, depID := range g.deps[id] {
+			dependents[depID] = append(dependents[depID], id)
+		}
+	}
+
+	visited := map[int]bool{taskID: true}
+	queue := []int{taskID}
+	var result []int
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, next := range dependents[current] {
+			if !visited[next] {
+				visited[next] = true
+				result = append(result, next)
+				queue = append(queue, next)
+			}
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+// Загрузка задач и зависимостей пайплайна из базы данных
+func loadPipelineGraph(q dbQuerier, pipelineID int) (*taskGraph, error) {
+	g := newTaskGraph(pipelineID)
+
+	rows, err := q.Query(`SELECT task_id, name, "order" FROM task WHERE pipeline_id = $1`, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		node := graphNode{PipelineID: pipelineID}
+		if err := rows.Scan(&node.TaskID, &node.Name, &node.Order); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g.addNode(node)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`
+        SELECT td.task_id, td.depends_on_task_id
+        FROM task_dependency td
+        JOIN task t ON t.task_id = td.task_id
+        WHERE t.pipeline_id = $1
+        ORDER BY td.task_id, td.depends_on_task_id`, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var edge dependencyEdge
+		if err := rows.Scan(&edge.TaskID, &edge.DependsOnID); err != nil {
+			return nil, err
+		}
+		g.addEdge(edge)
+	}
+	return g, rows.Err()
+}
+
+// Подгружает в граф задачи из других пайплайнов, на которые ссылаются рёбра,
+// чтобы отличить ссылку на чужой пайплайн от ссылки на несуществующую задачу
+func (g *taskGraph) loadForeignNodes(q dbQuerier, edges []dependencyEdge) error {
+	for _, edge := range edges {
+		for _, id := range []int{edge.TaskID, edge.DependsOnID} {
+			if _, ok := g.nodes[id]; ok {
+				continue
+			}
+			node := graphNode{TaskID: id}
+			err := q.QueryRow(`SELECT name, pipeline_id FROM task WHERE task_id = $1`, id).Scan(&node.Name, &node.PipelineID)
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return err
+			}
+			g.addNode(node)
+		}
+	}
+	return nil
+}
+
+// Единая точка записи зависимостей: применяет изменения к графу пайплайна,
+// проверяет добавляемые рёбра и только после этого пишет их в task_dependency.
+// Вызывается внутри транзакции, строка пайплайна блокируется на время проверки
+func applyDependencyChanges(tx *sql.Tx, pipelineID int, add, remove []dependencyEdge) error {
+	var lockedID int
+	err := tx.QueryRow(`SELECT pipeline_id FROM pipeline WHERE pipeline_id = $1 FOR UPDATE`, pipelineID).Scan(&lockedID)
+	if err != nil {
+		return fmt.Errorf("Ошибка при блокировке пайплайна %d: %v", pipelineID, err)
+	}
+
+	g, err := loadPipelineGraph(tx, pipelineID)
+	if err != nil {
+		return fmt.Errorf("Ошибка при загрузке графа пайплайна %d: %v", pipelineID, err)
+	}
+	if err := g.loadForeignNodes(tx, add); err != nil {
+		return fmt.Errorf("Ошибка при загрузке задач зависимостей: %v", err)
+	}
+
+	for _, edge := range remove {
+		g.removeEdge(edge)
+	}
+	var issues []GraphIssue
+	var added []dependencyEdge
+	for _, edge := range add {
+		if node, ok := g.nodes[edge.TaskID]; !ok || node.PipelineID != pipelineID {
+			issues = append(issues, g.issue(graphErrCrossPipeline,
+				fmt.Sprintf("задача %s не принадлежит пайплайну %d", g.taskName(edge.TaskID), pipelineID), edge.TaskID))
+			continue
+		}
+		g.addEdge(edge)
+		added = append(added, edge)
+	}
+	if err := g.validateEdges(added); err != nil {
+		issues = append(issues, err.(*GraphValidationError).Issues...)
+	}
+	if len(issues) > 0 {
+		return &GraphValidationError{Issues: issues}
+	}
+
+	for _, edge := range remove {
+		_, err := tx.Exec(`DELETE FROM task_dependency WHERE task_id = $1 AND depends_on_task_id = $2`, edge.TaskID, edge.DependsOnID)
+		if err != nil {
+			return fmt.Errorf("Ошибка при удалении зависимости %d -> %d: %v", edge.TaskID, edge.DependsOnID, err)
+		}
+	}
+	for _, edge := range add {
+		_, err := tx.Exec(`
+            INSERT INTO task_dependency (task_id, depends_on_task_id)
+            VALUES ($1, $2)
+            ON CONFLICT DO NOTHING`, edge.TaskID, edge.DependsOnID)
+		if err != nil {
+			return fmt.Errorf("Ошибка при добавлении зависимости %d -> %d: %v", edge.TaskID, edge.DependsOnID, err)
+		}
+	}
+	return nil
+}
+
+// Ошибка, которой функция транзакции запрашивает откат без ошибки для клиента (dry_run)
+var errDryRun = errors.New("dry run: транзакция откатывается")
+
+// Выполнение функции в транзакции с откатом при ошибке
+func withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Ответ клиенту об ошибке записи зависимостей.
+// Ошибки валидации графа возвращаются структурированно с кодом 409
+func writeDependencyError(w http.ResponseWriter, err error, message string) {
+	if graphErr, ok := err.(*GraphValidationError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Некорректный граф зависимостей",
+			"issues": graphErr.Issues,
+		})
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
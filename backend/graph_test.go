@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Граф пайплайна 1: build(1) <- test(2) <- deploy(3) и lint(4) без зависимостей, задача 9 из пайплайна 2
+func newTestGraph() *taskGraph {
+	g := newTaskGraph(1)
+	for i, name := range []string{"build", "test", "deploy", "lint"} {
+		g.addNode(graphNode{TaskID: i + 1, Name: name, PipelineID: 1, Order: i})
+	}
+	g.addNode(graphNode{TaskID: 9, Name: "other", PipelineID: 2})
+	g.addEdge(dependencyEdge{TaskID: 2, DependsOnID: 1})
+	g.addEdge(dependencyEdge{TaskID: 3, DependsOnID: 2})
+	return g
+}
+
+func TestValidateEdges(t *testing.T) {
+	tests := []struct {
+		name      string
+		edge      dependencyEdge
+		wantCode  string
+		wantTasks []string
+	}{
+		{"корректное ребро", dependencyEdge{TaskID: 4, DependsOnID: 1}, "", nil},
+		{"петля", dependencyEdge{TaskID: 4, DependsOnID: 4}, graphErrSelfDependency, []string{"lint"}},
+		{"несуществующая задача", dependencyEdge{TaskID: 4, DependsOnID: 42}, graphErrDanglingReference, []string{"lint", "#42"}},
+		{"другой пайплайн", dependencyEdge{TaskID: 4, DependsOnID: 9}, graphErrCrossPipeline, []string{"lint", "other"}},
+		{"цикл", dependencyEdge{TaskID: 1, DependsOnID: 3}, graphErrCycle, []string{"build", "test", "deploy"}},
+	}
+	for _, tt := range tests {
+		g := newTestGraph()
+		g.addEdge(tt.edge)
+		err := g.validateEdges([]dependencyEdge{tt.edge})
+		if tt.wantCode == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		graphErr, ok := err.(*GraphValidationError)
+		if !ok || len(graphErr.Issues) != 1 {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if issue := graphErr.Issues[0]; issue.Code != tt.wantCode || !reflect.DeepEqual(issue.Tasks, tt.wantTasks) {
+			t.Errorf("%s: %s %v, ожидалось %s %v", tt.name, issue.Code, issue.Tasks, tt.wantCode, tt.wantTasks)
+		}
+	}
+}
+
+// Уже сохранённые некорректные рёбра не мешают добавлять несвязанные с ними
+func TestValidateEdgesIgnoresExistingIssues(t *testing.T) {
+	g := newTestGraph()
+	g.addEdge(dependencyEdge{TaskID: 1, DependsOnID: 3})
+	g.addEdge(dependencyEdge{TaskID: 2, DependsOnID: 42})
+	if g.validate() == nil {
+		t.Fatal("validate не нашёл проблем в графе")
+	}
+
+	edge := dependencyEdge{TaskID: 4, DependsOnID: 2}
+	g.addEdge(edge)
+	if err := g.validateEdges([]dependencyEdge{edge}); err != nil {
+		t.Errorf("ребро %v отклонено: %v", edge, err)
+	}
+}
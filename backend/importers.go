@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Форматы файлов, которые принимает загрузка YAML
+const (
+	yamlFormatNative = "native" // собственный формат с секцией pipeline
+	yamlFormatGitLab = "gitlab" // .gitlab-ci.yml
+	yamlFormatGitHub = "github" // .github/workflows/*.yml
+)
+
+// Код ошибки конвертации: конструкция CI-файла, которую нельзя перенести в пайплайн
+const yamlErrUnsupported = "unsupported"
+
+// Определение формата по содержимому: секция pipeline - собственный формат,
+// jobs с runs-on или steps - GitHub Actions, остальное считается GitLab CI
+func detectYamlFormat(document *yaml.Node) string {
+	if document.Kind != yaml.MappingNode {
+		return yamlFormatNative
+	}
+	if mappingValue(document, "pipeline") != nil {
+		return yamlFormatNative
+	}
+	if jobs := mappingValue(document, "jobs"); jobs != nil && jobs.Kind == yaml.MappingNode {
+		for i := 1; i < len(jobs.Content); i += 2 {
+			if mappingValue(jobs.Content[i], "runs-on") != nil || mappingValue(jobs.Content[i], "steps") != nil {
+				return yamlFormatGitHub
+			}
+		}
+	}
+	return yamlFormatGitLab
+}
+
+// Приведение файла GitLab CI или GitHub Actions к собственному формату.
+// Возвращает YAML с секцией pipeline, который дальше проходит обычную проверку и импорт;
+// файлы собственного формата возвращаются без изменений. Имя пайплайна берётся из name,
+// затем из name workflow GitHub, затем из имени загруженного файла.
+// Метки раннера (runs-on GitHub, tags GitLab) по умолчанию становятся тегами задачи.
+// С agents они переносятся в runs_on, и задачи ждут агента с этими метками - об этом
+// возвращаются предупреждения
+func convertCIYaml(content []byte, format, name, fileName string, agents bool) ([]byte, []string, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil || len(root.Content) == 0 {
+		// Синтаксические ошибки с позицией вернёт parsePipelineYAML
+		return content, nil, nil
+	}
+	document := root.Content[0]
+	if format == "" {
+		format = detectYamlFormat(document)
+	}
+
+	var yamlData *YamlPipeline
+	var err error
+	switch format {
+	case yamlFormatNative:
+		return content, nil, nil
+	case yamlFormatGitLab:
+		yamlData, err = convertGitLabCI(document)
+	case yamlFormatGitHub:
+		yamlData, err = convertGitHubWorkflow(document)
+	default:
+		return nil, nil, &YamlValidationError{Issues: []YamlIssue{{Code: yamlErrInvalidValue, Path: "format",
+			Message: fmt.Sprintf("неизвестный формат %q, допустимы native, gitlab и github", format)}}}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var warnings []string
+	for i := range yamlData.Pipeline.Tasks {
+		task := &yamlData.Pipeline.Tasks[i]
+		if len(task.RunsOn) == 0 {
+			continue
+		}
+		if agents {
+			warnings = append(warnings, fmt.Sprintf("задача %q будет ждать агента с метками %s", task.Name, strings.Join(task.RunsOn, ", ")))
+			continue
+		}
+		task.Tags = append(task.Tags, task.RunsOn...)
+		task.RunsOn = nil
+	}
+	if name != "" {
+		yamlData.Pipeline.Name = name
+	}
+	if yamlData.Pipeline.Name == "" {
+		base := strings.TrimSuffix(strings.TrimSuffix(path.Base(fileName), ".yml"), ".yaml")
+		yamlData.Pipeline.Name = strings.TrimPrefix(base, ".")
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(yamlData); err != nil {
+		return nil, nil, err
+	}
+	encoder.Close()
+	return buf.Bytes(), warnings, nil
+}
+
+// Значение ключа в YAML-объекте или nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Строка или список строк (script, needs, runs-on и т.п.)
+func scalarOrList(node *yaml.Node) []string {
+	if node == nil {
+		return nil
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil
+		}
+		return []string{node.Value}
+	case yaml.SequenceNode:
+		var values []string
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				values = append(values, item.Value)
+			} else if item.Kind == yaml.SequenceNode {
+				// В GitLab вложенные списки в script разворачиваются
+				values = append(values, scalarOrList(item)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Зарезервированные ключи верхнего уровня .gitlab-ci.yml, которые не являются заданиями
+var gitlabReservedKeys = map[string]bool{
+	"stages": true, "variables": true, "default": true, "include": true, "workflow": true,
+	"image": true, "services": true, "before_script": true, "after_script": true, "cache": true,
+}
+
+// Стадии GitLab по умолчанию, если stages не заданы
+var gitlabDefaultStages = []string{".pre", "build", "test", "deploy", ".post"}
+
+// Задание GitLab CI с позицией в файле
+type gitlabJob struct {
+	Name  string
+	Node  *yaml.Node
+	Stage string
+	Index int
+}
+
+// Конвертация .gitlab-ci.yml: задания становятся задачами, needs - зависимостями,
+// без needs задание зависит от всех заданий предыдущей стадии. Ручные задания
+// (when: manual) получают перед собой задачу-подтверждение, when: on_failure и always
+// переносятся в условие задачи
+func convertGitLabCI(document *yaml.Node) (*YamlPipeline, error) {
+	v := &yamlValidator{nodes: make(map[string]*yaml.Node)}
+	if document.Kind != yaml.MappingNode {
+		v.add(document, "", yamlErrInvalidType, "ожидается объект с заданиями GitLab CI")
+		return nil, &YamlValidationError{Issues: v.issues}
+	}
+
+	stages := scalarOrList(mappingValue(document, "stages"))
+	if len(stages) == 0 {
+		stages = gitlabDefaultStages
+	} else {
+		stages = append(append([]string{".pre"}, stages...), ".post")
+	}
+	stageIndex := make(map[string]int)
+	for i, stage := range stages {
+		if _, exists := stageIndex[stage]; !exists {
+			stageIndex[stage] = i
+		}
+	}
+
+	templates := make(map[string]*yaml.Node)
+	var jobs []gitlabJob
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		key, value := document.Content[i], document.Content[i+1]
+		if gitlabReservedKeys[key.Value] {
+			continue
+		}
+		if strings.HasPrefix(key.Value, ".") {
+			// Скрытые задания - шаблоны для extends
+			templates[key.Value] = value
+			continue
+		}
+		if value.Kind != yaml.MappingNode {
+			v.add(value, key.Value, yamlErrInvalidType, "ожидается описание задания")
+			continue
+		}
+		jobs = append(jobs, gitlabJob{Name: key.Value, Node: value, Index: len(jobs)})
+	}
+
+	defaults := mappingValue(document, "default")
+	globalBefore := scalarOrList(mappingValue(document, "before_script"))
+	globalAfter := scalarOrList(mappingValue(document, "after_script"))
+	if defaults != nil {
+		if before := scalarOrList(mappingValue(defaults, "before_script")); before != nil {
+			globalBefore = before
+		}
+		if after := scalarOrList(mappingValue(defaults, "after_script")); after != nil {
+			globalAfter = after
+		}
+	}
+
+	for i := range jobs {
+		jobs[i].Node = gitlabResolveExtends(v, jobs[i].Name, jobs[i].Node, templates, 0)
+		jobs[i].Stage = "test"
+		if stage := mappingValue(jobs[i].Node, "stage"); stage != nil {
+			jobs[i].Stage = stage.Value
+		}
+		if _, ok := stageIndex[jobs[i].Stage]; !ok {
+			v.add(mappingValue(jobs[i].Node, "stage"), jobs[i].Name+".stage", yamlErrInvalidValue,
+				fmt.Sprintf("стадия %q не объявлена в stages", jobs[i].Stage))
+		}
+	}
+	// Задачи идут в порядке стадий, внутри стадии - в порядке файла
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return stageIndex[jobs[i].Stage] < stageIndex[jobs[j].Stage]
+	})
+
+	jobNames := make(map[string]bool)
+	for _, job := range jobs {
+		jobNames[job.Name] = true
+	}
+
+	yamlData := &YamlPipeline{}
+	// Глобальные variables становятся переменными пайплайна: ${VAR} в скриптах
+	// подставляется при импорте, $VAR остаётся оболочке
+	if variables := mappingValue(document, "variables"); variables != nil && variables.Kind == yaml.MappingNode {
+		yamlData.Pipeline.Variables = make(map[string]string)
+		for i := 0; i+1 < len(variables.Content); i += 2 {
+			value := variables.Content[i+1]
+			if nested := mappingValue(value, "value"); nested != nil {
+				value = nested
+			}
+			yamlData.Pipeline.Variables[variables.Content[i].Value] = value.Value
+		}
+	}
+	for _, job := range jobs {
+		task := YamlTask{Name: job.Name, Status: "Pending", Description: "stage: " + job.Stage}
+
+		before := globalBefore
+		if jobBefore := mappingValue(job.Node, "before_script"); jobBefore != nil {
+			before = scalarOrList(jobBefore)
+		}
+		after := globalAfter
+		if jobAfter := mappingValue(job.Node, "after_script"); jobAfter != nil {
+			after = scalarOrList(jobAfter)
+		}
+		var lines []string
+		lines = append(lines, before...)
+		lines = append(lines, scalarOrList(mappingValue(job.Node, "script"))...)
+		lines = append(lines, after...)
+		task.Script = strings.Join(lines, "\n")
+		if !strings.Contains(task.Script, "\n") {
+			task.Command, task.Script = task.Script, ""
+		}
+
+		// Метки раннера; в runs_on остаются только при импорте с runners=agents
+		task.RunsOn = scalarOrList(mappingValue(job.Node, "tags"))
+		if retry := mappingValue(job.Node, "retry"); retry != nil {
+			if max := mappingValue(retry, "max"); max != nil {
+				retry = max
+			}
+			task.Retries, _ = strconv.Atoi(retry.Value)
+		}
+		if timeout := mappingValue(job.Node, "timeout"); timeout != nil {
+			seconds, ok := parseGitLabDuration(timeout.Value)
+			if !ok {
+				v.add(timeout, job.Name+".timeout", yamlErrInvalidDuration, fmt.Sprintf("некорректная длительность %q", timeout.Value))
+			}
+			task.Timeout = formatYamlDuration(seconds)
+		}
+
+		if needs := mappingValue(job.Node, "needs"); needs != nil {
+			for i, need := range gitlabNeeds(needs) {
+				if !jobNames[need.Job] {
+					if !need.Optional {
+						v.add(needs.Content[i], job.Name+".needs", yamlErrUnknownDependency,
+							fmt.Sprintf("задание %q ссылается на несуществующее задание %q", job.Name, need.Job))
+					}
+					continue
+				}
+				task.DependsOn = append(task.DependsOn, need.Job)
+			}
+		} else {
+			// Без needs задание ждёт все задания ближайшей предыдущей непустой стадии
+			previous := -1
+			for _, other := range jobs {
+				if idx := stageIndex[other.Stage]; idx < stageIndex[job.Stage] && idx > previous {
+					previous = idx
+				}
+			}
+			for _, other := range jobs {
+				if previous >= 0 && stageIndex[other.Stage] == previous {
+					task.DependsOn = append(task.DependsOn, other.Name)
+				}
+			}
+		}
+
+		when := mappingValue(job.Node, "when")
+		if when != nil && (when.Value == "on_failure" || when.Value == "always") {
+			task.When = when.Value
+		}
+		if when != nil && when.Value == "manual" {
+			gate := YamlTask{
+				Name:        job.Name + " (подтверждение)",
+				Description: "ручной запуск задания " + job.Name,
+				Status:      "Pending",
+				Type:        "approval",
+				DependsOn:   task.DependsOn,
+			}
+			yamlData.Pipeline.Tasks = append(yamlData.Pipeline.Tasks, gate)
+			task.DependsOn = []string{gate.Name}
+		}
+		yamlData.Pipeline.Tasks = append(yamlData.Pipeline.Tasks, task)
+	}
+
+	if len(v.issues) > 0 {
+		return nil, &YamlValidationError{Issues: v.issues}
+	}
+	return yamlData, nil
+}
+
+// Зависимость из needs: строка или объект {job: ..., optional: true}
+type gitlabNeed struct {
+	Job      string
+	Optional bool
+}
+
+func gitlabNeeds(node *yaml.Node) []gitlabNeed {
+	var needs []gitlabNeed
+	if node.Kind != yaml.SequenceNode {
+		return needs
+	}
+	for _, item := range node.Content {
+		if item.Kind == yaml.ScalarNode {
+			needs = append(needs, gitlabNeed{Job: item.Value})
+			continue
+		}
+		need := gitlabNeed{}
+		if job := mappingValue(item, "job"); job != nil {
+			need.Job = job.Value
+		}
+		if optional := mappingValue(item, "optional"); optional != nil {
+			need.Optional = optional.Value == "true"
+		}
+		needs = append(needs, need)
+	}
+	return needs
+}
+
+// Применение extends: ключи шаблонов подставляются, если задание их не переопределяет.
+// Вложенные объекты (variables и т.п.) сливаются, как это делает GitLab
+func gitlabResolveExtends(v *yamlValidator, jobName string, job *yaml.Node, templates map[string]*yaml.Node, depth int) *yaml.Node {
+	extends := mappingValue(job, "extends")
+	if extends == nil {
+		return job
+	}
+	if depth > 10 {
+		v.add(extends, jobName+".extends", yamlErrUnsupported, "слишком глубокая цепочка extends")
+		return job
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Line: job.Line, Column: job.Column}
+	for _, templateName := range scalarOrList(extends) {
+		template, ok := templates[templateName]
+		if !ok {
+			v.add(extends, jobName+".extends", yamlErrUnknownDependency, fmt.Sprintf("шаблон %q не найден", templateName))
+			continue
+		}
+		merged = mergeYamlMappings(merged, gitlabResolveExtends(v, templateName, template, templates, depth+1))
+	}
+	return mergeYamlMappings(merged, job)
+}
+
+// Слияние двух YAML-объектов: значения override заменяют base, вложенные объекты сливаются
+func mergeYamlMappings(base, override *yaml.Node) *yaml.Node {
+	result := &yaml.Node{Kind: yaml.MappingNode, Line: override.Line, Column: override.Column}
+	index := make(map[string]int)
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		index[base.Content[i].Value] = len(result.Content)
+		result.Content = append(result.Content, base.Content[i], base.Content[i+1])
+	}
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+		if key.Value == "extends" {
+			continue
+		}
+		if at, exists := index[key.Value]; exists {
+			if previous := result.Content[at+1]; previous.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+				value = mergeYamlMappings(previous, value)
+			}
+			result.Content[at+1] = value
+			continue
+		}
+		index[key.Value] = len(result.Content)
+		result.Content = append(result.Content, key, value)
+	}
+	return result
+}
+
+// Длительность в формате GitLab: "1h 30m", "3 hours", "90 minutes", "45s"
+var gitlabDurationPart = regexp.MustCompile(`(\d+)\s*(h|hr|hrs|hours?|m|min|mins|minutes?|s|sec|secs|seconds?)\b`)
+
+func parseGitLabDuration(value string) (int, bool) {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		return seconds, true
+	}
+	parts := gitlabDurationPart.FindAllStringSubmatch(strings.ToLower(value), -1)
+	if len(parts) == 0 {
+		return 0, false
+	}
+	total := 0
+	for _, part := range parts {
+		n, _ := strconv.Atoi(part[1])
+		switch part[2][0] {
+		case 'h':
+			total += n * 3600
+		case 'm':
+			total += n * 60
+		default:
+			total += n
+		}
+	}
+	return total, true
+}
+
+// Конвертация workflow GitHub Actions: задания становятся задачами, needs - зависимостями,
+// шаги run собираются в скрипт задачи, шаги uses остаются комментариями
+func convertGitHubWorkflow(document *yaml.Node) (*YamlPipeline, error) {
+	v := &yamlValidator{nodes: make(map[string]*yaml.Node)}
+	jobsNode := mappingValue(document, "jobs")
+	if jobsNode == nil || jobsNode.Kind != yaml.MappingNode {
+		v.add(document, "jobs", yamlErrRequired, "в workflow нет секции jobs")
+		return nil, &YamlValidationError{Issues: v.issues}
+	}
+
+	yamlData := &YamlPipeline{}
+	if workflowName := mappingValue(document, "name"); workflowName != nil && workflowName.Value != "" {
+		yamlData.Pipeline.Name = workflowName.Value
+	}
+
+	jobIDs := make(map[string]bool)
+	for i := 0; i+1 < len(jobsNode.Content); i += 2 {
+		jobIDs[jobsNode.Content[i].Value] = true
+	}
+
+	for i := 0; i+1 < len(jobsNode.Content); i += 2 {
+		jobID, job := jobsNode.Content[i].Value, jobsNode.Content[i+1]
+		jobPath := "jobs." + jobID
+		if job.Kind != yaml.MappingNode {
+			v.add(job, jobPath, yamlErrInvalidType, "ожидается описание задания")
+			continue
+		}
+		if mappingValue(job, "uses") != nil {
+			v.add(mappingValue(job, "uses"), jobPath+".uses", yamlErrUnsupported, "повторно используемые workflow не поддерживаются")
+			continue
+		}
+
+		task := YamlTask{Name: jobID, Status: "Pending"}
+		if jobName := mappingValue(job, "name"); jobName != nil {
+			task.Description = jobName.Value
+		}
+		// Метки раннера; в runs_on остаются только при импорте с runners=agents
+		task.RunsOn = scalarOrList(mappingValue(job, "runs-on"))
+
+		needsNode := mappingValue(job, "needs")
+		for _, need := range scalarOrList(needsNode) {
+			if !jobIDs[need] {
+				v.add(needsNode, jobPath+".needs", yamlErrUnknownDependency,
+					fmt.Sprintf("задание %q ссылается на несуществующее задание %q", jobID, need))
+				continue
+			}
+			task.DependsOn = append(task.DependsOn, need)
+		}
+
+		if timeout := mappingValue(job, "timeout-minutes"); timeout != nil {
+			minutes, err := strconv.Atoi(timeout.Value)
+			if err != nil {
+				v.add(timeout, jobPath+".timeout-minutes", yamlErrInvalidType, "ожидается целое число минут")
+			}
+			task.Timeout = formatYamlDuration(minutes * 60)
+		}
+
+		var lines []string
+		if steps := mappingValue(job, "steps"); steps != nil && steps.Kind == yaml.SequenceNode {
+			for _, step := range steps.Content {
+				if stepName := mappingValue(step, "name"); stepName != nil {
+					lines = append(lines, "# "+stepName.Value)
+				}
+				if uses := mappingValue(step, "uses"); uses != nil {
+					lines = append(lines, "# uses: "+uses.Value)
+				}
+				if run := mappingValue(step, "run"); run != nil {
+					lines = append(lines, strings.TrimRight(run.Value, "\n"))
+				}
+			}
+		}
+		task.Script = strings.Join(lines, "\n")
+		if !strings.Contains(task.Script, "\n") {
+			task.Command, task.Script = task.Script, ""
+		}
+
+		yamlData.Pipeline.Tasks = append(yamlData.Pipeline.Tasks, task)
+	}
+
+	if len(v.issues) > 0 {
+		return nil, &YamlValidationError{Issues: v.issues}
+	}
+	return yamlData, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Метки раннера GitHub (runs-on) и GitLab (tags) импортируются одинаково: тегами
+// по умолчанию и в runs_on с предупреждением при runners=agents
+func TestConvertCIYamlRunnerLabels(t *testing.T) {
+	files := map[string]string{
+		yamlFormatGitHub: `
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - run: make
+`,
+		yamlFormatGitLab: `
+build:
+  tags: [ubuntu-latest]
+  script: make
+`,
+	}
+	for format, content := range files {
+		for _, agents := range []bool{false, true} {
+			converted, warnings, err := convertCIYaml([]byte(content), format, "ci", "ci.yml", agents)
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			var result YamlPipeline
+			if err := yaml.Unmarshal(converted, &result); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if len(result.Pipeline.Tasks) != 1 {
+				t.Fatalf("%s: задачи %+v", format, result.Pipeline.Tasks)
+			}
+			task := result.Pipeline.Tasks[0]
+			labels := []string{"ubuntu-latest"}
+			if agents {
+				if task.Tags != nil || !reflect.DeepEqual(task.RunsOn, labels) || len(warnings) != 1 {
+					t.Errorf("%s с агентами: tags %v, runs_on %v, предупреждения %v", format, task.Tags, task.RunsOn, warnings)
+				}
+			} else if !reflect.DeepEqual(task.Tags, labels) || task.RunsOn != nil || warnings != nil {
+				t.Errorf("%s: tags %v, runs_on %v, предупреждения %v", format, task.Tags, task.RunsOn, warnings)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Максимальная глубина вложенных include
+const yamlMaxIncludeDepth = 10
+
+// Ссылка include на сохранённое определение; version = 0 - последняя версия
+// (или версия, закреплённая при сохранении включающего определения)
+type yamlInclude struct {
+	Definition string
+	Version    int
+	Node       *yaml.Node
+}
+
+// Разбор списка include: элемент - имя определения или {definition, version}
+func parseYamlIncludes(node *yaml.Node) []yamlInclude {
+	var includes []yamlInclude
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return includes
+	}
+	for _, item := range node.Content {
+		include := yamlInclude{Node: item}
+		switch item.Kind {
+		case yaml.ScalarNode:
+			include.Definition = item.Value
+		case yaml.MappingNode:
+			if definition := mappingValue(item, "definition"); definition != nil {
+				include.Definition = definition.Value
+			}
+			if version := mappingValue(item, "version"); version != nil {
+				version.Decode(&include.Version)
+			}
+		}
+		if include.Definition != "" {
+			includes = append(includes, include)
+		}
+	}
+	return includes
+}
+
+// Подключение сохранённых определений и шаблонов задач до проверки схемы.
+// Правила слияния:
+//   - include подключаются по порядку, их задачи идут перед задачами файла;
+//     задачи с одинаковыми именами считаются ошибкой duplicate_task_name;
+//   - variables и templates: более поздний include заменяет более ранний,
+//     значения самого файла заменяют подключённые;
+//   - extends: шаблоны применяются по порядку списка, затем поля самой задачи;
+//     вложенные объекты сливаются, скаляры и списки заменяются целиком
+func (v *yamlValidator) expandIncludes(document *yaml.Node, definitions dbQuerier) {
+	pipeline := mappingValue(document, "pipeline")
+	if pipeline == nil || pipeline.Kind != yaml.MappingNode {
+		return
+	}
+	var stack []string
+	if name := mappingValue(pipeline, "name"); name != nil {
+		stack = append(stack, name.Value)
+	}
+	v.resolveIncludes(pipeline, definitions, stack, nil)
+	v.resolveExtends(pipeline)
+}
+
+// Рекурсивное подключение определений; stack - цепочка имён для обнаружения циклов.
+// Ошибки во вложенных определениях привязываются к элементу include исходного файла (origin)
+func (v *yamlValidator) resolveIncludes(pipeline *yaml.Node, definitions dbQuerier, stack []string, origin *yaml.Node) {
+	includes := parseYamlIncludes(mappingValue(pipeline, "include"))
+	if len(includes) == 0 {
+		return
+	}
+
+	variables := &yaml.Node{Kind: yaml.MappingNode}
+	templates := &yaml.Node{Kind: yaml.MappingNode}
+	tasks := &yaml.Node{Kind: yaml.SequenceNode}
+
+	for _, include := range includes {
+		if origin != nil {
+			include.Node = origin
+		}
+		if definitions == nil {
+			v.add(include.Node, "pipeline.include", yamlErrUnknownInclude, "подключение определений недоступно")
+			continue
+		}
+		if len(stack) >= yamlMaxIncludeDepth {
+			v.add(include.Node, "pipeline.include", yamlErrIncludeCycle, "слишком глубокая вложенность include")
+			continue
+		}
+		if containsString(stack, include.Definition) {
+			v.add(include.Node, "pipeline.include", yamlErrIncludeCycle,
+				fmt.Sprintf("циклическое подключение определения %q", include.Definition))
+			continue
+		}
+
+		version := include.Version
+		if version == 0 {
+			version = v.pinnedIncludes[include.Definition]
+		}
+		var content string
+		var resolved int
+		err := definitions.QueryRow(`
+            SELECT v.yaml, v.version FROM pipeline_definition d
+            JOIN pipeline_definition_version v ON v.definition_id = d.definition_id
+            WHERE d.name = $1 AND ($2 = 0 OR v.version = $2)
+            ORDER BY v.version DESC LIMIT 1`, include.Definition, version).Scan(&content, &resolved)
+		if err == sql.ErrNoRows {
+			message := fmt.Sprintf("определение %q не найдено", include.Definition)
+			if version > 0 {
+				message = fmt.Sprintf("версия %d определения %q не найдена", version, include.Definition)
+			}
+			v.add(include.Node, "pipeline.include", yamlErrUnknownInclude, message)
+			continue
+		} else if err != nil {
+			v.add(include.Node, "pipeline.include", yamlErrUnknownInclude,
+				fmt.Sprintf("ошибка загрузки определения %q: %v", include.Definition, err))
+			continue
+		}
+		if include.Version == 0 {
+			v.resolvedIncludes[include.Definition] = resolved
+		}
+
+		var root yaml.Node
+		if err := yaml.Unmarshal([]byte(content), &root); err != nil || len(root.Content) == 0 {
+			v.add(include.Node, "pipeline.include", yamlErrUnknownInclude,
+				fmt.Sprintf("определение %q содержит некорректный YAML", include.Definition))
+			continue
+		}
+		included := mappingValue(root.Content[0], "pipeline")
+		if included == nil || included.Kind != yaml.MappingNode {
+			continue
+		}
+		v.resolveIncludes(included, definitions, append(stack, include.Definition), include.Node)
+
+		mergeYamlEntries(variables, mappingValue(included, "variables"))
+		mergeYamlEntries(templates, mappingValue(included, "templates"))
+		if includedTasks := mappingValue(included, "tasks"); includedTasks != nil && includedTasks.Kind == yaml.SequenceNode {
+			tasks.Content = append(tasks.Content, includedTasks.Content...)
+		}
+	}
+
+	// Собственные значения файла идут после подключённых и заменяют их
+	setYamlMappingValue(pipeline, "variables", mergeYamlEntries(variables, mappingValue(pipeline, "variables")))
+	setYamlMappingValue(pipeline, "templates", mergeYamlEntries(templates, mappingValue(pipeline, "templates")))
+	if ownTasks := mappingValue(pipeline, "tasks"); ownTasks != nil && ownTasks.Kind == yaml.SequenceNode {
+		tasks.Content = append(tasks.Content, ownTasks.Content...)
+	}
+	setYamlMappingValue(pipeline, "tasks", tasks)
+}
+
+// Применение extends к задачам пайплайна
+func (v *yamlValidator) resolveExtends(pipeline *yaml.Node) {
+	templates := mappingValue(pipeline, "templates")
+	tasks := mappingValue(pipeline, "tasks")
+	if tasks == nil || tasks.Kind != yaml.SequenceNode {
+		return
+	}
+	for i, task := range tasks.Content {
+		if mappingValue(task, "extends") != nil {
+			tasks.Content[i] = v.extendTask(task, templates, fmt.Sprintf("pipeline.tasks[%d]", i), nil)
+		}
+	}
+}
+
+// Слияние задачи (или шаблона) с шаблонами из extends; chain - цепочка шаблонов для обнаружения циклов
+func (v *yamlValidator) extendTask(task, templates *yaml.Node, path string, chain []string) *yaml.Node {
+	extends := mappingValue(task, "extends")
+	if extends == nil || task.Kind != yaml.MappingNode {
+		return task
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Line: task.Line, Column: task.Column}
+	for _, name := range scalarOrList(extends) {
+		if containsString(chain, name) {
+			v.add(extends, path+".extends", yamlErrTemplateCycle, fmt.Sprintf("циклическое наследование шаблона %q", name))
+			continue
+		}
+		template := mappingValue(templates, name)
+		if template == nil || template.Kind != yaml.MappingNode {
+			v.add(extends, path+".extends", yamlErrUnknownTemplate, fmt.Sprintf("шаблон %q не найден в pipeline.templates", name))
+			continue
+		}
+		resolved := v.extendTask(template, templates, "pipeline.templates."+name, append(chain, name))
+		merged = mergeYamlMappings(merged, resolved)
+	}
+	return mergeYamlMappings(merged, task)
+}
+
+// Добавление пар ключ-значение из source в target с заменой существующих ключей
+func mergeYamlEntries(target, source *yaml.Node) *yaml.Node {
+	if source == nil || source.Kind != yaml.MappingNode {
+		return target
+	}
+	for i := 0; i+1 < len(source.Content); i += 2 {
+		setYamlMappingValue(target, source.Content[i].Value, source.Content[i+1])
+	}
+	return target
+}
+
+// Установка значения ключа в YAML-объекте; пустые объекты и списки не добавляются
+func setYamlMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	if (value.Kind == yaml.MappingNode || value.Kind == yaml.SequenceNode) && len(value.Content) == 0 {
+		return
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
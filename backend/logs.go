@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// Сколько записей журнала можно прислать одним запросом
+	maxTaskLogBatch = 1000
+	// Размер страницы журнала по умолчанию и максимум
+	defaultTaskLogPage = 100
+	maxTaskLogPage     = 1000
+)
+
+// Уровни строк журнала задачи (task_log.log_type)
+var taskLogLevels = map[string]bool{"Info": true, "Warning": true, "Error": true}
+
+// Запись журнала задачи
+type TaskLogEntry struct {
+	LogID   int    `json:"log_id"`
+	TaskID  int    `json:"task_id"`
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Новая строка журнала; нулевое At - время записи в базу
+type taskLogLine struct {
+	Level   string
+	Message string
+	At      time.Time
+}
+
+// Запись строк в журнал задачи и рассылка подписчикам журнала. С countProblems
+// каждая запись Error или Warning увеличивает счётчик в task_metrics в той же
+// транзакции, что и сами записи. Возвращает записи с присвоенными log_id и временем
+func appendTaskLogs(taskID int, lines []taskLogLine, countProblems bool) ([]TaskLogEntry, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	levels := make([]string, len(lines))
+	messages := make([]string, len(lines))
+	// task_log.log_time без часового пояса, время хранится в UTC; пустая строка - время записи
+	times := make([]string, len(lines))
+	errors, warnings := 0, 0
+	for i, line := range lines {
+		levels[i], messages[i] = line.Level, line.Message
+		if !line.At.IsZero() {
+			times[i] = line.At.UTC().Format("2006-01-02 15:04:05.999999")
+		}
+		switch line.Level {
+		case "Error":
+			errors++
+		case "Warning":
+			warnings++
+		}
+	}
+
+	entries := make([]TaskLogEntry, 0, len(lines))
+	err := withTx(func(tx *sql.Tx) error {
+		// Вся пачка одним запросом; log_id выдаются в порядке ord
+		rows, err := tx.Query(`
+            INSERT INTO task_log (task_id, log_type, message, log_time)
+            SELECT $1, l.level, l.message, COALESCE(NULLIF(l.at, '')::timestamp, NOW() AT TIME ZONE 'UTC')
+            FROM unnest($2::text[], $3::text[], $4::text[]) WITH ORDINALITY AS l(level, message, at, ord)
+            ORDER BY l.ord
+            RETURNING log_id, log_type, message, log_time`,
+			taskID, pq.Array(levels), pq.Array(messages), pq.Array(times))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			entry := TaskLogEntry{TaskID: taskID}
+			var logTime sql.NullTime
+			if err := rows.Scan(&entry.LogID, &entry.Level, &entry.Message, &logTime); err != nil {
+				return err
+			}
+			entry.Time = formatTime(logTime)
+			entries = append(entries, entry)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if countProblems && errors+warnings > 0 {
+			return updateErrorAndWarningCounts(tx, taskID, errors, warnings)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING не гарантирует порядок строк, подписчикам они нужны по log_id
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LogID < entries[j].LogID })
+	publishTaskLogs(taskID, entries)
+	return entries, nil
+}
+
+// Служебные сообщения сервера в журнал задачи; на счётчики ошибок не влияют
+func insertTaskLogs(taskID int, level string, messages []string) error {
+	lines := make([]taskLogLine, len(messages))
+	for i, message := range messages {
+		lines[i] = taskLogLine{Level: level, Message: message}
+	}
+	_, err := appendTaskLogs(taskID, lines, false)
+	return err
+}
+
+// Вывод команды, выполняемой сервером, построчно в журнал задачи. Строки копятся
+// и записываются пачками: по taskLogFlushLines строк или раз в taskLogFlushInterval
+type taskLogWriter struct {
+	taskID  int
+	mu      sync.Mutex
+	partial []byte
+	lines   []taskLogLine
+	timer   *time.Timer
+}
+
+const (
+	taskLogFlushLines    = 100
+	taskLogFlushInterval = time.Second
+	// Строка длиннее этого записывается частями
+	taskLogMaxLine = 64 * 1024
+)
+
+func newTaskLogWriter(taskID int) *taskLogWriter {
+	return &taskLogWriter{taskID: taskID}
+}
+
+func (w *taskLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.addLine(string(bytes.TrimSuffix(w.partial[:i], []byte("\r"))))
+		w.partial = w.partial[i+1:]
+	}
+	if len(w.partial) >= taskLogMaxLine {
+		w.addLine(string(w.partial))
+		w.partial = nil
+	}
+
+	if len(w.lines) >= taskLogFlushLines {
+		w.flushLocked()
+	} else if len(w.lines) > 0 && w.timer == nil {
+		w.timer = time.AfterFunc(taskLogFlushInterval, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.timer = nil
+			w.flushLocked()
+		})
+	}
+	// Ошибки записи журнала не должны прерывать команду
+	return len(p), nil
+}
+
+func (w *taskLogWriter) addLine(message string) {
+	w.lines = append(w.lines, taskLogLine{Level: "Info", Message: message})
+}
+
+// Запись оставшегося вывода, включая строку без завершающего перевода строки
+func (w *taskLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.partial) > 0 {
+		w.addLine(string(w.partial))
+		w.partial = nil
+	}
+	w.flushLocked()
+	return nil
+}
+
+func (w *taskLogWriter) flushLocked() {
+	if len(w.lines) == 0 {
+		return
+	}
+	if _, err := appendTaskLogs(w.taskID, w.lines, false); err != nil {
+		log.Printf("Ошибка записи вывода задачи %d в журнал: %v", w.taskID, err)
+	}
+	w.lines = nil
+}
+
+// Время в параметрах журнала: RFC 3339 или, как в ответах API, "2006-01-02 15:04:05" в UTC
+func parseTaskLogTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("некорректное время %q", value)
+}
+
+// Запись журнала в теле запроса
+type taskLogRequest struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Time    string `json:"time"`
+}
+
+// Разбор тела POST /api/task/{task_id}/logs: один объект, массив объектов
+// или JSON lines - по объекту (или массиву) на строку
+func parseTaskLogRequests(body io.Reader) ([]taskLogLine, error) {
+	var requests []taskLogRequest
+	decoder := json.NewDecoder(body)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("неверный JSON: %v", err)
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			var batch []taskLogRequest
+			if err := json.Unmarshal(raw, &batch); err != nil {
+				return nil, fmt.Errorf("неверный JSON: %v", err)
+			}
+			requests = append(requests, batch...)
+		} else {
+			var single taskLogRequest
+			if err := json.Unmarshal(raw, &single); err != nil {
+				return nil, fmt.Errorf("неверный JSON: %v", err)
+			}
+			requests = append(requests, single)
+		}
+		if len(requests) > maxTaskLogBatch {
+			return nil, fmt.Errorf("не больше %d записей за запрос", maxTaskLogBatch)
+		}
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("нет записей журнала")
+	}
+
+	lines := make([]taskLogLine, len(requests))
+	for i, req := range requests {
+		line := taskLogLine{Level: req.Level, Message: req.Message}
+		if line.Level == "" {
+			line.Level = "Info"
+		}
+		if !taskLogLevels[line.Level] {
+			return nil, fmt.Errorf("запись %d: level должен быть Info, Warning или Error", i+1)
+		}
+		if req.Time != "" {
+			at, err := parseTaskLogTime(req.Time)
+			if err != nil {
+				return nil, fmt.Errorf("запись %d: %v", i+1, err)
+			}
+			line.At = at
+		}
+		lines[i] = line
+	}
+	return lines, nil
+}
+
+// Приём журнала задачи: POST /api/task/{task_id}/logs.
+// Тело: {"level": "Error", "message": "...", "time": "2024-01-02T10:00:00Z"}, массив таких
+// объектов или JSON lines; level по умолчанию Info, time - время приёма
+func postTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Некорректный task_id", http.StatusBadRequest)
+		return
+	}
+	lines, err := parseTaskLogRequests(r.Body)
+	if err != nil {
+		http.Error(w, "Неверные данные: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM task WHERE task_id = $1)`, taskID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	}
+
+	entries, err := appendTaskLogs(taskID, lines, true)
+	if err != nil {
+		http.Error(w, "Ошибка записи журнала", http.StatusInternalServerError)
+		return
+	}
+
+	logIDs := make([]int, len(entries))
+	for i, entry := range entries {
+		logIDs[i] = entry.LogID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":  taskID,
+		"accepted": len(entries),
+		"log_ids":  logIDs,
+	})
+}
+
+// Журнал задачи по страницам в порядке записи:
+// GET /api/task/{task_id}/logs?level=Error,Warning&since=...&until=...&after_id=0&limit=100.
+// Следующая страница запрашивается с after_id = next_after_id из ответа
+func getTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Некорректный task_id", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+
+	var levels []string
+	if value := query.Get("level"); value != "" {
+		for _, level := range strings.Split(value, ",") {
+			level = strings.TrimSpace(level)
+			if !taskLogLevels[level] {
+				http.Error(w, "level должен быть Info, Warning или Error", http.StatusBadRequest)
+				return
+			}
+			levels = append(levels, level)
+		}
+	}
+	var since, until interface{}
+	for name, target := range map[string]*interface{}{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			t, err := parseTaskLogTime(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Некорректный %s", name), http.StatusBadRequest)
+				return
+			}
+			*target = t.UTC()
+		}
+	}
+	afterID := 0
+	if value := query.Get("after_id"); value != "" {
+		if afterID, err = strconv.Atoi(value); err != nil || afterID < 0 {
+			http.Error(w, "Некорректный after_id", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultTaskLogPage
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxTaskLogPage {
+			http.Error(w, fmt.Sprintf("limit должен быть от 1 до %d", maxTaskLogPage), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM task WHERE task_id = $1)`, taskID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	}
+
+	// Берём на одну запись больше, чтобы понять, есть ли следующая страница
+	rows, err := db.Query(`
+        SELECT log_id, log_time, log_type, COALESCE(message, '')
+        FROM task_log
+        WHERE task_id = $1
+          AND (cardinality($2::text[]) = 0 OR log_type = ANY($2::text[]))
+          AND ($3::timestamp IS NULL OR log_time >= $3::timestamp)
+          AND ($4::timestamp IS NULL OR log_time < $4::timestamp)
+          AND log_id > $5
+        ORDER BY log_id
+        LIMIT $6`, taskID, pqArray(levels), since, until, afterID, limit+1)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []TaskLogEntry{}
+	for rows.Next() {
+		entry := TaskLogEntry{TaskID: taskID}
+		var logTime sql.NullTime
+		if err := rows.Scan(&entry.LogID, &logTime, &entry.Level, &entry.Message); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		entry.Time = formatTime(logTime)
+		entries = append(entries, entry)
+	}
+
+	var nextAfterID *int
+	if len(entries) > limit {
+		entries = entries[:limit]
+		nextAfterID = &entries[limit-1].LogID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":       taskID,
+		"logs":          entries,
+		"next_after_id": nextAfterID,
+	})
+}
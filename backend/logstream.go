@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Хвост журнала при подписке по умолчанию
+	defaultTaskLogTail = 100
+	// Сколько ждать записи одного сообщения, прежде чем отключить клиента
+	wsWriteTimeout = 5 * time.Second
+	// Очередь отправки соединения. Клиент, у которого она переполнилась, не успевает
+	// читать и отключается, чтобы не задерживать рассылку остальным
+	wsSendBuffer = 256
+)
+
+// Соединение WebSocket с очередью отправки. В соединение пишет только его горутина
+// writeLoop, поэтому рассылка и запись журналов в базу не ждут сеть
+type wsClient struct {
+	conn      *websocket.Conn
+	send      chan interface{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Закрытие соединения с кодом и причиной после отправки уже поставленных сообщений
+type wsCloseMessage struct {
+	code int
+	text string
+}
+
+func newWSClient(conn *websocket.Conn) *wsClient {
+	c := &wsClient{
+		conn:   conn,
+		send:   make(chan interface{}, wsSendBuffer),
+		closed: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// Постановка сообщения в очередь без ожидания; false - клиент отключён
+func (c *wsClient) enqueue(msg interface{}) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if closeMsg, ok := msg.(wsCloseMessage); ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeMsg.code, closeMsg.text))
+				c.close()
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// Отправка сообщения о закрытии и ожидание, пока writeLoop его запишет
+func (c *wsClient) closeWith(code int, text string) {
+	if c.enqueue(wsCloseMessage{code: code, text: text}) {
+		<-c.closed
+	}
+}
+
+// Сообщение клиента WebSocket.
+// {"action": "subscribe_logs", "task_id": 5, "tail": 100, "follow": true} - последние tail строк
+// журнала задачи и дальше новые строки по мере записи; follow=false - только хвост.
+// {"action": "unsubscribe_logs", "task_id": 5} - отписка
+type wsClientMessage struct {
+	Action string `json:"action"`
+	TaskID int    `json:"task_id"`
+	Tail   *int   `json:"tail"`
+	Follow *bool  `json:"follow"`
+}
+
+// Подписка соединения на журнал задачи. Пока хвост не отправлен, новые строки
+// копятся в queue, чтобы не потерять записанные между чтением хвоста и подпиской
+type logSubscription struct {
+	pending bool
+	queue   []TaskLogEntry
+}
+
+// Подписки на журналы: task_id -> соединение -> подписка. Защищены clientsMutex,
+// под ним же сообщения ставятся в очереди соединений, чтобы сохранить их порядок
+var logSubscriptions = make(map[int]map[*wsClient]*logSubscription)
+
+// Обработка сообщений клиента /ws
+func handleClientMessage(ws *wsClient, msg wsClientMessage) {
+	switch msg.Action {
+	case "subscribe_logs":
+		tail := defaultTaskLogTail
+		if msg.Tail != nil {
+			tail = *msg.Tail
+		}
+		follow := msg.Follow == nil || *msg.Follow
+		if err := subscribeTaskLogs(ws, msg.TaskID, tail, follow); err != nil {
+			writeClientJSON(ws, map[string]interface{}{
+				"action":  "error",
+				"task_id": msg.TaskID,
+				"message": err.Error(),
+			})
+		}
+	case "unsubscribe_logs":
+		unsubscribeTaskLogs(ws, msg.TaskID)
+	default:
+		writeClientJSON(ws, map[string]interface{}{
+			"action":  "error",
+			"message": fmt.Sprintf("Неизвестное действие %q", msg.Action),
+		})
+	}
+}
+
+// Отдельный поток журнала одной задачи: GET /ws/task/{task_id}/logs?tail=100&follow=true.
+// Получает те же сообщения task_logs, что и подписка через /ws, но без событий пайплайнов
+func handleTaskLogStream(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Некорректный task_id", http.StatusBadRequest)
+		return
+	}
+	tail := defaultTaskLogTail
+	if value := r.URL.Query().Get("tail"); value != "" {
+		if tail, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Некорректный tail", http.StatusBadRequest)
+			return
+		}
+	}
+	follow := true
+	if value := r.URL.Query().Get("follow"); value != "" {
+		if follow, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Некорректный follow", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ws := newWSClient(conn)
+	defer ws.close()
+	defer unsubscribeAllTaskLogs(ws)
+
+	if err := subscribeTaskLogs(ws, taskID, tail, follow); err != nil {
+		ws.closeWith(websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+	if !follow {
+		ws.closeWith(websocket.CloseNormalClosure, "")
+		return
+	}
+	// Сообщения клиента не нужны, чтение только обнаруживает закрытие соединения
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// Отправка хвоста журнала и, при follow, подписка на новые строки
+func subscribeTaskLogs(ws *wsClient, taskID int, tail int, follow bool) error {
+	if tail < 0 || tail > maxTaskLogPage {
+		return fmt.Errorf("tail должен быть от 0 до %d", maxTaskLogPage)
+	}
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM task WHERE task_id = $1)`, taskID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("ошибка базы данных")
+	}
+	if !exists {
+		return fmt.Errorf("задача %d не найдена", taskID)
+	}
+
+	var subscription *logSubscription
+	if follow {
+		subscription = &logSubscription{pending: true}
+		clientsMutex.Lock()
+		if logSubscriptions[taskID] == nil {
+			logSubscriptions[taskID] = make(map[*wsClient]*logSubscription)
+		}
+		logSubscriptions[taskID][ws] = subscription
+		clientsMutex.Unlock()
+	}
+
+	entries, err := tailTaskLogs(taskID, tail)
+	if err != nil {
+		unsubscribeTaskLogs(ws, taskID)
+		return fmt.Errorf("ошибка чтения журнала")
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if !writeTaskLogs(ws, taskID, entries, true) {
+		return nil
+	}
+	if subscription == nil || logSubscriptions[taskID][ws] != subscription {
+		return nil
+	}
+	// Строки, записанные во время чтения хвоста, кроме уже попавших в него
+	sent := make(map[int]bool, len(entries))
+	for _, entry := range entries {
+		sent[entry.LogID] = true
+	}
+	var missed []TaskLogEntry
+	for _, entry := range subscription.queue {
+		if !sent[entry.LogID] {
+			missed = append(missed, entry)
+		}
+	}
+	subscription.pending, subscription.queue = false, nil
+	if len(missed) > 0 {
+		writeTaskLogs(ws, taskID, missed, false)
+	}
+	return nil
+}
+
+// Последние tail строк журнала задачи в порядке записи
+func tailTaskLogs(taskID int, tail int) ([]TaskLogEntry, error) {
+	entries := []TaskLogEntry{}
+	if tail == 0 {
+		return entries, nil
+	}
+	rows, err := db.Query(`
+        SELECT log_id, log_time, log_type, COALESCE(message, '')
+        FROM (
+            SELECT * FROM task_log WHERE task_id = $1 ORDER BY log_id DESC LIMIT $2
+        ) last
+        ORDER BY log_id`, taskID, tail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := TaskLogEntry{TaskID: taskID}
+		var logTime sql.NullTime
+		if err := rows.Scan(&entry.LogID, &logTime, &entry.Level, &entry.Message); err != nil {
+			return nil, err
+		}
+		entry.Time = formatTime(logTime)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func unsubscribeTaskLogs(ws *wsClient, taskID int) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	removeLogSubscription(ws, taskID)
+}
+
+// Снятие всех подписок соединения при его закрытии
+func unsubscribeAllTaskLogs(ws *wsClient) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	for taskID := range logSubscriptions {
+		removeLogSubscription(ws, taskID)
+	}
+}
+
+// Вызывается под clientsMutex
+func removeLogSubscription(ws *wsClient, taskID int) {
+	delete(logSubscriptions[taskID], ws)
+	if len(logSubscriptions[taskID]) == 0 {
+		delete(logSubscriptions, taskID)
+	}
+}
+
+// Рассылка новых строк журнала подписчикам задачи. Строки только ставятся в очереди
+// соединений, поэтому запись журнала не ждёт медленных клиентов
+func publishTaskLogs(taskID int, entries []TaskLogEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	for ws, subscription := range logSubscriptions[taskID] {
+		if subscription.pending {
+			subscription.queue = append(subscription.queue, entries...)
+			continue
+		}
+		if !writeTaskLogs(ws, taskID, entries, false) {
+			removeLogSubscription(ws, taskID)
+		}
+	}
+}
+
+// Сообщение со строками журнала; вызывается под clientsMutex.
+// false - клиент отключён, его обработчик снимает подписки
+func writeTaskLogs(ws *wsClient, taskID int, entries []TaskLogEntry, tail bool) bool {
+	return ws.enqueue(map[string]interface{}{
+		"action":  "task_logs",
+		"task_id": taskID,
+		"tail":    tail,
+		"logs":    entries,
+	})
+}
+
+func writeClientJSON(ws *wsClient, msg interface{}) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	ws.enqueue(msg)
+}
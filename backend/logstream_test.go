@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Клиент, который не читает сообщения, не должен задерживать рассылку журнала:
+// его очередь переполняется, он отключается, а остальные получают строки
+func TestPublishTaskLogsSlowClient(t *testing.T) {
+	const taskID = 1
+	accepted := make(chan *wsClient, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- newWSClient(conn)
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	slowConn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowConn.Close()
+	slow := <-accepted
+	fastConn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fastConn.Close()
+	fast := <-accepted
+
+	clientsMutex.Lock()
+	logSubscriptions[taskID] = map[*wsClient]*logSubscription{slow: {}, fast: {}}
+	clientsMutex.Unlock()
+	defer func() {
+		clientsMutex.Lock()
+		delete(logSubscriptions, taskID)
+		clientsMutex.Unlock()
+	}()
+
+	received := make(chan int, 1)
+	go func() {
+		count := 0
+		for {
+			var msg map[string]interface{}
+			if err := fastConn.ReadJSON(&msg); err != nil {
+				received <- count
+				return
+			}
+			count++
+		}
+	}()
+
+	entries := []TaskLogEntry{{TaskID: taskID, Level: "Info", Message: strings.Repeat("x", 64*1024)}}
+	// Буферы сокета медленного клиента заполняются за несколько мегабайт, после этого
+	// переполняется его очередь. Пауза между пачками даёт быстрому клиенту успевать
+	const batches = 2 * wsSendBuffer
+	var slowest time.Duration
+	for i := 0; i < batches; i++ {
+		start := time.Now()
+		publishTaskLogs(taskID, entries)
+		if elapsed := time.Since(start); elapsed > slowest {
+			slowest = elapsed
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if slowest > 100*time.Millisecond {
+		t.Errorf("рассылка пачки заняла %s", slowest)
+	}
+
+	select {
+	case <-slow.closed:
+	case <-time.After(time.Second):
+		t.Fatal("медленный клиент не отключён")
+	}
+	clientsMutex.Lock()
+	_, stillSubscribed := logSubscriptions[taskID][slow]
+	clientsMutex.Unlock()
+	if stillSubscribed {
+		t.Error("подписка медленного клиента не снята")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	fast.closeWith(websocket.CloseNormalClosure, "")
+	if count := <-received; count != batches {
+		t.Errorf("быстрый клиент получил %d сообщений из %d", count, batches)
+	}
+}
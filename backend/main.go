@@ -14,7 +14,6 @@ import (
 	"time"
 "strings"
 	"github.com/gorilla/mux"
-	"github.com/go-yaml/yaml"
 	"github.com/gorilla/websocket"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/lib/pq"
@@ -23,32 +22,75 @@ import (
 // Структура для парсинга YAML
 type YamlPipeline struct {
     Pipeline struct {
-        Name        string `yaml:"name"`
-        Description string `yaml:"description"`
-        Tasks       []struct {
-            Name        string   `yaml:"name"`
-            Description string   `yaml:"description"`
-            Status      string   `yaml:"status"`
-            Progress    int      `yaml:"progress_percentage"`
-            DependsOn   []string `yaml:"depends_on"`
-            Assignee    string   `yaml:"assignee"`
-			Tags        []string `yaml:"tags"`
-        } `yaml:"tasks"`
+        Name        string            `yaml:"name"`
+        Description string            `yaml:"description,omitempty"`
+        MaxParallel int               `yaml:"max_parallel,omitempty"` // Сколько задач пайплайна выполняется одновременно, 0 - без ограничения
+        Timeout     string            `yaml:"timeout,omitempty"`      // Максимальная длительность выполнения пайплайна ("1h")
+        Variables   map[string]string `yaml:"variables,omitempty"`    // Значения для подстановки ${VAR}, переопределяются параметрами var.NAME
+        Tasks       []YamlTask        `yaml:"tasks,omitempty"`
     } `yaml:"pipeline"`
+    // Версии, в которые разрешились include без version; сохраняются вместе с версией
+    // определения, чтобы её повторный разбор подключал те же версии
+    IncludeVersions map[string]int `yaml:"-"`
+}
+
+// Описание задачи в YAML
+type YamlTask struct {
+    Name          string            `yaml:"name"`
+    Description   string            `yaml:"description,omitempty"`
+    Status        string            `yaml:"status,omitempty"`
+    Progress      int               `yaml:"progress_percentage,omitempty"`
+    DependsOn     []string          `yaml:"depends_on,omitempty"`
+    Assignee      string            `yaml:"assignee,omitempty"`
+    Tags          []string          `yaml:"tags,omitempty"`
+    Command       string            `yaml:"command,omitempty"`        // Команда оболочки, которую выполняет движок
+    Script        string            `yaml:"script,omitempty"`         // Многострочный скрипт, используется если command не задан
+    Retries       int               `yaml:"retries,omitempty"`        // Сколько раз повторить задачу после неудачи
+    RetryDelay    string            `yaml:"retry_delay,omitempty"`    // Пауза перед первым повтором ("30s", "1m"), дальше удваивается
+    RetryOn       []string          `yaml:"retry_on,omitempty"`       // Коды выхода или регулярные выражения по выводу, при которых нужен повтор
+    Timeout       string            `yaml:"timeout,omitempty"`        // Максимальная длительность выполнения задачи ("10m") вместе со всеми повторами и паузами между ними
+    Type          string            `yaml:"type,omitempty"`           // command (по умолчанию) или approval - ручное подтверждение
+    ApprovalLevel string            `yaml:"approval_level,omitempty"` // Минимальный permission_level для подтверждения, по умолчанию Admin
+    When          string            `yaml:"when,omitempty"`           // Условие запуска (on_failure, always, vars.ENV == 'prod'), по умолчанию on_success
+    RunsOn        []string          `yaml:"runs_on,omitempty"`        // Метки агента, который должен выполнить команду; пусто - выполняет сервер
+    MatrixGroup   string            `yaml:"matrix_group,omitempty"`   // Имя задачи matrix, из которой развёрнута задача (заполняется при развёртывании и при выгрузке; при загрузке имя задачи должно быть её развёрткой)
+    MatrixValues  map[string]string `yaml:"matrix_values,omitempty"`  // Значения осей matrix для этой задачи
+}
+
+// Разбор длительности из YAML: "30s", "5m" или число секунд
+func parseYamlDuration(value string) (time.Duration, error) {
+    if value == "" {
+        return 0, nil
+    }
+    if seconds, err := strconv.Atoi(value); err == nil {
+        return time.Duration(seconds) * time.Second, nil
+    }
+    return time.ParseDuration(value)
+}
+
+// Команда задачи для выполнения движком
+func (t YamlTask) shellCommand() string {
+    if t.Command != "" {
+        return t.Command
+    }
+    return t.Script
 }
 
 // структура task
 type Task struct {
-    TaskID      int          `json:"task_id"`
-    Name        string       `json:"name"`
-    Status      string       `json:"status"`
-    Description string       `json:"description"`
-    DependsOn   []int        `json:"depends_on"`
-    Order       int          `json:"order"`
-    StartTime   NullTimeJSON `json:"start_time,omitempty"`
-    EndTime     NullTimeJSON `json:"end_time,omitempty"`
-    Assignee    string       `json:"assignee,omitempty"`
-    Tags        []string     `json:"tags,omitempty"` // Добавьте это поле
+    TaskID       int               `json:"task_id"`
+    Name         string            `json:"name"`
+    Status       string            `json:"status"`
+    Description  string            `json:"description"`
+    DependsOn    []int             `json:"depends_on"`
+    Order        int               `json:"order"`
+    StartTime    NullTimeJSON      `json:"start_time,omitempty"`
+    EndTime      NullTimeJSON      `json:"end_time,omitempty"`
+    Assignee     string            `json:"assignee,omitempty"`
+    Tags         []string          `json:"tags,omitempty"` // Добавьте это поле
+    Command      string            `json:"command,omitempty"`
+    MatrixGroup  string            `json:"matrix_group,omitempty"` // задачи одной группы развёрнуты из одной задачи matrix
+    MatrixValues map[string]string `json:"matrix_values,omitempty"`
 }
 
 // Структура ответа для /api/pipeline/{pipeline_id}/tasks/stats
@@ -69,7 +111,18 @@ type AveragePipelineDuration struct {
         FromDate string `json:"from_date"`
         ToDate   string `json:"to_date"`
     } `json:"time_period"`
-    StatusFilter string `json:"status_filter"`
+    StatusFilter string               `json:"status_filter"`
+    DefinitionID *int                 `json:"definition_id,omitempty"`
+    Definitions  []DefinitionDuration `json:"definitions"` // Средняя длительность по запускам каждого определения
+}
+
+// Средняя длительность запусков одного определения пайплайна
+type DefinitionDuration struct {
+    DefinitionID           int    `json:"definition_id"`
+    Name                   string `json:"name"`
+    RunsAnalyzed           int    `json:"runs_analyzed"`
+    AverageDurationSeconds int64  `json:"average_duration_seconds"`
+    AverageDurationHuman   string `json:"average_duration_human_readable"`
 }
 
 
@@ -87,13 +140,17 @@ func (nt NullTimeJSON) MarshalJSON() ([]byte, error) {
 
 // структура pipeline
 type Pipeline struct {
-	PipelineID  int          `json:"pipeline_id"`
-	Name        string       `json:"name"`
-	Description string       `json:"description"`
-	Status      string       `json:"status"`
-	StartTime   NullTimeJSON `json:"start_time,omitempty"`
-	EndTime     NullTimeJSON `json:"end_time,omitempty"`
-	Tasks       []Task       `json:"tasks"`
+	PipelineID   int          `json:"pipeline_id"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	Status       string       `json:"status"`
+	StatusReason string       `json:"status_reason,omitempty"`
+	StartTime    NullTimeJSON `json:"start_time,omitempty"`
+	EndTime      NullTimeJSON `json:"end_time,omitempty"`
+	DefinitionID *int         `json:"definition_id,omitempty"` // определение, запуском которого является пайплайн
+	RunNumber    *int         `json:"run_number,omitempty"`
+	Tasks        []Task       `json:"tasks"`
+	Groups       []TaskGroup  `json:"groups,omitempty"` // группы задач matrix для сворачивания в графе
 }
 
 type User struct {
@@ -102,22 +159,28 @@ type User struct {
 }
 
 type TaskDetails struct {
-	TaskID       int    `json:"task_id"`
-	Name         string `json:"name"`
-	Description  string `json:"description"`
-	Status       string `json:"status"`
-	AssignedUser string `json:"assignedUser"`
-	PipelineName string `json:"pipelineName"`
-	StartTime    string `json:"start_time"`
-	EndTime      string `json:"end_time"`
-	Duration     string `json:"duration"`
-	ErrorCount   int    `json:"error_count"`
-	WarningCount int    `json:"warning_count"`
+	TaskID       int            `json:"task_id"`
+	Name         string         `json:"name"`
+	Description  string         `json:"description"`
+	Status       string         `json:"status"`
+	StatusReason string         `json:"status_reason,omitempty"`
+	AssignedUser string         `json:"assignedUser"`
+	PipelineName string         `json:"pipelineName"`
+	StartTime    string         `json:"start_time"`
+	EndTime      string         `json:"end_time"`
+	Duration     string         `json:"duration"`
+	ErrorCount   int            `json:"error_count"`
+	WarningCount int            `json:"warning_count"`
+	ExitCode     *int           `json:"exit_code"`
+	Attempts     []TaskAttempt  `json:"attempts"`
+	TaskType     string         `json:"task_type"`
+	Approvals    []TaskApproval `json:"approvals,omitempty"`
+	Condition    string         `json:"condition,omitempty"` // условие when
 }
 
 var (
 	db        *sql.DB
-	clients   = make(map[*websocket.Conn]bool)
+	clients   = make(map[*wsClient]bool)
 	broadcast = make(chan interface{})
 	upgrader  = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
@@ -125,11 +188,6 @@ var (
 	clientsMutex = sync.Mutex{}
 )
 
-type TaskUpdate struct {
-	TaskID int    `json:"task_id"`
-	Status string `json:"status"`
-}
-
 func initDB() (*sql.DB, error) {
 	// Считывает параметры подключения к базе данных из переменных окружения.
 	dbHost := os.Getenv("DB_HOST")
@@ -163,7 +221,7 @@ func uploadPipelineYAMLHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    file, _, err := r.FormFile("yamlFile")
+    file, header, err := r.FormFile("yamlFile")
     if err != nil {
         http.Error(w, "Файл не найден", http.StatusBadRequest)
         return
@@ -176,120 +234,104 @@ func uploadPipelineYAMLHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var yamlData YamlPipeline
-    err = yaml.Unmarshal(content, &yamlData)
+    // .gitlab-ci.yml и workflow GitHub Actions приводятся к собственному формату,
+    // формат определяется по содержимому или задаётся параметром format.
+    // С runners=agents метки раннера становятся runs_on и задачи выполняют агенты
+    agents := r.URL.Query().Get("runners") == "agents"
+    content, warnings, err := convertCIYaml(content, r.URL.Query().Get("format"), r.FormValue("name"), header.Filename, agents)
     if err != nil {
-        http.Error(w, "Ошибка парсинга YAML", http.StatusBadRequest)
+        if validationErr, ok := err.(*YamlValidationError); ok {
+            writeYamlValidationError(w, validationErr)
+            return
+        }
+        http.Error(w, "Ошибка конвертации файла", http.StatusInternalServerError)
         return
     }
 
-    var pipelineID int
-    err = db.QueryRow(
-        `INSERT INTO pipeline (name, description, status) VALUES ($1, $2, 'Pending') RETURNING pipeline_id`,
-        yamlData.Pipeline.Name, yamlData.Pipeline.Description,
-    ).Scan(&pipelineID)
-
+    knownUsers, err := loadKnownUsers(db)
     if err != nil {
-        http.Error(w, "Ошибка создания пайплайна", http.StatusInternalServerError)
+        http.Error(w, "Ошибка при получении списка пользователей", http.StatusInternalServerError)
         return
     }
 
-    taskNameToID := make(map[string]int)
-
-    currentTime := time.Now()
-
-    for i, t := range yamlData.Pipeline.Tasks {
-        var startTime, endTime interface{}
-        switch t.Status {
-        case "Running":
-            startTime = currentTime
-            endTime = nil
-        case "Completed", "Failed":
-            startTime = currentTime
-            endTime = currentTime
-        case "Pending":
-            startTime = nil
-            endTime = nil
-        default:
-            startTime = nil
-            endTime = nil
+    // Строгая проверка схемы, значений и графа зависимостей до записи в базу данных
+    parsed, err := parsePipelineYAML(content, yamlParseOptions{
+        KnownUsers:  knownUsers,
+        Overrides:   variableOverrides(r),
+        Definitions: db,
+    })
+    if err != nil {
+        writeYamlValidationError(w, err.(*YamlValidationError))
+        return
+    }
+    yamlData := *parsed
+
+    // Весь импорт (определение, пайплайн, задачи, task_metrics, task_dependency) идёт в одной
+    // транзакции: при любой ошибке в базе не остаётся наполовину созданного пайплайна.
+    // С dry_run=true транзакция откатывается, а в ответе возвращается запланированный граф
+    dryRun := r.URL.Query().Get("dry_run") == "true"
+
+    // YAML сохраняется как версия определения, а пайплайн создаётся как очередной запуск этого определения
+    var pipelineID, definitionID, version, previousVersion int
+    var plan map[string]interface{}
+    err = withTx(func(tx *sql.Tx) error {
+        err := tx.QueryRow(`
+            SELECT COALESCE(MAX(v.version), 0)
+            FROM pipeline_definition d
+            LEFT JOIN pipeline_definition_version v ON v.definition_id = d.definition_id
+            WHERE d.name = $1`, yamlData.Pipeline.Name).Scan(&previousVersion)
+        if err != nil && err != sql.ErrNoRows {
+            return err
         }
-
-        var assignedTo interface{}
-        if t.Assignee != "" {
-            var userID int
-            err = db.QueryRow(`SELECT user_id FROM "user" WHERE username = $1`, t.Assignee).Scan(&userID)
-            if err != nil {
-                assignedTo = nil
-            } else {
-                assignedTo = userID
-            }
-        } else {
-            assignedTo = nil
+        definitionID, version, err = saveDefinitionVersion(tx, &yamlData, string(content))
+        if err != nil {
+            return err
         }
-
-        // Вставляем задачу с тегами
-        // tags в Go []string соответствуют TEXT[] в PostgreSQL
-        var taskID int
-        err = db.QueryRow(`
-            INSERT INTO task (pipeline_id, name, description, status, "order", progress_percentage, assigned_to, start_time, end_time, tags)
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING task_id
-        `,
-            pipelineID, t.Name, t.Description, t.Status, i+1, t.Progress, assignedTo, startTime, endTime, pqStringArray(t.Tags),
-        ).Scan(&taskID)
-
+        pipelineID, err = createPipelineRun(tx, &yamlData, definitionID, version, false)
         if err != nil {
-            http.Error(w, "Ошибка создания задачи", http.StatusInternalServerError)
-            return
+            return err
         }
-        taskNameToID[t.Name] = taskID
-
-        // Если статус Failed, прибавляем +1 к error_count
-        errorCount := 0
-        if t.Status == "Failed" {
-            errorCount = 1
+        if !dryRun {
+            return nil
         }
-
-        _, err = db.Exec(`
-            INSERT INTO task_metrics (task_id, error_count, warning_count)
-            VALUES ($1, $2, 0)
-        `, taskID, errorCount)
+        plan, err = planPipelineRun(tx, pipelineID)
         if err != nil {
-            http.Error(w, "Ошибка при инициализации метрик задачи", http.StatusInternalServerError)
-            return
+            return err
         }
-    }
-
-    // Зависимости
-    for _, t := range yamlData.Pipeline.Tasks {
-        if len(t.DependsOn) > 0 {
-            currentTaskID, ok := taskNameToID[t.Name]
-            if !ok {
-                continue
-            }
-
-            for _, depName := range t.DependsOn {
-                depTaskID, ok := taskNameToID[depName]
-                if !ok {
-                    continue
-                }
-
-                _, err = db.Exec(`INSERT INTO task_dependency (task_id, depends_on_task_id) VALUES ($1, $2)`, currentTaskID, depTaskID)
-                if err != nil {
-                    http.Error(w, "Ошибка создания зависимости задач", http.StatusInternalServerError)
-                    return
-                }
-            }
+        return errDryRun
+    })
+    if dryRun && err == errDryRun {
+        plan["dry_run"] = true
+        plan["version"] = version
+        plan["new_definition"] = previousVersion == 0
+        if previousVersion > 0 {
+            plan["definition_id"] = definitionID
+        }
+        if len(warnings) > 0 {
+            plan["warnings"] = warnings
         }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(plan)
+        return
+    }
+    if err != nil {
+        writeDependencyError(w, err, "Ошибка создания пайплайна")
+        return
     }
 
     sendPipelineUpdate(pipelineID)
 
+    response := map[string]interface{}{
+        "message":       "Pipeline and tasks successfully created from YAML",
+        "pipeline_id":   pipelineID,
+        "definition_id": definitionID,
+        "version":       version,
+    }
+    if len(warnings) > 0 {
+        response["warnings"] = warnings
+    }
     w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "message":     "Pipeline and tasks successfully created from YAML",
-        "pipeline_id": pipelineID,
-    })
+    json.NewEncoder(w).Encode(response)
 }
 
 func pqStringArray(arr []string) interface{} {
@@ -438,6 +480,10 @@ func getPipelineTaskStatsHandler(w http.ResponseWriter, r *http.Request) {
         "running":   0,
         "completed": 0,
         "failed":    0,
+        "timed_out": 0,
+        "skipped":   0,
+        "cancelled": 0,
+        "waiting_for_approval": 0,
     }
 
     totalTasks := 0
@@ -459,6 +505,14 @@ func getPipelineTaskStatsHandler(w http.ResponseWriter, r *http.Request) {
             taskStatuses["completed"] = count
         case "Failed":
             taskStatuses["failed"] = count
+        case "TimedOut":
+            taskStatuses["timed_out"] = count
+        case "Skipped":
+            taskStatuses["skipped"] = count
+        case "Cancelled":
+            taskStatuses["cancelled"] = count
+        case "WaitingForApproval":
+            taskStatuses["waiting_for_approval"] = count
         }
     }
 
@@ -507,6 +561,17 @@ func getAveragePipelineDurationHandler(w http.ResponseWriter, r *http.Request) {
         }
     }
 
+    // Если передан definition_id, среднее считается по запускам одного определения
+    var definitionID interface{}
+    if definitionIDStr := r.URL.Query().Get("definition_id"); definitionIDStr != "" {
+        id, err := strconv.Atoi(definitionIDStr)
+        if err != nil {
+            http.Error(w, "Invalid definition_id", http.StatusBadRequest)
+            return
+        }
+        definitionID = id
+    }
+
     log.Println("Calculating average pipeline duration with params:")
     log.Println("statusFilter =", statusFilter)
     log.Println("fromDate =", fromDate)
@@ -521,7 +586,8 @@ func getAveragePipelineDurationHandler(w http.ResponseWriter, r *http.Request) {
           AND end_time IS NOT NULL
           AND start_time >= $2
           AND end_time <= $3
-    `, statusFilter, fromDate, toDate)
+          AND ($4::int IS NULL OR definition_id = $4)
+    `, statusFilter, fromDate, toDate, definitionID)
 
     var totalPipelines int
     var avgSeconds sql.NullFloat64
@@ -553,6 +619,45 @@ func getAveragePipelineDurationHandler(w http.ResponseWriter, r *http.Request) {
     }
     result.TimePeriod.FromDate = fromDate.Format("2006-01-02")
     result.TimePeriod.ToDate = toDate.Format("2006-01-02")
+    if id, ok := definitionID.(int); ok {
+        result.DefinitionID = &id
+    }
+
+    // Те же показатели отдельно по каждому определению: запуски одного определения агрегируются вместе
+    rows, err := db.Query(`
+        SELECT d.definition_id, d.name, COUNT(*),
+               AVG(EXTRACT(EPOCH FROM (p.end_time - p.start_time)))
+        FROM pipeline p
+        JOIN pipeline_definition d ON p.definition_id = d.definition_id
+        WHERE LOWER(p.status) = LOWER($1)
+          AND p.start_time IS NOT NULL
+          AND p.end_time IS NOT NULL
+          AND p.start_time >= $2
+          AND p.end_time <= $3
+          AND ($4::int IS NULL OR p.definition_id = $4)
+        GROUP BY d.definition_id, d.name
+        ORDER BY d.definition_id
+    `, statusFilter, fromDate, toDate, definitionID)
+    if err != nil {
+        log.Println("Database error:", err)
+        http.Error(w, "Database error", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    result.Definitions = []DefinitionDuration{}
+    for rows.Next() {
+        var item DefinitionDuration
+        var avg sql.NullFloat64
+        if err := rows.Scan(&item.DefinitionID, &item.Name, &item.RunsAnalyzed, &avg); err != nil {
+            log.Println("Database error:", err)
+            http.Error(w, "Database error", http.StatusInternalServerError)
+            return
+        }
+        item.AverageDurationSeconds = int64(avg.Float64)
+        item.AverageDurationHuman = formatDuration(item.AverageDurationSeconds)
+        result.Definitions = append(result.Definitions, item)
+    }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(result)
@@ -621,7 +726,9 @@ func createPipelineHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(pipeline)
 }
 
-// Создание задачи с назначением значения order и зависимости
+// Создание задачи с назначением значения order и зависимостей.
+// Если в теле передан depends_on, задача зависит только от перечисленных задач,
+// иначе она по-прежнему ставится в конец цепочки после последней задачи.
 func createTaskHandler(w http.ResponseWriter, r *http.Request) {
 	var task Task
 	err := json.NewDecoder(r.Body).Decode(&task)
@@ -639,9 +746,18 @@ func createTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Задача, её метрики и зависимости создаются в одной транзакции,
+	// чтобы некорректный depends_on не оставлял задачу без связей
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка создания задачи", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Получаем максимальное значение order для задач в текущем pipeline
 	var maxOrder int
-	err = db.QueryRow(`SELECT COALESCE(MAX("order"), 0) FROM task WHERE pipeline_id = $1`, pipelineID).Scan(&maxOrder)
+	err = tx.QueryRow(`SELECT COALESCE(MAX("order"), 0) FROM task WHERE pipeline_id = $1`, pipelineID).Scan(&maxOrder)
 	if err != nil {
 
 		http.Error(w, "Ошибка при назначении порядка задачи", http.StatusInternalServerError)
@@ -652,11 +768,11 @@ func createTaskHandler(w http.ResponseWriter, r *http.Request) {
 	newOrder := maxOrder + 1
 
 	// Вставка задачи в таблицу `task` с новым значением order
-	err = db.QueryRow(`
-    INSERT INTO task (pipeline_id, name, description, status, "order") 
-    VALUES ($1, $2, $3, 'Pending', $4) 
+	err = tx.QueryRow(`
+    INSERT INTO task (pipeline_id, name, description, status, "order", command) 
+    VALUES ($1, $2, $3, 'Pending', $4, $5) 
     RETURNING task_id
-`, pipelineID, task.Name, task.Description, newOrder).Scan(&task.TaskID)
+`, pipelineID, task.Name, task.Description, newOrder, nilIfEmpty(task.Command)).Scan(&task.TaskID)
 	if err != nil {
 
 		http.Error(w, "Ошибка создания задачи", http.StatusInternalServerError)
@@ -664,36 +780,41 @@ func createTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Инициализация метрик для новой задачи в таблице task_metrics
-	_, err = db.Exec(`INSERT INTO task_metrics (task_id, error_count, warning_count) VALUES ($1, 0, 0)`, task.TaskID)
+	_, err = tx.Exec(`INSERT INTO task_metrics (task_id, error_count, warning_count) VALUES ($1, 0, 0)`, task.TaskID)
 	if err != nil {
 
 		http.Error(w, "Ошибка инициализации метрик для задачи", http.StatusInternalServerError)
 		return
 	}
 
-	// Устанавливаем зависимость на последнюю задачу, если она существует
-	if maxOrder > 0 {
-		var lastTaskID int
-		err = db.QueryRow(`SELECT task_id FROM task WHERE pipeline_id = $1 AND "order" = $2`, pipelineID, maxOrder).Scan(&lastTaskID)
-		if err != nil {
-
-			http.Error(w, "Ошибка при назначении зависимости", http.StatusInternalServerError)
-			return
-		}
-
-		// Добавляем зависимость в таблицу task_dependency
-		_, err = db.Exec(`INSERT INTO task_dependency (task_id, depends_on_task_id) VALUES ($1, $2)`, task.TaskID, lastTaskID)
-		if err != nil {
+	if task.DependsOn == nil {
+		// Без depends_on устанавливаем зависимость на последнюю задачу, если она существует
+		task.DependsOn = []int{}
+		if maxOrder > 0 {
+			var lastTaskID int
+			err = tx.QueryRow(`SELECT task_id FROM task WHERE pipeline_id = $1 AND "order" = $2`, pipelineID, maxOrder).Scan(&lastTaskID)
+			if err != nil {
 
-			http.Error(w, "Ошибка при создании зависимости задачи", http.StatusInternalServerError)
-			return
+				http.Error(w, "Ошибка при назначении зависимости", http.StatusInternalServerError)
+				return
+			}
+			task.DependsOn = []int{lastTaskID}
 		}
+	}
 
-		task.DependsOn = []int{lastTaskID}
-	} else {
-		// Если это первая задача, зависимость отсутствует
-		task.DependsOn = []int{}
+	// Добавляем зависимости в таблицу task_dependency через общую проверку графа
+	var edges []dependencyEdge
+	for _, depID := range task.DependsOn {
+		edges = append(edges, dependencyEdge{TaskID: task.TaskID, DependsOnID: depID})
+	}
+	if err := applyDependencyChanges(tx, pipelineID, edges, nil); err != nil {
+		writeDependencyError(w, err, "Ошибка при создании зависимости задачи")
+		return
+	}
 
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка создания задачи", http.StatusInternalServerError)
+		return
 	}
 
 	task.Status = "Pending"
@@ -796,40 +917,30 @@ func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 		nextTaskIDs = append(nextTaskIDs, nextTaskID)
 	}
 
-	// Обновление зависимостей для следующих задач
+	// Следующие задачи наследуют зависимости удаляемой задачи.
+	// Новые рёбра проходят общую проверку графа, удаление выполняется в той же транзакции
+	var add, remove []dependencyEdge
+	for _, originalDepend := range originalDependsOn {
+		remove = append(remove, dependencyEdge{TaskID: taskID, DependsOnID: originalDepend})
+	}
 	for _, nextTaskID := range nextTaskIDs {
-		_, err = db.Exec(`DELETE FROM task_dependency WHERE task_id = $1 AND depends_on_task_id = $2`, nextTaskID, taskID)
-		if err != nil {
-
-			http.Error(w, "Ошибка при удалении зависимости задачи", http.StatusInternalServerError)
-			return
-		}
-
-		// Назначение оригинальных зависимостей следующей задаче
+		remove = append(remove, dependencyEdge{TaskID: nextTaskID, DependsOnID: taskID})
 		for _, originalDepend := range originalDependsOn {
-			_, err = db.Exec(`INSERT INTO task_dependency (task_id, depends_on_task_id) VALUES ($1, $2)`, nextTaskID, originalDepend)
-			if err != nil {
-
-				http.Error(w, "Ошибка при добавлении зависимости задачи", http.StatusInternalServerError)
-				return
-			}
-
+			add = append(add, dependencyEdge{TaskID: nextTaskID, DependsOnID: originalDepend})
 		}
 	}
 
-	// Удаление зависимостей задачи
-	_, err = db.Exec(`DELETE FROM task_dependency WHERE task_id = $1 OR depends_on_task_id = $1`, taskID)
-	if err != nil {
-
-		http.Error(w, "Ошибка при удалении зависимостей задачи", http.StatusInternalServerError)
-		return
-	}
-
-	// Удаление задачи
-	_, err = db.Exec(`DELETE FROM task WHERE task_id = $1`, taskID)
+	err = withTx(func(tx *sql.Tx) error {
+		if err := applyDependencyChanges(tx, pipelineID, add, remove); err != nil {
+			return err
+		}
+		// Удаление задачи
+		_, err := tx.Exec(`DELETE FROM task WHERE task_id = $1`, taskID)
+		return err
+	})
 	if err != nil {
 
-		http.Error(w, "Ошибка при удалении задачи", http.StatusInternalServerError)
+		writeDependencyError(w, err, "Ошибка при удалении задачи")
 		return
 	}
 
@@ -850,22 +961,27 @@ func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 // Отправляем обновленный массив задач всего пайплайна
 func sendPipelineUpdate(pipelineID int) {
 	var pipeline Pipeline
+	var definitionID, runNumber sql.NullInt32
 
 	// получаем информацию по пайпланйам
 	err := db.QueryRow(`
-        SELECT p.pipeline_id, p.name, p.description, p.status, p.start_time, p.end_time
+        SELECT p.pipeline_id, p.name, p.description, p.status, COALESCE(p.status_reason, ''), p.start_time, p.end_time,
+               p.definition_id, p.run_number
         FROM pipeline p WHERE p.pipeline_id = $1`, pipelineID).Scan(
-		&pipeline.PipelineID, &pipeline.Name, &pipeline.Description, &pipeline.Status, &pipeline.StartTime, &pipeline.EndTime)
+		&pipeline.PipelineID, &pipeline.Name, &pipeline.Description, &pipeline.Status, &pipeline.StatusReason, &pipeline.StartTime, &pipeline.EndTime,
+		&definitionID, &runNumber)
 
 	if err != nil {
 
 		return
 	}
+	pipeline.DefinitionID = nullIntPtr(definitionID)
+	pipeline.RunNumber = nullIntPtr(runNumber)
 
 	//Извлечение задач, их зависимостей и информации о назначенных пользователях
 	rows, err := db.Query(`
         SELECT t.task_id, t.name, t.status, t.description, t.start_time, t.end_time, t."order", td.depends_on_task_id,
-       u.user_id, r.role_name AS assignee, t.tags
+       u.user_id, r.role_name AS assignee, t.tags, COALESCE(t.matrix_group, ''), t.matrix_values
 FROM task t
 LEFT JOIN task_dependency td ON t.task_id = td.task_id
 LEFT JOIN "user" u ON t.assigned_to = u.user_id
@@ -885,15 +1001,20 @@ WHERE t.pipeline_id = $1 ORDER BY t."order" ASC`, pipelineID)
 		var userID sql.NullInt64    //пользователя
 		var assignee sql.NullString //исполнителя
 		var tags pq.StringArray // Используем pq.StringArray для сканирования TEXT[]
+		var matrixValues []byte
 
 		// Чтение данных задачи и её зависимостей из строки результата запроса
-		err := rows.Scan(&task.TaskID, &task.Name, &task.Status, &task.Description, &task.StartTime, &task.EndTime, &task.Order, &depID, &userID, &assignee, &tags)
+		err := rows.Scan(&task.TaskID, &task.Name, &task.Status, &task.Description, &task.StartTime, &task.EndTime, &task.Order, &depID, &userID, &assignee, &tags,
+			&task.MatrixGroup, &matrixValues)
 		if err != nil {
 
 			return
 		}
 
 		task.Tags = []string(tags) // Конвертируем pq.StringArray в []string
+		if matrixValues != nil {
+			json.Unmarshal(matrixValues, &task.MatrixValues)
+		}
 
 		// Если для задачи указаны зависимости, добавляем их в карту `taskDepends`
 		if depID.Valid {
@@ -919,6 +1040,7 @@ WHERE t.pipeline_id = $1 ORDER BY t."order" ASC`, pipelineID)
 
 		}
 	}
+	pipeline.Groups = groupMatrixTasks(pipeline.Tasks)
 
 	broadcast <- map[string]interface{}{
 		"action":   "update_pipeline",
@@ -927,7 +1049,7 @@ WHERE t.pipeline_id = $1 ORDER BY t."order" ASC`, pipelineID)
 
 }
 
-// Обработчик для перемещения задач вверх или вниз с обновлением depends_on
+// Обработчик для перемещения задач вверх или вниз без изменения depends_on
 func moveTaskHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		PipelineID int    `json:"pipelineId"`
@@ -994,63 +1116,12 @@ func moveTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Обновляем зависимости
-	updateDependencies(request.PipelineID)
-
-	// Отправляем обновленный статус пайплайна через WebSocket
+	// Отправляем обновленный статус пайплайна через WebSocket.
+	// Порядок влияет только на отображение, зависимости task_dependency не меняются
 	sendPipelineUpdate(request.PipelineID)
 
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "Task order updated and dependencies recalculated")
-}
-
-// Функция для пересчёта зависимостей в соответствии с текущим порядком задач в pipeline
-func updateDependencies(pipelineID int) {
-	// Получаем все задачи в текущем порядке
-	rows, err := db.Query(`SELECT task_id, "order" FROM task WHERE pipeline_id = $1 ORDER BY "order" ASC`, pipelineID)
-	if err != nil {
-
-		return
-	}
-	defer rows.Close()
-
-	var tasks []struct {
-		TaskID int
-		Order  int
-	}
-
-	for rows.Next() {
-		var task struct {
-			TaskID int
-			Order  int
-		}
-		if err := rows.Scan(&task.TaskID, &task.Order); err != nil {
-
-			return
-		}
-		tasks = append(tasks, task)
-	}
-
-	// Обновляем зависимости
-	for i, task := range tasks {
-		// Очистка текущих зависимостей
-		_, err := db.Exec(`DELETE FROM task_dependency WHERE task_id = $1`, task.TaskID)
-		if err != nil {
-
-			return
-		}
-
-		// Если это не первая задача, назначаем зависимость от предыдущей
-		if i > 0 {
-			prevTaskID := tasks[i-1].TaskID
-			_, err := db.Exec(`INSERT INTO task_dependency (task_id, depends_on_task_id) VALUES ($1, $2)`, task.TaskID, prevTaskID)
-			if err != nil {
-
-				return
-			}
-
-		}
-	}
+	fmt.Fprintln(w, "Task order updated")
 }
 
 func getTasksByPipeline(pipelineID int) ([]Task, error) {
@@ -1079,12 +1150,13 @@ func getTasksByPipeline(pipelineID int) ([]Task, error) {
 
 // Обработчик WebSocket для подключения клиентов
 func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 
 		return
 	}
-	defer ws.Close()
+	ws := newWSClient(conn)
+	defer ws.close()
 
 	// Защищаем доступ к clients
 	clientsMutex.Lock()
@@ -1092,15 +1164,17 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	clientsMutex.Unlock()
 
 	for {
-		var msg TaskUpdate
-		err := ws.ReadJSON(&msg)
+		var msg wsClientMessage
+		err := conn.ReadJSON(&msg)
 		if err != nil {
-			// Удаление клиента из мапы при ошибке
+			// Удаление клиента из мапы и его подписок на журналы при ошибке
 			clientsMutex.Lock()
 			delete(clients, ws)
 			clientsMutex.Unlock()
+			unsubscribeAllTaskLogs(ws)
 			break
 		}
+		handleClientMessage(ws, msg)
 	}
 }
 
@@ -1115,15 +1189,15 @@ func handleMessages() {
 
 				continue
 			}
+			// То же событие уходит подписчикам исходящих webhook
+			queueWebhookEvent(data)
 		}
 
-		// Рассылаем сообщение всем клиентам
+		// Рассылаем сообщение всем клиентам через их очереди отправки
 		clientsMutex.Lock()
 		for client := range clients {
-			err := client.WriteJSON(msg)
-			if err != nil {
+			if !client.enqueue(msg) {
 
-				client.Close()
 				delete(clients, client)
 			}
 		}
@@ -1197,6 +1271,7 @@ func sendUpdatedPipelineToClients() {
 				pipeline.Tasks[i].DependsOn = deps
 			}
 		}
+		pipeline.Groups = groupMatrixTasks(pipeline.Tasks)
 	}
 
 	var response []Pipeline
@@ -1211,9 +1286,9 @@ func getPipelinesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// получаем данные о пайплайнах, задачах, зависимостях и исполнителях
 	rows, err := db.Query(`
-       SELECT p.pipeline_id, p.name, p.description, p.status, p.start_time, p.end_time, 
+       SELECT p.pipeline_id, p.name, p.description, p.status, p.start_time, p.end_time, p.definition_id, p.run_number,
        t.task_id, t.name, t.status, t.description, t.start_time, t.end_time, t."order",
-       u.user_id, r.role_name AS assignee_name, td.depends_on_task_id, t.tags
+       u.user_id, r.role_name AS assignee_name, td.depends_on_task_id, t.tags, t.matrix_group, t.matrix_values
 FROM pipeline p
 LEFT JOIN task t ON p.pipeline_id = t.pipeline_id
 LEFT JOIN task_dependency td ON t.task_id = td.task_id
@@ -1238,12 +1313,15 @@ ORDER BY p.pipeline_id ASC, t."order" ASC
 		var taskOrder sql.NullInt64
 		var pipelineName, pipelineDescription, pipelineStatus, taskName, taskStatus, taskDescription, assigneeRole sql.NullString
 		var pipelineStartTime, pipelineEndTime, taskStartTime, taskEndTime sql.NullTime
+		var definitionID, runNumber sql.NullInt32
 		var tags pq.StringArray
+		var matrixGroup sql.NullString
+		var matrixValues []byte
 
 		// Чтение строки результата
-		err := rows.Scan(&pipelineID, &pipelineName, &pipelineDescription, &pipelineStatus, &pipelineStartTime, &pipelineEndTime,
+		err := rows.Scan(&pipelineID, &pipelineName, &pipelineDescription, &pipelineStatus, &pipelineStartTime, &pipelineEndTime, &definitionID, &runNumber,
 			&taskID, &taskName, &taskStatus, &taskDescription, &taskStartTime, &taskEndTime, &taskOrder,
-			&assignedTo, &assigneeRole, &depID, &tags)
+			&assignedTo, &assigneeRole, &depID, &tags, &matrixGroup, &matrixValues)
 		if err != nil {
 
 			http.Error(w, `{"error": "Ошибка обработки данных"}`, http.StatusInternalServerError)
@@ -1256,13 +1334,15 @@ ORDER BY p.pipeline_id ASC, t."order" ASC
 
 		if pipelines[int(pipelineID.Int64)] == nil {
 			pipelines[int(pipelineID.Int64)] = &Pipeline{
-				PipelineID:  int(pipelineID.Int64),
-				Name:        pipelineName.String,
-				Description: pipelineDescription.String,
-				Status:      pipelineStatus.String,
-				StartTime:   NullTimeJSON{pipelineStartTime},
-				EndTime:     NullTimeJSON{pipelineEndTime},
-				Tasks:       []Task{},
+				PipelineID:   int(pipelineID.Int64),
+				Name:         pipelineName.String,
+				Description:  pipelineDescription.String,
+				Status:       pipelineStatus.String,
+				StartTime:    NullTimeJSON{pipelineStartTime},
+				EndTime:      NullTimeJSON{pipelineEndTime},
+				DefinitionID: nullIntPtr(definitionID),
+				RunNumber:    nullIntPtr(runNumber),
+				Tasks:        []Task{},
 			}
 		}
 
@@ -1279,9 +1359,13 @@ ORDER BY p.pipeline_id ASC, t."order" ASC
 				StartTime:   NullTimeJSON{taskStartTime},
 				EndTime:     NullTimeJSON{taskEndTime},
 				Tags:        []string(tags), // Добавляем теги
+				MatrixGroup: matrixGroup.String,
 			}
 
 			task.Tags = []string(tags)
+			if matrixValues != nil {
+				json.Unmarshal(matrixValues, &task.MatrixValues)
+			}
 
 			pipelines[int(pipelineID.Int64)].Tasks = append(pipelines[int(pipelineID.Int64)].Tasks, task)
 
@@ -1298,6 +1382,7 @@ ORDER BY p.pipeline_id ASC, t."order" ASC
 				pipeline.Tasks[i].DependsOn = deps
 			}
 		}
+		pipeline.Groups = groupMatrixTasks(pipeline.Tasks)
 	}
 
 	// Формируем окончательный ответ
@@ -1431,21 +1516,24 @@ func updateTaskStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Логика для учета ошибок и предупреждений
-	if newStatus == "Failed" && currentStatus != "Failed" {
-
-		// Если статуc меняет на failed +1 к ошибкам
-		_, err = db.Exec(`
-        INSERT INTO task_metrics (task_id, error_count, warning_count)
-        VALUES ($1, 1, 0)
-        ON CONFLICT (task_id) DO UPDATE SET error_count = task_metrics.error_count + 1
-    `, taskID)
-		if err != nil {
+	// Логика для учета попыток, ошибок и предупреждений
+	if newStatus == "Running" && currentStatus != "Running" {
+		// Переход в Running открывает новую попытку выполнения
+		if _, _, err := startTaskAttempt(db, taskID); err != nil {
+			log.Printf("Ошибка при создании попытки задачи %d: %v", taskID, err)
+		}
+	} else if (newStatus == "Failed" || newStatus == "Completed") && currentStatus != newStatus {
 
+		// Завершение закрывает текущую попытку, при failed +1 к ошибкам
+		if err := finishOpenTaskAttempt(db, taskID, newStatus, ""); err != nil {
+			log.Printf("Ошибка при завершении попытки задачи %d: %v", taskID, err)
 		}
 		// Если статус меняется с запущен на ожидание + 1 к предупреждениям
 	} else if newStatus == "Pending" && currentStatus == "Running" {
 
+		if err := finishOpenTaskAttempt(db, taskID, "Failed", "задача возвращена в Pending"); err != nil {
+			log.Printf("Ошибка при завершении попытки задачи %d: %v", taskID, err)
+		}
 		_, err = db.Exec(`
         INSERT INTO task_metrics (task_id, error_count, warning_count)
         VALUES ($1, 0, 1)
@@ -1559,28 +1647,25 @@ func updatePipelineStatusHandler(w http.ResponseWriter, r *http.Request) {
 func checkTasksProgressHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Checking tasks progress...")
 
+	// Статус по прогрессу меняется только у ручных задач: без команды, не approval
+	// и вне пайплайнов, которые выполняет движок, - остальными управляет движок
+	manualTask := `COALESCE(command, '') = '' AND task_type = 'command' AND NOT (COALESCE(pipeline_id, 0) = ANY($1::int[]))`
+	enginePipelines := pq.Array(enginePipelineIDs())
+
 	// Обновление задач со статусом 'Pending' -> 'Running'
 	_, err := db.Exec(`
         UPDATE task
         SET status = 'Running', start_time = NOW()
-        WHERE status = 'Pending' AND progress_percentage > 0
-    `)
+        WHERE status = 'Pending' AND progress_percentage > 0 AND `+manualTask, enginePipelines)
 	if err != nil {
 		log.Printf("Error updating tasks from Pending to Running: %v", err)
 	}
 
-	// Обновление задач со статусом 'Running' -> 'Failed' // Добавить +1 к ошибкам
-	_, err = db.Exec(`
-        UPDATE task
-        SET status = 'Failed', end_time = NOW()
-        WHERE status = 'Running' AND progress_percentage < 100 AND last_updated < NOW() - INTERVAL '10 minutes'
-    `)
-	if err != nil {
-		log.Printf("Error updating tasks from Running to Failed: %v", err)
-	}
+	// Таймауты задач и пайплайнов (то же делает фоновый супервизор)
+	enforceTimeouts()
 
 	// Получение всех задач со статусом 'Running'
-	rows, err := db.Query(`SELECT task_id, progress_percentage FROM task WHERE status = 'Running'`)
+	rows, err := db.Query(`SELECT task_id, progress_percentage FROM task WHERE status = 'Running' AND `+manualTask, enginePipelines)
 	if err != nil {
 		http.Error(w, "Error retrieving tasks", http.StatusInternalServerError)
 		log.Printf("Error retrieving tasks: %v", err)
@@ -1601,14 +1686,18 @@ func checkTasksProgressHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Если прогресс достиг 100%, меняем статус на Completed
 		if progress >= 100 {
-			_, err = db.Exec(`
+			result, err := db.Exec(`
                 UPDATE task
                 SET status = 'Completed', end_time = NOW()
-                WHERE task_id = $1`, taskID)
+                WHERE task_id = $2 AND status = 'Running' AND `+manualTask, enginePipelines, taskID)
 			if err != nil {
 				log.Printf("Error updating task %d status to Completed: %v", taskID, err)
 				continue
 			}
+			// Задачу успел забрать движок или изменил другой запрос
+			if n, _ := result.RowsAffected(); n == 0 {
+				continue
+			}
 
 			log.Printf("Task %d marked as Completed due to 100%% progress.", taskID)
 			sendTaskUpdateWithProgress(taskID, 100) // Передаем прогресс 100%
@@ -1681,14 +1770,25 @@ func formatTime(t sql.NullTime) string {
 	return t.Time.Format("2006-01-02 15:04:05")
 }
 
-// обновление счётчика ошибок и предупреждений, для конкретной задачи
-func updateErrorAndWarningCounts(taskID int, isError bool) error {
-	query := `UPDATE task_metrics
-              SET error_count = CASE WHEN $2 THEN error_count + 1 ELSE error_count END,
-                  warning_count = CASE WHEN NOT $2 THEN warning_count + 1 ELSE warning_count END
-              WHERE task_id = $1`
+// Преобразование nullable-значения в указатель для JSON (null, если значения нет)
+func nullIntPtr(v sql.NullInt32) *int {
+	if !v.Valid {
+		return nil
+	}
+	value := int(v.Int32)
+	return &value
+}
 
-	_, err := db.Exec(query, taskID, isError)
+// обновление счётчика ошибок и предупреждений, для конкретной задачи
+// (строка task_metrics создаётся, если её ещё нет)
+func updateErrorAndWarningCounts(q dbQuerier, taskID int, errors, warnings int) error {
+	query := `INSERT INTO task_metrics (task_id, error_count, warning_count)
+              VALUES ($1, $2, $3)
+              ON CONFLICT (task_id) DO UPDATE
+              SET error_count = task_metrics.error_count + $2,
+                  warning_count = task_metrics.warning_count + $3`
+
+	_, err := q.Exec(query, taskID, errors, warnings)
 	return err
 }
 
@@ -1763,6 +1863,14 @@ func getPipelineAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Помощная функция для обработки нулевых чисел
+func nilIfZero(value int) interface{} {
+	if value == 0 {
+		return nil
+	}
+	return value
+}
+
 // Помощная функция для обработки пустых значений
 func nilIfEmpty(value string) interface{} {
 	if value == "" {
@@ -1788,6 +1896,7 @@ func getTaskDetails(w http.ResponseWriter, r *http.Request) {
 	var endTime sql.NullTime
 	var errorCount sql.NullInt32
 	var warningCount sql.NullInt32
+	var exitCode sql.NullInt32
 
 	// запрос для получения информации о задаче, включая время, метрики и связи.
 	query := `
@@ -1796,13 +1905,17 @@ func getTaskDetails(w http.ResponseWriter, r *http.Request) {
             t.name, 
             t.description, 
             t.status, 
+            COALESCE(t.status_reason, ''),
             COALESCE(u.username, '') AS assigned_user, 
             p.name AS pipeline_name, 
             t.start_time, 
             t.end_time, 
             COALESCE(EXTRACT(EPOCH FROM (t.end_time - t.start_time))::INTEGER, 0) AS duration_seconds,
             COALESCE(tm.error_count, 0),   -- Используем COALESCE для гарантированного значения
-            COALESCE(tm.warning_count, 0)  -- Используем COALESCE для гарантированного значения
+            COALESCE(tm.warning_count, 0), -- Используем COALESCE для гарантированного значения
+            t.exit_code,
+            t.task_type,
+            COALESCE(t.condition, '')
         FROM 
             task t
         LEFT JOIN 
@@ -1824,6 +1937,7 @@ func getTaskDetails(w http.ResponseWriter, r *http.Request) {
 		&task.Name,
 		&task.Description,
 		&task.Status,
+		&task.StatusReason,
 		&task.AssignedUser,
 		&task.PipelineName,
 		&startTime,
@@ -1831,6 +1945,9 @@ func getTaskDetails(w http.ResponseWriter, r *http.Request) {
 		&durationSeconds,
 		&errorCount,
 		&warningCount,
+		&exitCode,
+		&task.TaskType,
+		&task.Condition,
 	)
 	if err != nil {
 
@@ -1845,6 +1962,7 @@ func getTaskDetails(w http.ResponseWriter, r *http.Request) {
 	// Форматирование данных в нужный вид
 	task.ErrorCount = int(errorCount.Int32)
 	task.WarningCount = int(warningCount.Int32)
+	task.ExitCode = nullIntPtr(exitCode)
 
 	// Форматирование данных в нужный вид
 	duration := time.Duration(durationSeconds) * time.Second
@@ -1854,6 +1972,24 @@ func getTaskDetails(w http.ResponseWriter, r *http.Request) {
 		int(duration.Minutes())%60,
 	)
 
+	// История попыток выполнения задачи
+	task.Attempts, err = getTaskAttempts(taskID)
+	if err != nil {
+
+		http.Error(w, "Ошибка загрузки попыток задачи", http.StatusInternalServerError)
+		return
+	}
+
+	// Решения по задаче-подтверждению
+	if task.TaskType == "approval" {
+		task.Approvals, err = getTaskApprovals(taskID)
+		if err != nil {
+
+			http.Error(w, "Ошибка загрузки решений по задаче", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Отправка данных в формате JSON.
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(task)
@@ -1872,31 +2008,35 @@ func sendTaskUpdate(taskID int) {
 	// Далее идет остальная логика функции
 	var task TaskDetails
 	var startTime, endTime sql.NullTime
-	var errorCount, warningCount sql.NullInt32
-	var progressPercentage int
+	var errorCount, warningCount, exitCode sql.NullInt32
+	var progressPercentage, attemptCount int
 
 	query := `
         SELECT 
-            t.task_id, t.name, t.description, t.status, 
+            t.task_id, t.name, t.description, t.status, COALESCE(t.status_reason, ''),
             COALESCE(u.username, '') AS assignedUser,
             p.name AS pipeline_name, t.start_time, t.end_time, 
             COALESCE(EXTRACT(EPOCH FROM (t.end_time - t.start_time))::INTEGER, 0) AS duration_seconds,
             COALESCE(tm.error_count, 0),
             COALESCE(tm.warning_count, 0),
-            t.progress_percentage
+            t.progress_percentage, t.exit_code,
+            (SELECT COUNT(*) FROM task_attempt ta WHERE ta.task_id = t.task_id) AS attempt_count,
+            t.task_type, COALESCE(t.approval_level, $2)
         FROM task t
         LEFT JOIN "user" u ON t.assigned_to = u.user_id
         LEFT JOIN pipeline p ON t.pipeline_id = p.pipeline_id
         LEFT JOIN task_metrics tm ON t.task_id = tm.task_id
         WHERE t.task_id = $1`
 
-	row := db.QueryRow(query, taskID)
+	row := db.QueryRow(query, taskID, defaultApprovalLevel)
 	var durationSeconds int
+	var approvalLevel string
 	err = row.Scan(
-		&task.TaskID, &task.Name, &task.Description, &task.Status,
+		&task.TaskID, &task.Name, &task.Description, &task.Status, &task.StatusReason,
 		&task.AssignedUser, &task.PipelineName,
 		&startTime, &endTime, &durationSeconds, &errorCount, &warningCount,
-		&progressPercentage,
+		&progressPercentage, &exitCode, &attemptCount,
+		&task.TaskType, &approvalLevel,
 	)
 	if err != nil {
 		log.Printf("Ошибка при получении данных задачи для task %d: %v", taskID, err)
@@ -1907,6 +2047,7 @@ func sendTaskUpdate(taskID int) {
 	task.EndTime = formatTime(endTime)
 	task.ErrorCount = int(errorCount.Int32)
 	task.WarningCount = int(warningCount.Int32)
+	task.ExitCode = nullIntPtr(exitCode)
 	task.Duration = fmt.Sprintf("%d дней, %d часов, %d минут",
 		int(durationSeconds/86400),
 		int(durationSeconds%86400)/3600,
@@ -1919,6 +2060,7 @@ func sendTaskUpdate(taskID int) {
 			"task_id":             task.TaskID,
 			"name":                task.Name,
 			"status":              task.Status,
+			"status_reason":       task.StatusReason,
 			"description":         task.Description,
 			"assignee":            task.AssignedUser,
 			"pipeline_name":       task.PipelineName,
@@ -1928,6 +2070,12 @@ func sendTaskUpdate(taskID int) {
 			"error_count":         task.ErrorCount,
 			"warning_count":       task.WarningCount,
 			"progress_percentage": progressPercentage, // Добавляем progress_percentage
+			"exit_code":           task.ExitCode,
+			"attempt":             attemptCount,
+			"task_type":           task.TaskType,
+			// Задача-подтверждение блокирует зависимые задачи, пока по ней не принято решение
+			"waiting_for_approval": task.Status == "WaitingForApproval",
+			"approval_level":       approvalLevel,
 		},
 		"pipeline_id": pipelineID, // Передача pipeline_id для фронтенда
 	}
@@ -1995,7 +2143,7 @@ func enableCORS(next http.Handler) http.Handler {
 		// Разрешаем запросы с фронтенда на `localhost:3000`.
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		// Если метод `OPTIONS`, отправляем OK без обработки.
 		if r.Method == "OPTIONS" {
@@ -2032,8 +2180,11 @@ func main() {
 	r.HandleFunc("/api/check-tasks", checkTasksProgressHandler).Methods("POST")
 	r.HandleFunc("/api/analytics", getPipelineAnalyticsHandler).Methods("GET")
 	r.HandleFunc("/api/users", getUsersHandler).Methods("GET")
+	r.HandleFunc("/api/user/{user_id}/token", issueUserTokenHandler).Methods("POST")
 	r.HandleFunc("/api/task/assign", assignTaskHandler).Methods("POST")
 	r.HandleFunc("/api/task/move", moveTaskHandler).Methods("POST")
+	r.HandleFunc("/api/task/dependency/add", addDependencyHandler).Methods("POST")
+	r.HandleFunc("/api/task/dependency/remove", removeDependencyHandler).Methods("DELETE")
 	r.HandleFunc("/api/pipeline/delete", deletePipelineHandler).Methods("DELETE")
 	r.HandleFunc("/api/task/delete", deleteTaskHandler).Methods("DELETE")
 	r.HandleFunc("/status", handleStatus).Methods("GET")
@@ -2042,7 +2193,45 @@ func main() {
 	r.HandleFunc("/api/task/create", createTaskHandler).Methods("POST")
 	r.HandleFunc("/api/task/update", updateTaskStatusHandler).Methods("POST")
 	r.HandleFunc("/api/pipeline/update", updatePipelineStatusHandler).Methods("POST")
+	r.HandleFunc("/api/pipeline/{pipeline_id}/run", runPipelineHandler).Methods("POST")
+	r.HandleFunc("/api/pipeline/{pipeline_id}/cancel", cancelPipelineHandler).Methods("POST")
+	r.HandleFunc("/api/pipeline/{pipeline_id}/pause", pausePipelineHandler).Methods("POST")
+	r.HandleFunc("/api/pipeline/{pipeline_id}/resume", resumePipelineHandler).Methods("POST")
+	r.HandleFunc("/api/pipeline/{pipeline_id}/rerun-failed", rerunFailedHandler).Methods("POST")
+	r.HandleFunc("/api/pipeline/{pipeline_id}/export.yaml", exportPipelineYAMLHandler).Methods("GET")
+	r.HandleFunc("/api/task/{task_id}/cancel", cancelTaskHandler).Methods("POST")
+	r.HandleFunc("/api/definitions", getDefinitionsHandler).Methods("GET")
+	r.HandleFunc("/api/definition/{definition_id}", getDefinitionHandler).Methods("GET")
+	r.HandleFunc("/api/definition/{definition_id}/run", runDefinitionHandler).Methods("POST")
+	r.HandleFunc("/api/definition/{definition_id}/version/{version}", getDefinitionVersionHandler).Methods("GET")
+	r.HandleFunc("/api/definition/{definition_id}/diff", getDefinitionDiffHandler).Methods("GET")
+	r.HandleFunc("/api/definition/{definition_id}/schedules", getDefinitionSchedulesHandler).Methods("GET")
+	r.HandleFunc("/api/definition/{definition_id}/schedules", createScheduleHandler).Methods("POST")
+	r.HandleFunc("/api/schedule/{schedule_id}/update", updateScheduleHandler).Methods("POST")
+	r.HandleFunc("/api/schedule/{schedule_id}", deleteScheduleHandler).Methods("DELETE")
+	r.HandleFunc("/api/definition/{definition_id}/triggers", getDefinitionTriggersHandler).Methods("GET")
+	r.HandleFunc("/api/definition/{definition_id}/triggers", createTriggerHandler).Methods("POST")
+	r.HandleFunc("/api/trigger/{trigger_id}/update", updateTriggerHandler).Methods("POST")
+	r.HandleFunc("/api/trigger/{trigger_id}", deleteTriggerHandler).Methods("DELETE")
+	r.HandleFunc("/api/git/webhook", gitWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/webhooks", getWebhooksHandler).Methods("GET")
+	r.HandleFunc("/api/webhooks", createWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/webhook/{subscription_id}", deleteWebhookHandler).Methods("DELETE")
+	r.HandleFunc("/api/webhook/{subscription_id}/deliveries", getWebhookDeliveriesHandler).Methods("GET")
+	r.HandleFunc("/api/webhook-delivery/{delivery_id}/redeliver", redeliverWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/agents", getAgentsHandler).Methods("GET")
+	r.HandleFunc("/api/agents/register", registerAgentHandler).Methods("POST")
+	r.HandleFunc("/api/agent/{agent_id}", deleteAgentHandler).Methods("DELETE")
+	r.HandleFunc("/api/agent/{agent_id}/lease", leaseAgentJobHandler).Methods("POST")
+	r.HandleFunc("/api/agent/{agent_id}/heartbeat", agentHeartbeatHandler).Methods("POST")
+	r.HandleFunc("/api/agent/{agent_id}/jobs/{job_id}/logs", agentJobLogsHandler).Methods("POST")
+	r.HandleFunc("/api/agent/{agent_id}/jobs/{job_id}/result", agentJobResultHandler).Methods("POST")
+	r.HandleFunc("/api/task/{task_id}/logs", getTaskLogsHandler).Methods("GET")
+	r.HandleFunc("/api/task/{task_id}/logs", postTaskLogsHandler).Methods("POST")
+	r.HandleFunc("/api/task/{task_id}/approve", approveTaskHandler).Methods("POST")
+	r.HandleFunc("/api/task/{task_id}/reject", rejectTaskHandler).Methods("POST")
 	r.HandleFunc("/ws", handleConnections)
+	r.HandleFunc("/ws/task/{task_id}/logs", handleTaskLogStream)
 
 	// Новый маршрут для получения деталей задачи
 	r.HandleFunc("/api/task/{taskId}", getTaskDetails).Methods("GET")
@@ -2050,6 +2239,19 @@ func main() {
 	// Запуск обработчика WebSocket-сообщений
 	go handleMessages()
 
+	// Запуск супервизора таймаутов задач и пайплайнов
+	go superviseTimeouts()
+
+	// Запуск планировщика запусков по расписаниям (cron)
+	go runScheduler()
+
+	// Запуск рассылки событий по исходящим webhook
+	go runWebhookDispatcher()
+	go runWebhookDelivery()
+
+	// Запуск проверки аренды заданий удалённых агентов
+	go runAgentLeaseMonitor()
+
 	corsHandler := enableCORS(r)
 
 	// Запуск HTTP-сервера на порту 8080.
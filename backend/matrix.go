@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Максимальное число задач, в которое разворачивается одна задача matrix
+const yamlMaxMatrixSize = 256
+
+// Подстановка значения оси матрицы: ${matrix.go}
+var yamlMatrixPattern = regexp.MustCompile(`\$\{matrix\.([A-Za-z0-9_-]+)\}`)
+
+// Развёрнутая задача matrix: исходная задача и значения осей
+type yamlMatrixTask struct {
+	Group  string
+	Values map[string]string
+}
+
+// Ось матрицы в порядке объявления
+type yamlMatrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// Развёртывание задач с matrix в отдельные задачи до проверки схемы.
+// Каждая комбинация значений осей (в порядке объявления) даёт задачу с именем
+// "name (v1, v2)", если имя само не содержит ${matrix.*}. Развёрнутые задачи
+// наследуют зависимости и теги исходной, а depends_on на исходную задачу
+// заменяется зависимостью от всех развёрнутых
+func (v *yamlValidator) expandMatrix(document *yaml.Node) map[*yaml.Node]yamlMatrixTask {
+	expanded := make(map[*yaml.Node]yamlMatrixTask)
+	tasks := mappingValue(mappingValue(document, "pipeline"), "tasks")
+	if tasks == nil || tasks.Kind != yaml.SequenceNode {
+		return expanded
+	}
+
+	groups := make(map[string][]string)
+	var result []*yaml.Node
+	for i, task := range tasks.Content {
+		matrix := mappingValue(task, "matrix")
+		path := fmt.Sprintf("pipeline.tasks[%d]", i)
+		if matrix == nil || matrix.Kind != yaml.MappingNode {
+			// Некорректное значение matrix отметит проверка схемы
+			result = append(result, task)
+			continue
+		}
+
+		axes, ok := v.matrixAxes(matrix, path+".matrix")
+		if !ok {
+			result = append(result, task)
+			continue
+		}
+		name := ""
+		if nameNode := mappingValue(task, "name"); nameNode != nil {
+			name = nameNode.Value
+		}
+
+		for n, combination := range matrixCombinations(axes) {
+			clone := cloneYamlNode(task)
+			removeYamlMappingKey(clone, "matrix")
+			// Неизвестные оси одинаковы во всех комбинациях, сообщаем о них один раз
+			v.substituteMatrix(clone, combination, path, n == 0)
+
+			taskName := name
+			if nameNode := mappingValue(clone, "name"); nameNode != nil {
+				if !strings.Contains(name, "${matrix.") {
+					labels := make([]string, len(axes))
+					for j, axis := range axes {
+						labels[j] = combination[axis.Name]
+					}
+					nameNode.Value = fmt.Sprintf("%s (%s)", name, strings.Join(labels, ", "))
+				}
+				taskName = nameNode.Value
+			}
+			groups[name] = append(groups[name], taskName)
+			expanded[clone] = yamlMatrixTask{Group: name, Values: combination}
+			result = append(result, clone)
+		}
+	}
+	tasks.Content = result
+
+	// Сведение (fan-in): зависимость от задачи matrix - зависимость от всех её экземпляров
+	for _, task := range tasks.Content {
+		dependsOn := mappingValue(task, "depends_on")
+		if dependsOn == nil || dependsOn.Kind != yaml.SequenceNode {
+			continue
+		}
+		var items []*yaml.Node
+		for _, item := range dependsOn.Content {
+			names, ok := groups[item.Value]
+			if !ok || item.Kind != yaml.ScalarNode {
+				items = append(items, item)
+				continue
+			}
+			for _, name := range names {
+				items = append(items, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name, Line: item.Line, Column: item.Column})
+			}
+		}
+		dependsOn.Content = items
+	}
+	return expanded
+}
+
+// Перенос сведений о matrix в разобранные задачи; имя группы получает
+// подставленные значения переменных, как и имена задач.
+// Явные matrix_group и matrix_values приходят из выгрузки уже развёрнутого пайплайна
+// и принимаются, только если имя задачи - развёртка этой группы с этими значениями
+func (v *yamlValidator) assignMatrixGroups(document *yaml.Node, yamlData *YamlPipeline, matrixTasks map[*yaml.Node]yamlMatrixTask) {
+	tasks := mappingValue(mappingValue(document, "pipeline"), "tasks")
+	if tasks == nil {
+		return
+	}
+	for i, node := range tasks.Content {
+		if i >= len(yamlData.Pipeline.Tasks) {
+			continue
+		}
+		task := &yamlData.Pipeline.Tasks[i]
+		matrixTask, ok := matrixTasks[node]
+		if !ok {
+			if (task.MatrixGroup != "" || len(task.MatrixValues) > 0) && !isMatrixExpansion(task.Name, task.MatrixGroup, task.MatrixValues) {
+				field := mappingValue(node, "matrix_group")
+				if field == nil {
+					field = mappingValue(node, "matrix_values")
+				}
+				v.add(field, fmt.Sprintf("pipeline.tasks[%d].matrix_group", i), yamlErrInvalidValue,
+					fmt.Sprintf("задача %q не развёрнута из matrix %q со значениями matrix_values; для новых задач используйте matrix", task.Name, task.MatrixGroup))
+			}
+			continue
+		}
+		task.MatrixGroup, _ = expandVariables(matrixTask.Group, yamlData.Pipeline.Variables)
+		task.MatrixValues = matrixTask.Values
+	}
+}
+
+// Совпадает ли имя с именем, которое expandMatrix даёт задаче группы group со значениями
+// осей values: "group (v1, v2)" (порядок осей после выгрузки неизвестен) или group
+// с подставленными ${matrix.*}
+func isMatrixExpansion(name, group string, values map[string]string) bool {
+	if group == "" || len(values) == 0 {
+		return false
+	}
+	if strings.Contains(group, "${matrix.") {
+		return yamlMatrixPattern.ReplaceAllStringFunc(group, func(match string) string {
+			if value, ok := values[yamlMatrixPattern.FindStringSubmatch(match)[1]]; ok {
+				return value
+			}
+			return match
+		}) == name
+	}
+	prefix := group + " ("
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ")") {
+		return false
+	}
+	labels := strings.Split(name[len(prefix):len(name)-1], ", ")
+	if len(labels) != len(values) {
+		return false
+	}
+	remaining := make(map[string]int)
+	for _, value := range values {
+		remaining[value]++
+	}
+	for _, label := range labels {
+		if remaining[label] == 0 {
+			return false
+		}
+		remaining[label]--
+	}
+	return true
+}
+
+// Оси матрицы с проверкой значений; ось со скаляром считается осью из одного значения
+func (v *yamlValidator) matrixAxes(matrix *yaml.Node, path string) ([]yamlMatrixAxis, bool) {
+	var axes []yamlMatrixAxis
+	size := 1
+	ok := true
+	for i := 0; i+1 < len(matrix.Content); i += 2 {
+		key, value := matrix.Content[i], matrix.Content[i+1]
+		axisPath := path + "." + key.Value
+		if value.Kind != yaml.ScalarNode && value.Kind != yaml.SequenceNode {
+			v.add(value, axisPath, yamlErrInvalidType, "ожидается список значений")
+			ok = false
+			continue
+		}
+		values := scalarOrList(value)
+		if len(values) == 0 {
+			v.add(value, axisPath, yamlErrRequired, fmt.Sprintf("ось %q не содержит значений", key.Value))
+			ok = false
+			continue
+		}
+		axes = append(axes, yamlMatrixAxis{Name: key.Value, Values: values})
+		size *= len(values)
+	}
+	if len(axes) == 0 && ok {
+		v.add(matrix, path, yamlErrRequired, "matrix должна содержать хотя бы одну ось")
+		ok = false
+	}
+	if size > yamlMaxMatrixSize {
+		v.add(matrix, path, yamlErrOutOfRange, fmt.Sprintf("matrix разворачивается в %d задач, допустимо не больше %d", size, yamlMaxMatrixSize))
+		ok = false
+	}
+	return axes, ok
+}
+
+// Все комбинации значений осей: первая ось меняется медленнее всего
+func matrixCombinations(axes []yamlMatrixAxis) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, axis := range axes {
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range axis.Values {
+				item := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					item[k] = v
+				}
+				item[axis.Name] = value
+				next = append(next, item)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// Подстановка ${matrix.axis} во все скалярные значения задачи
+func (v *yamlValidator) substituteMatrix(node *yaml.Node, values map[string]string, path string, report bool) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${matrix.") {
+			return
+		}
+		node.Value = yamlMatrixPattern.ReplaceAllStringFunc(node.Value, func(match string) string {
+			axis := match[len("${matrix.") : len(match)-1]
+			value, ok := values[axis]
+			if !ok {
+				if report {
+					v.add(node, path, yamlErrUnknownVariable, fmt.Sprintf("ось %q не объявлена в matrix", axis))
+				}
+				return match
+			}
+			return value
+		})
+		node.Tag = "!!str"
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			v.substituteMatrix(node.Content[i], values, path, report)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			v.substituteMatrix(item, values, path, report)
+		}
+	}
+}
+
+// Глубокая копия узла YAML с сохранением позиций
+func cloneYamlNode(node *yaml.Node) *yaml.Node {
+	clone := *node
+	clone.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		clone.Content[i] = cloneYamlNode(child)
+	}
+	return &clone
+}
+
+func removeYamlMappingKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// Группа задач, развёрнутых из одной задачи matrix, для сворачивания в графе
+type TaskGroup struct {
+	Name     string         `json:"name"`
+	Status   string         `json:"status"`
+	TaskIDs  []int          `json:"task_ids"`
+	Statuses map[string]int `json:"statuses"`
+}
+
+// Порядок статусов для сводного статуса группы: первый встретившийся побеждает
+var taskGroupStatusPriority = []string{"Failed", "TimedOut", "Running", "WaitingForApproval", "Pending", "Cancelled", "Skipped", "Completed"}
+
+// Группировка задач пайплайна по matrix_group в порядке первого появления
+func groupMatrixTasks(tasks []Task) []TaskGroup {
+	var groups []TaskGroup
+	index := make(map[string]int)
+	seen := make(map[int]bool)
+	for _, task := range tasks {
+		if task.MatrixGroup == "" || seen[task.TaskID] {
+			continue
+		}
+		seen[task.TaskID] = true
+		i, ok := index[task.MatrixGroup]
+		if !ok {
+			i = len(groups)
+			index[task.MatrixGroup] = i
+			groups = append(groups, TaskGroup{Name: task.MatrixGroup, Statuses: make(map[string]int)})
+		}
+		groups[i].TaskIDs = append(groups[i].TaskIDs, task.TaskID)
+		groups[i].Statuses[task.Status]++
+	}
+	for i := range groups {
+		for _, status := range taskGroupStatusPriority {
+			if groups[i].Statuses[status] > 0 {
+				groups[i].Status = status
+				break
+			}
+		}
+	}
+	return groups
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsMatrixExpansion(t *testing.T) {
+	values := map[string]string{"os": "linux", "go": "1.20"}
+	tests := []struct {
+		name, group string
+		values      map[string]string
+		want        bool
+	}{
+		{"build (linux, 1.20)", "build", values, true},
+		{"build (1.20, linux)", "build", values, true},
+		{"build (linux)", "build", values, false},
+		{"build (linux, 1.21)", "build", values, false},
+		{"deploy (linux, 1.20)", "build", values, false},
+		{"build-linux-1.20", "build-${matrix.os}-${matrix.go}", values, true},
+		{"build-linux-1.21", "build-${matrix.os}-${matrix.go}", values, false},
+		{"build (linux, 1.20)", "build", nil, false},
+		{"build", "", values, false},
+	}
+	for _, tt := range tests {
+		if got := isMatrixExpansion(tt.name, tt.group, tt.values); got != tt.want {
+			t.Errorf("isMatrixExpansion(%q, %q) = %v, ожидалось %v", tt.name, tt.group, got, tt.want)
+		}
+	}
+}
+
+// Явные matrix_group и matrix_values принимаются только у развёрнутых задач
+func TestParsePipelineMatrixGroupFromExport(t *testing.T) {
+	exported := `
+pipeline:
+  name: ci
+  tasks:
+    - name: test (linux)
+      command: make test
+      matrix_group: test
+      matrix_values:
+        os: linux
+`
+	parsed, err := parsePipelineYAML([]byte(exported), yamlParseOptions{})
+	if err != nil {
+		t.Fatalf("выгрузка не принята: %v", err)
+	}
+	if task := parsed.Pipeline.Tasks[0]; task.MatrixGroup != "test" || task.MatrixValues["os"] != "linux" {
+		t.Errorf("задача %+v", task)
+	}
+
+	forged := `
+pipeline:
+  name: ci
+  tasks:
+    - name: deploy
+      command: make deploy
+      matrix_group: test
+      matrix_values:
+        os: linux
+`
+	_, err = parsePipelineYAML([]byte(forged), yamlParseOptions{})
+	if err == nil || !strings.Contains(err.Error(), "не развёрнута из matrix") {
+		t.Errorf("поддельная группа: %v", err)
+	}
+}
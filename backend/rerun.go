@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// Статусы, с которых начинается повторный запуск упавшей части пайплайна
+var rerunFromStatuses = map[string]bool{
+	"Failed":    true,
+	"TimedOut":  true,
+	"Cancelled": true,
+}
+
+// Повторный запуск упавшей части пайплайна. Упавшие задачи (или задача из task_id)
+// и всё, что от них зависит, возвращаются в Pending; успешно завершённые задачи выше
+// по графу сохраняют результаты. История попыток и счётчики task_metrics не сбрасываются,
+// новые попытки продолжают нумерацию. С start=false задачи только сбрасываются без запуска движка
+func rerunFailedHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, status, ok := pipelineStatusFromPath(w, r)
+	if !ok {
+		return
+	}
+	if status == "Running" || status == "Paused" {
+		http.Error(w, "Пайплайн ещё выполняется", http.StatusConflict)
+		return
+	}
+
+	var fromTaskID int
+	if taskIDStr := r.URL.Query().Get("task_id"); taskIDStr != "" {
+		id, err := strconv.Atoi(taskIDStr)
+		if err != nil {
+			http.Error(w, "Некорректный task_id", http.StatusBadRequest)
+			return
+		}
+		fromTaskID = id
+	}
+	start := r.URL.Query().Get("start") != "false"
+
+	var reset []int
+	err := withTx(func(tx *sql.Tx) error {
+		// Блокировка пайплайна, чтобы граф и статусы не менялись во время сброса
+		if _, err := tx.Exec(`SELECT 1 FROM pipeline WHERE pipeline_id = $1 FOR UPDATE`, pipelineID); err != nil {
+			return err
+		}
+		graph, err := loadPipelineGraph(tx, pipelineID)
+		if err != nil {
+			return err
+		}
+		statuses, err := loadTaskStatuses(tx, pipelineID)
+		if err != nil {
+			return err
+		}
+
+		var roots []int
+		if fromTaskID != 0 {
+			taskStatus, ok := statuses[fromTaskID]
+			if !ok {
+				return &requestError{http.StatusNotFound, "Задача не найдена в пайплайне"}
+			}
+			if taskStatus == "Running" || taskStatus == "WaitingForApproval" {
+				return &requestError{http.StatusConflict, "Задача ещё выполняется"}
+			}
+			roots = []int{fromTaskID}
+		} else {
+			for _, taskID := range graph.sortedTaskIDs() {
+				if rerunFromStatuses[statuses[taskID]] {
+					roots = append(roots, taskID)
+				}
+			}
+		}
+		if len(roots) == 0 {
+			return &requestError{http.StatusConflict, "В пайплайне нет упавших задач"}
+		}
+
+		selected := make(map[int]bool)
+		for _, root := range roots {
+			selected[root] = true
+			for _, taskID := range graph.downstream(root) {
+				selected[taskID] = true
+			}
+		}
+		for _, taskID := range graph.sortedTaskIDs() {
+			if selected[taskID] {
+				reset = append(reset, taskID)
+			}
+		}
+
+		_, err = tx.Exec(`
+            UPDATE task
+            SET status = 'Pending', start_time = NULL, end_time = NULL, exit_code = NULL, status_reason = NULL,
+                progress_percentage = 0
+            WHERE task_id = ANY($1::int[])`, pq.Array(reset))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+            UPDATE pipeline SET status = 'Pending', end_time = NULL, status_reason = NULL
+            WHERE pipeline_id = $1`, pipelineID)
+		return err
+	})
+	if appErr, ok := err.(*requestError); ok {
+		http.Error(w, appErr.Message, appErr.Code)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка при сбросе задач пайплайна", http.StatusInternalServerError)
+		return
+	}
+
+	for _, taskID := range reset {
+		sendTaskUpdate(taskID)
+	}
+	sendPipelineUpdate(pipelineID)
+
+	if start {
+		if err := startPipelineRerun(pipelineID); err == errPipelineAlreadyRunning {
+			http.Error(w, "Пайплайн уже выполняется", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка запуска пайплайна", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pipeline_id": pipelineID,
+		"reset_tasks": reset,
+		"started":     start,
+	})
+}
+
+// Текущие статусы задач пайплайна
+func loadTaskStatuses(q dbQuerier, pipelineID int) (map[int]string, error) {
+	rows, err := q.Query(`SELECT task_id, COALESCE(status, 'Pending') FROM task WHERE pipeline_id = $1`, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[int]string)
+	for rows.Next() {
+		var taskID int
+		var status string
+		if err := rows.Scan(&taskID, &status); err != nil {
+			return nil, err
+		}
+		statuses[taskID] = status
+	}
+	return statuses, rows.Err()
+}
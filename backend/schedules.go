@@ -0,0 +1,504 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Как часто планировщик проверяет расписания
+	scheduleInterval = 15 * time.Second
+	// Срабатывание старше этого считается пропущенным (например, сервер был выключен)
+	scheduleGrace = time.Minute
+	// Сколько пропущенных срабатываний догоняется при catchup_policy = all
+	scheduleMaxCatchUp = 100
+)
+
+// Что делать, если предыдущий запуск определения ещё выполняется
+var scheduleOverlapPolicies = map[string]bool{
+	"skip":            true, // срабатывание пропускается
+	"queue":           true, // запуск создаётся и ждёт завершения предыдущих
+	"cancel-previous": true, // выполняющиеся запуски отменяются
+}
+
+// Что делать со срабатываниями, пропущенными во время простоя
+var scheduleCatchUpPolicies = map[string]bool{
+	"none":   true, // пропущенные срабатывания не выполняются
+	"latest": true, // выполняется только последнее пропущенное
+	"all":    true, // выполняются все, но не больше scheduleMaxCatchUp
+}
+
+// Расписание запусков определения
+type PipelineSchedule struct {
+	ScheduleID    int               `json:"schedule_id"`
+	DefinitionID  int               `json:"definition_id"`
+	Cron          string            `json:"cron"`
+	Timezone      string            `json:"timezone"`
+	OverlapPolicy string            `json:"overlap_policy"`
+	CatchUpPolicy string            `json:"catchup_policy"`
+	Variables     map[string]string `json:"variables,omitempty"` // переопределения переменных для запусков по расписанию
+	Enabled       bool              `json:"enabled"`
+	NextRunAt     string            `json:"next_run_at,omitempty"` // в часовом поясе расписания
+	LastError     string            `json:"last_error,omitempty"`
+	CreatedAt     string            `json:"created_at"`
+}
+
+// Тело запроса на создание и изменение расписания; не переданные поля не меняются
+type scheduleRequest struct {
+	Cron          *string            `json:"cron"`
+	Timezone      *string            `json:"timezone"`
+	OverlapPolicy *string            `json:"overlap_policy"`
+	CatchUpPolicy *string            `json:"catchup_policy"`
+	Variables     *map[string]string `json:"variables"`
+	Enabled       *bool              `json:"enabled"`
+}
+
+func (req *scheduleRequest) apply(schedule *PipelineSchedule) {
+	if req.Cron != nil {
+		schedule.Cron = *req.Cron
+	}
+	if req.Timezone != nil {
+		schedule.Timezone = *req.Timezone
+	}
+	if req.OverlapPolicy != nil {
+		schedule.OverlapPolicy = *req.OverlapPolicy
+	}
+	if req.CatchUpPolicy != nil {
+		schedule.CatchUpPolicy = *req.CatchUpPolicy
+	}
+	if req.Variables != nil {
+		schedule.Variables = *req.Variables
+	}
+	if req.Enabled != nil {
+		schedule.Enabled = *req.Enabled
+	}
+}
+
+// Проверка расписания: cron, часовой пояс, политики и переопределения переменных
+// последней версии определения. Возвращает ближайшее время срабатывания
+func validateSchedule(schedule *PipelineSchedule) (time.Time, error) {
+	expression, err := parseCron(schedule.Cron)
+	if err != nil {
+		return time.Time{}, &requestError{http.StatusBadRequest, "Некорректное cron-выражение: " + err.Error()}
+	}
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return time.Time{}, &requestError{http.StatusBadRequest, fmt.Sprintf("Неизвестный часовой пояс %q", schedule.Timezone)}
+	}
+	if !scheduleOverlapPolicies[schedule.OverlapPolicy] {
+		return time.Time{}, &requestError{http.StatusBadRequest, "overlap_policy должен быть skip, queue или cancel-previous"}
+	}
+	if !scheduleCatchUpPolicies[schedule.CatchUpPolicy] {
+		return time.Time{}, &requestError{http.StatusBadRequest, "catchup_policy должен быть none, latest или all"}
+	}
+	next := expression.next(time.Now().In(loc))
+	if next.IsZero() {
+		return time.Time{}, &requestError{http.StatusBadRequest, "cron-выражение никогда не срабатывает"}
+	}
+
+	if _, _, err := loadDefinitionVersion(db, schedule.DefinitionID, 0, schedule.Variables); err == sql.ErrNoRows {
+		return time.Time{}, &requestError{http.StatusNotFound, "Определение не найдено"}
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return next, nil
+}
+
+func writeScheduleError(w http.ResponseWriter, err error) {
+	if reqErr, ok := err.(*requestError); ok {
+		http.Error(w, reqErr.Message, reqErr.Code)
+	} else if validationErr, ok := err.(*YamlValidationError); ok {
+		writeYamlValidationError(w, validationErr)
+	} else {
+		http.Error(w, "Ошибка загрузки определения", http.StatusInternalServerError)
+	}
+}
+
+// Расписания определения: GET /api/definition/{definition_id}/schedules
+func getDefinitionSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	schedules, err := loadSchedules(`WHERE definition_id = $1`, definitionID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// Создание расписания: POST /api/definition/{definition_id}/schedules
+// {"cron": "0 3 * * *", "timezone": "Europe/Moscow", "overlap_policy": "skip", "catchup_policy": "latest"}
+func createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Cron == nil {
+		http.Error(w, "Неверные данные: нужно поле cron", http.StatusBadRequest)
+		return
+	}
+
+	schedule := PipelineSchedule{DefinitionID: definitionID, Timezone: "UTC", OverlapPolicy: "skip", CatchUpPolicy: "latest", Enabled: true}
+	req.apply(&schedule)
+	if _, err := validateSchedule(&schedule); err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	// Отсчёт срабатываний начинается с момента создания, прошлые не догоняются
+	err = db.QueryRow(`
+        INSERT INTO pipeline_schedule (definition_id, cron, timezone, overlap_policy, catchup_policy, variables, enabled, last_checked_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+        RETURNING schedule_id`,
+		definitionID, schedule.Cron, schedule.Timezone, schedule.OverlapPolicy, schedule.CatchUpPolicy,
+		stringMapJSON(schedule.Variables), schedule.Enabled).Scan(&schedule.ScheduleID)
+	if err != nil {
+		http.Error(w, "Ошибка создания расписания", http.StatusInternalServerError)
+		return
+	}
+	writeSchedule(w, schedule.ScheduleID, http.StatusCreated)
+}
+
+// Изменение расписания: POST /api/schedule/{schedule_id}/update с теми же полями, что при создании
+func updateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	scheduleID, err := strconv.Atoi(mux.Vars(r)["schedule_id"])
+	if err != nil {
+		http.Error(w, "Некорректный schedule_id", http.StatusBadRequest)
+		return
+	}
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверные данные", http.StatusBadRequest)
+		return
+	}
+
+	schedules, err := loadSchedules(`WHERE schedule_id = $1`, scheduleID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if len(schedules) == 0 {
+		http.Error(w, "Расписание не найдено", http.StatusNotFound)
+		return
+	}
+	schedule := schedules[0]
+	wasEnabled := schedule.Enabled
+	req.apply(&schedule)
+	if _, err := validateSchedule(&schedule); err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	// После включения срабатывания за время, пока расписание было выключено, не догоняются
+	_, err = db.Exec(`
+        UPDATE pipeline_schedule
+        SET cron = $1, timezone = $2, overlap_policy = $3, catchup_policy = $4, variables = $5, enabled = $6,
+            last_checked_at = CASE WHEN $7 THEN NOW() ELSE last_checked_at END, last_error = NULL
+        WHERE schedule_id = $8`,
+		schedule.Cron, schedule.Timezone, schedule.OverlapPolicy, schedule.CatchUpPolicy,
+		stringMapJSON(schedule.Variables), schedule.Enabled, schedule.Enabled && !wasEnabled, scheduleID)
+	if err != nil {
+		http.Error(w, "Ошибка изменения расписания", http.StatusInternalServerError)
+		return
+	}
+	writeSchedule(w, scheduleID, http.StatusOK)
+}
+
+// Удаление расписания: DELETE /api/schedule/{schedule_id}; созданные им запуски остаются
+func deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	scheduleID, err := strconv.Atoi(mux.Vars(r)["schedule_id"])
+	if err != nil {
+		http.Error(w, "Некорректный schedule_id", http.StatusBadRequest)
+		return
+	}
+	result, err := db.Exec(`DELETE FROM pipeline_schedule WHERE schedule_id = $1`, scheduleID)
+	if err != nil {
+		http.Error(w, "Ошибка удаления расписания", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Расписание не найдено", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeSchedule(w http.ResponseWriter, scheduleID, status int) {
+	schedules, err := loadSchedules(`WHERE schedule_id = $1`, scheduleID)
+	if err != nil || len(schedules) == 0 {
+		http.Error(w, "Ошибка загрузки расписания", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(schedules[0])
+}
+
+// Расписания по условию where с вычисленным временем ближайшего срабатывания
+func loadSchedules(where string, args ...interface{}) ([]PipelineSchedule, error) {
+	rows, err := db.Query(`
+        SELECT schedule_id, definition_id, cron, timezone, overlap_policy, catchup_policy,
+               variables, enabled, COALESCE(last_error, ''), created_at
+        FROM pipeline_schedule `+where+` ORDER BY schedule_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []PipelineSchedule{}
+	for rows.Next() {
+		var schedule PipelineSchedule
+		var variables []byte
+		var createdAt sql.NullTime
+		if err := rows.Scan(&schedule.ScheduleID, &schedule.DefinitionID, &schedule.Cron, &schedule.Timezone,
+			&schedule.OverlapPolicy, &schedule.CatchUpPolicy, &variables, &schedule.Enabled, &schedule.LastError, &createdAt); err != nil {
+			return nil, err
+		}
+		if variables != nil {
+			if err := json.Unmarshal(variables, &schedule.Variables); err != nil {
+				return nil, fmt.Errorf("переменные расписания %d: %v", schedule.ScheduleID, err)
+			}
+		}
+		schedule.CreatedAt = formatTime(createdAt)
+		if schedule.Enabled {
+			expression, err := parseCron(schedule.Cron)
+			loc, locErr := time.LoadLocation(schedule.Timezone)
+			if err == nil && locErr == nil {
+				if next := expression.next(time.Now().In(loc)); !next.IsZero() {
+					schedule.NextRunAt = next.Format("2006-01-02 15:04:05 -0700")
+				}
+			}
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+// Фоновая горутина, которая создаёт и запускает запуски определений по расписаниям
+func runScheduler() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fireSchedules(time.Now())
+	}
+}
+
+func fireSchedules(now time.Time) {
+	rows, err := db.Query(`SELECT schedule_id FROM pipeline_schedule WHERE enabled ORDER BY schedule_id`)
+	if err != nil {
+		log.Printf("Ошибка при получении расписаний: %v", err)
+		return
+	}
+	var scheduleIDs []int
+	for rows.Next() {
+		var scheduleID int
+		if err := rows.Scan(&scheduleID); err == nil {
+			scheduleIDs = append(scheduleIDs, scheduleID)
+		}
+	}
+	rows.Close()
+
+	for _, scheduleID := range scheduleIDs {
+		fireSchedule(scheduleID, now)
+	}
+	startQueuedRuns()
+}
+
+// Обработка срабатываний одного расписания с момента прошлой проверки до now.
+// Строка расписания блокируется, поэтому несколько экземпляров сервера не создадут
+// один и тот же запуск дважды
+func fireSchedule(scheduleID int, now time.Time) {
+	var created, cancelled []int
+	var overlapPolicy string
+	err := withTx(func(tx *sql.Tx) error {
+		var definitionID int
+		var cron, timezone, catchUpPolicy string
+		var variablesJSON []byte
+		var lastChecked sql.NullTime
+		err := tx.QueryRow(`
+            SELECT definition_id, cron, timezone, overlap_policy, catchup_policy, variables, last_checked_at
+            FROM pipeline_schedule WHERE schedule_id = $1 AND enabled
+            FOR UPDATE SKIP LOCKED`, scheduleID).Scan(
+			&definitionID, &cron, &timezone, &overlapPolicy, &catchUpPolicy, &variablesJSON, &lastChecked)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE pipeline_schedule SET last_checked_at = $1 WHERE schedule_id = $2`, now, scheduleID); err != nil {
+			return err
+		}
+		if !lastChecked.Valid {
+			return nil
+		}
+
+		slots, err := scheduleSlots(cron, timezone, catchUpPolicy, lastChecked.Time, now)
+		if err != nil || len(slots) == 0 {
+			return setScheduleError(tx, scheduleID, err)
+		}
+
+		// Без переменных или определения срабатывание не создаёт запусков и не отменяет
+		// выполняющиеся: ошибка сохраняется в last_error расписания
+		variables := make(map[string]string)
+		if variablesJSON != nil {
+			if err := json.Unmarshal(variablesJSON, &variables); err != nil {
+				return setScheduleError(tx, scheduleID, fmt.Errorf("некорректные переменные расписания: %v", err))
+			}
+		}
+		yamlData, version, err := loadDefinitionVersion(tx, definitionID, 0, variables)
+		if err != nil {
+			return setScheduleError(tx, scheduleID, err)
+		}
+
+		active, err := activeDefinitionRuns(tx, definitionID)
+		if err != nil {
+			return err
+		}
+		if overlapPolicy == "cancel-previous" {
+			// Каждое следующее срабатывание отменило бы предыдущее, поэтому нужно только последнее
+			slots = slots[len(slots)-1:]
+			cancelled = active
+			active = nil
+		}
+
+		for _, slot := range slots {
+			if overlapPolicy == "skip" && len(active) > 0 {
+				log.Printf("Расписание %d: срабатывание %s пропущено, запуск %d ещё выполняется", scheduleID, slot.Format(time.RFC3339), active[0])
+				continue
+			}
+			pipelineID, err := createPipelineRun(tx, yamlData, definitionID, version, true)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE pipeline SET schedule_id = $1, scheduled_for = $2 WHERE pipeline_id = $3`, scheduleID, slot, pipelineID); err != nil {
+				return err
+			}
+			active = append(active, pipelineID)
+			created = append(created, pipelineID)
+		}
+		return setScheduleError(tx, scheduleID, nil)
+	})
+	if err != nil {
+		log.Printf("Ошибка обработки расписания %d: %v", scheduleID, err)
+		return
+	}
+
+	for _, pipelineID := range cancelled {
+		stopPipeline(pipelineID, "Cancelled", fmt.Sprintf("отменён новым запуском по расписанию %d", scheduleID))
+	}
+	for _, pipelineID := range created {
+		sendPipelineUpdate(pipelineID)
+		// Запуски в очереди стартуют по одному в startQueuedRuns
+		if overlapPolicy == "queue" {
+			continue
+		}
+		if err := startPipelineExecution(pipelineID, false); err != nil {
+			log.Printf("Ошибка запуска пайплайна %d по расписанию %d: %v", pipelineID, scheduleID, err)
+		}
+	}
+}
+
+// Срабатывания в интервале (from, now] с учётом политики догона пропущенных
+func scheduleSlots(cron, timezone, catchUpPolicy string, from, now time.Time) ([]time.Time, error) {
+	expression, err := parseCron(cron)
+	if err != nil {
+		return nil, fmt.Errorf("некорректное cron-выражение: %v", err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("неизвестный часовой пояс %q", timezone)
+	}
+	slots := expression.between(from.In(loc), now.In(loc), scheduleMaxCatchUp)
+	switch catchUpPolicy {
+	case "none":
+		var onTime []time.Time
+		for _, slot := range slots {
+			if now.Sub(slot) <= scheduleGrace {
+				onTime = append(onTime, slot)
+			}
+		}
+		return onTime, nil
+	case "latest":
+		if len(slots) > 1 {
+			slots = slots[len(slots)-1:]
+		}
+	}
+	return slots, nil
+}
+
+// Сохранение ошибки последнего срабатывания (nil - ошибки нет), чтобы её было видно в API
+func setScheduleError(tx *sql.Tx, scheduleID int, err error) error {
+	var message interface{}
+	if err != nil {
+		message = err.Error()
+		log.Printf("Расписание %d: %v", scheduleID, err)
+	}
+	_, dbErr := tx.Exec(`UPDATE pipeline_schedule SET last_error = $1 WHERE schedule_id = $2`, message, scheduleID)
+	return dbErr
+}
+
+// Незавершённые запуски определения: выполняющиеся, на паузе и ожидающие в очереди расписания
+func activeDefinitionRuns(q dbQuerier, definitionID int) ([]int, error) {
+	rows, err := q.Query(`
+        SELECT pipeline_id FROM pipeline
+        WHERE definition_id = $1
+          AND (status IN ('Running', 'Paused')
+               OR (schedule_id IS NOT NULL AND status = 'Pending' AND start_time IS NULL))
+        ORDER BY run_number`, definitionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pipelineIDs []int
+	for rows.Next() {
+		var pipelineID int
+		if err := rows.Scan(&pipelineID); err != nil {
+			return nil, err
+		}
+		pipelineIDs = append(pipelineIDs, pipelineID)
+	}
+	return pipelineIDs, rows.Err()
+}
+
+// Запуск первого запуска из очереди расписаний для каждого определения,
+// у которого нет выполняющихся запусков
+func startQueuedRuns() {
+	rows, err := db.Query(`
+        SELECT DISTINCT ON (p.definition_id) p.pipeline_id
+        FROM pipeline p
+        WHERE p.schedule_id IS NOT NULL AND p.status = 'Pending' AND p.start_time IS NULL
+          AND NOT EXISTS (
+              SELECT 1 FROM pipeline a
+              WHERE a.definition_id = p.definition_id AND a.status IN ('Running', 'Paused'))
+        ORDER BY p.definition_id, p.run_number`)
+	if err != nil {
+		log.Printf("Ошибка при получении очереди запусков: %v", err)
+		return
+	}
+	var pipelineIDs []int
+	for rows.Next() {
+		var pipelineID int
+		if err := rows.Scan(&pipelineID); err == nil {
+			pipelineIDs = append(pipelineIDs, pipelineID)
+		}
+	}
+	rows.Close()
+
+	for _, pipelineID := range pipelineIDs {
+		if err := startPipelineExecution(pipelineID, false); err != nil && err != errPipelineAlreadyRunning {
+			log.Printf("Ошибка запуска пайплайна %d из очереди: %v", pipelineID, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleSlots(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hours := func(n ...int) []time.Time {
+		var times []time.Time
+		for _, h := range n {
+			times = append(times, from.Add(time.Duration(h)*time.Hour))
+		}
+		return times
+	}
+
+	tests := []struct {
+		name   string
+		cron   string
+		policy string
+		now    time.Time
+		want   []time.Time
+	}{
+		{"none: все пропущены", "0 * * * *", "none", from.Add(3*time.Hour + 5*time.Minute), nil},
+		{"none: последнее в пределах grace", "0 * * * *", "none", from.Add(3*time.Hour + 30*time.Second), hours(3)},
+		{"latest", "0 * * * *", "latest", from.Add(3*time.Hour + 5*time.Minute), hours(3)},
+		{"latest без срабатываний", "0 * * * *", "latest", from.Add(30 * time.Minute), nil},
+		{"all", "0 * * * *", "all", from.Add(3*time.Hour + 5*time.Minute), hours(1, 2, 3)},
+	}
+	for _, tt := range tests {
+		got, err := scheduleSlots(tt.cron, "UTC", tt.policy, from, tt.now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %v, ожидалось %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("%s: %v, ожидалось %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestScheduleSlotsCatchUpLimit(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := from.Add(1000 * time.Minute)
+	got, err := scheduleSlots("* * * * *", "UTC", "all", from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != scheduleMaxCatchUp || !got[len(got)-1].Equal(now) {
+		t.Errorf("all: %d срабатываний, последнее %s", len(got), got[len(got)-1])
+	}
+}
+
+func TestScheduleSlotsTimezone(t *testing.T) {
+	// 09:00 по Москве (UTC+3) - 06:00 UTC
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	got, err := scheduleSlots("0 9 * * *", "Europe/Moscow", "all", from, from.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].Equal(from.Add(6*time.Hour)) {
+		t.Errorf("Europe/Moscow: %v", got)
+	}
+
+	if _, err := scheduleSlots("0 9 * * *", "Mars/Base", "all", from, from); err == nil {
+		t.Error("ожидалась ошибка неизвестного часового пояса")
+	}
+	if _, err := scheduleSlots("0 9 * *", "UTC", "all", from, from); err == nil {
+		t.Error("ожидалась ошибка cron-выражения")
+	}
+}
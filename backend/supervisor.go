@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Как часто супервизор проверяет таймауты задач и пайплайнов
+const supervisorInterval = 15 * time.Second
+
+// Фоновая горутина, которая следит за таймаутами задач и пайплайнов
+func superviseTimeouts() {
+	ticker := time.NewTicker(supervisorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		enforceTimeouts()
+	}
+}
+
+// Перевод в TimedOut всех задач и пайплайнов, превысивших timeout_seconds.
+// Время задачи считается от start_time первой попытки: timeout - общий бюджет
+// на все повторы, а не на одну попытку
+func enforceTimeouts() {
+	type expired struct {
+		ID         int
+		PipelineID int
+		Timeout    int
+	}
+
+	var tasks []expired
+	rows, err := db.Query(`
+        SELECT task_id, pipeline_id, timeout_seconds
+        FROM task
+        WHERE status IN ('Running', 'WaitingForApproval') AND timeout_seconds > 0
+          AND start_time + make_interval(secs => timeout_seconds) < NOW()`)
+	if err != nil {
+		log.Printf("Ошибка при поиске задач с истёкшим таймаутом: %v", err)
+		return
+	}
+	for rows.Next() {
+		var t expired
+		if err := rows.Scan(&t.ID, &t.PipelineID, &t.Timeout); err != nil {
+			log.Printf("Ошибка при сканировании задачи: %v", err)
+			continue
+		}
+		tasks = append(tasks, t)
+	}
+	rows.Close()
+
+	for _, t := range tasks {
+		stopTask(t.ID, t.PipelineID, "TimedOut", fmt.Sprintf("превышен таймаут задачи (%s)", time.Duration(t.Timeout)*time.Second))
+	}
+
+	var pipelines []expired
+	rows, err = db.Query(`
+        SELECT pipeline_id, timeout_seconds
+        FROM pipeline
+        WHERE status = 'Running' AND timeout_seconds > 0
+          AND start_time + make_interval(secs => timeout_seconds) < NOW()`)
+	if err != nil {
+		log.Printf("Ошибка при поиске пайплайнов с истёкшим таймаутом: %v", err)
+		return
+	}
+	for rows.Next() {
+		var p expired
+		if err := rows.Scan(&p.ID, &p.Timeout); err != nil {
+			log.Printf("Ошибка при сканировании пайплайна: %v", err)
+			continue
+		}
+		pipelines = append(pipelines, p)
+	}
+	rows.Close()
+
+	for _, p := range pipelines {
+		stopPipeline(p.ID, "TimedOut", fmt.Sprintf("превышен таймаут пайплайна (%s)", time.Duration(p.Timeout)*time.Second))
+	}
+}
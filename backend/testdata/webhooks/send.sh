@@ -0,0 +1,45 @@
+#!/bin/sh
+# Отправка записанного webhook с подписью, как это делает git-сервер.
+# Использование: ./send.sh <github|gitlab|gitea> <файл.json> <секрет> [адрес]
+# Перед отправкой создайте триггер:
+#   curl -X POST localhost:8080/api/definition/1/triggers \
+#        -d '{"repository": "team/ci-demo", "branch": "*", "secret": "s3cret"}'
+set -e
+
+provider=$1
+payload=$2
+secret=$3
+url=${4:-http://localhost:8080/api/git/webhook}
+
+if [ -z "$provider" ] || [ -z "$payload" ] || [ -z "$secret" ]; then
+    echo "Использование: $0 <github|gitlab|gitea> <файл.json> <секрет> [адрес]" >&2
+    exit 1
+fi
+
+signature=$(openssl dgst -sha256 -hmac "$secret" < "$payload" | sed 's/^.* //')
+case "$payload" in
+    *merge_request*|*pull_request*) event=merge_request ;;
+    *) event=push ;;
+esac
+
+case "$provider" in
+    github)
+        [ "$event" = merge_request ] && event=pull_request
+        curl -sS -X POST "$url" -H "Content-Type: application/json" \
+            -H "X-GitHub-Event: $event" -H "X-Hub-Signature-256: sha256=$signature" \
+            --data-binary "@$payload" ;;
+    gitea)
+        [ "$event" = merge_request ] && event=pull_request
+        curl -sS -X POST "$url" -H "Content-Type: application/json" \
+            -H "X-Gitea-Event: $event" -H "X-Gitea-Signature: $signature" \
+            --data-binary "@$payload" ;;
+    gitlab)
+        [ "$event" = merge_request ] && hook="Merge Request Hook" || hook="Push Hook"
+        curl -sS -X POST "$url" -H "Content-Type: application/json" \
+            -H "X-Gitlab-Event: $hook" -H "X-Gitlab-Token: $secret" \
+            --data-binary "@$payload" ;;
+    *)
+        echo "Неизвестный источник $provider" >&2
+        exit 1 ;;
+esac
+echo
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Максимальный размер тела входящего webhook
+const maxWebhookBody = 5 << 20
+
+// Допустимое расхождение Webhook-Timestamp подписанного webhook GitLab с часами сервера:
+// более старые запросы считаются повтором перехваченного
+const gitWebhookTolerance = 5 * time.Minute
+
+// События git-сервера, которые могут запускать пайплайны
+var gitTriggerEvents = map[string]bool{
+	"push":          true,
+	"merge_request": true, // merge request GitLab и pull request GitHub/Gitea
+}
+
+// Триггер: webhook из репозитория запускает определение
+type PipelineTrigger struct {
+	TriggerID    int      `json:"trigger_id"`
+	DefinitionID int      `json:"definition_id"`
+	Repository   string   `json:"repository"` // owner/repo, без учёта регистра
+	Branch       string   `json:"branch"`     // * - любая ветка, иначе шаблон path.Match (release/*)
+	Events       []string `json:"events"`
+	Secret       string   `json:"secret,omitempty"` // принимается при создании, в ответах не возвращается
+	Enabled      bool     `json:"enabled"`
+	CreatedAt    string   `json:"created_at"`
+}
+
+// Событие git-сервера, приведённое к общему виду
+type gitEvent struct {
+	Provider   string // github, gitlab или gitea
+	Kind       string // push или merge_request
+	Repository string
+	Branch     string // для merge request - исходная ветка
+	CommitSHA  string
+	Author     string
+}
+
+func (t *PipelineTrigger) matches(event *gitEvent) bool {
+	if !strings.EqualFold(t.Repository, event.Repository) || !containsString(t.Events, event.Kind) {
+		return false
+	}
+	if t.Branch == "*" {
+		return true
+	}
+	matched, _ := path.Match(t.Branch, event.Branch)
+	return matched
+}
+
+// Входящий webhook git-сервера: POST /api/git/webhook.
+// Источник определяется по заголовкам X-GitHub-Event, X-Gitlab-Event и X-Gitea-Event,
+// подпись проверяется секретом каждого подходящего триггера
+func gitWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	provider, eventName := gitWebhookSource(r)
+	if provider == "" {
+		http.Error(w, "Неизвестный источник webhook: нужен заголовок X-GitHub-Event, X-Gitlab-Event или X-Gitea-Event", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		http.Error(w, "Ошибка чтения тела запроса", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxWebhookBody {
+		http.Error(w, "Слишком большое тело webhook", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	event, err := parseGitEvent(provider, eventName, body)
+	if err != nil {
+		http.Error(w, "Некорректный webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if event == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": fmt.Sprintf("Событие %s %q не запускает пайплайны", provider, eventName),
+		})
+		return
+	}
+
+	triggers, err := loadTriggers(`WHERE enabled AND LOWER(repository) = LOWER($1)`, event.Repository)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var matched, verified []PipelineTrigger
+	for _, trigger := range triggers {
+		if !trigger.matches(event) {
+			continue
+		}
+		matched = append(matched, trigger)
+		if verifyGitSignature(provider, r.Header, body, trigger.Secret) {
+			verified = append(verified, trigger)
+		}
+	}
+	if len(matched) > 0 && len(verified) == 0 {
+		http.Error(w, "Неверная подпись webhook", http.StatusUnauthorized)
+		return
+	}
+
+	runs := []map[string]interface{}{}
+	failures := []map[string]interface{}{}
+	for _, trigger := range verified {
+		pipelineID, runNumber, err := runTrigger(&trigger, event)
+		if err != nil {
+			log.Printf("Ошибка запуска по триггеру %d: %v", trigger.TriggerID, err)
+			failures = append(failures, map[string]interface{}{
+				"trigger_id":    trigger.TriggerID,
+				"definition_id": trigger.DefinitionID,
+				"error":         err.Error(),
+			})
+			continue
+		}
+		runs = append(runs, map[string]interface{}{
+			"trigger_id":    trigger.TriggerID,
+			"definition_id": trigger.DefinitionID,
+			"pipeline_id":   pipelineID,
+			"run_number":    runNumber,
+		})
+	}
+
+	status := http.StatusOK
+	if len(runs) > 0 {
+		status = http.StatusAccepted
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    fmt.Sprintf("Запущено пайплайнов: %d", len(runs)),
+		"repository": event.Repository,
+		"branch":     event.Branch,
+		"commit_sha": event.CommitSHA,
+		"pipelines":  runs,
+		"errors":     failures,
+	})
+}
+
+// Источник и имя события webhook. Gitea дублирует заголовки GitHub, поэтому проверяется первой
+func gitWebhookSource(r *http.Request) (string, string) {
+	if event := r.Header.Get("X-Gitea-Event"); event != "" {
+		return "gitea", event
+	}
+	if event := r.Header.Get("X-Gitlab-Event"); event != "" {
+		return "gitlab", event
+	}
+	if event := r.Header.Get("X-GitHub-Event"); event != "" {
+		return "github", event
+	}
+	return "", ""
+}
+
+// Проверка подписи webhook:
+//   - GitHub: X-Hub-Signature-256 = sha256=<HMAC-SHA256 тела в hex>;
+//   - Gitea: X-Gitea-Signature = <HMAC-SHA256 тела в hex>;
+//   - GitLab: webhook-signature (Standard Webhooks, HMAC-SHA256 от "id.timestamp.тело" в base64,
+//     Webhook-Timestamp не дальше gitWebhookTolerance от текущего времени),
+//     а без неё - совпадение X-Gitlab-Token с секретом
+func verifyGitSignature(provider string, header http.Header, body []byte, secret string) bool {
+	switch provider {
+	case "github":
+		signature := header.Get("X-Hub-Signature-256")
+		return strings.HasPrefix(signature, "sha256=") && hmacHexEqual(secret, body, strings.TrimPrefix(signature, "sha256="))
+	case "gitea":
+		return hmacHexEqual(secret, body, header.Get("X-Gitea-Signature"))
+	case "gitlab":
+		signatures := header.Get("Webhook-Signature")
+		if signatures == "" {
+			token := header.Get("X-Gitlab-Token")
+			return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+		}
+		timestamp, err := strconv.ParseInt(header.Get("Webhook-Timestamp"), 10, 64)
+		if err != nil {
+			return false
+		}
+		if age := time.Since(time.Unix(timestamp, 0)); age > gitWebhookTolerance || age < -gitWebhookTolerance {
+			return false
+		}
+		key := []byte(secret)
+		if strings.HasPrefix(secret, "whsec_") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "whsec_"))
+			if err != nil {
+				return false
+			}
+			key = decoded
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(header.Get("Webhook-Id") + "." + header.Get("Webhook-Timestamp") + "."))
+		mac.Write(body)
+		expected := mac.Sum(nil)
+		// Заголовок может содержать несколько подписей через пробел: v1,<base64> v1,<base64>
+		for _, signature := range strings.Fields(signatures) {
+			value, ok := strings.CutPrefix(signature, "v1,")
+			if !ok {
+				continue
+			}
+			if decoded, err := base64.StdEncoding.DecodeString(value); err == nil && hmac.Equal(decoded, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hmacHexEqual(secret string, body []byte, signature string) bool {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || len(decoded) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
+
+// Тело push и pull_request GitHub и Gitea: форматы почти совпадают
+type githubWebhookPayload struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Action     string `json:"action"`
+	HeadCommit *struct {
+		ID     string `json:"id"`
+		Author struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		} `json:"author"`
+	} `json:"head_commit"`
+	Pusher struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	PullRequest *struct {
+		Head struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"head"`
+		User struct {
+			Login    string `json:"login"`
+			Username string `json:"username"`
+		} `json:"user"`
+	} `json:"pull_request"`
+}
+
+// Тело Push Hook и Merge Request Hook GitLab
+type gitlabWebhookPayload struct {
+	ObjectKind   string `json:"object_kind"`
+	Ref          string `json:"ref"`
+	CheckoutSha  string `json:"checkout_sha"`
+	UserName     string `json:"user_name"`
+	UserUsername string `json:"user_username"`
+	Project      struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	Commits []struct {
+		ID     string `json:"id"`
+		Author struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	User struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		Action       string `json:"action"`
+		SourceBranch string `json:"source_branch"`
+		LastCommit   struct {
+			ID     string `json:"id"`
+			Author struct {
+				Name string `json:"name"`
+			} `json:"author"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// Действия с pull/merge request, после которых нужен запуск; закрытие, метки и т.п. пропускаются
+var mergeRequestActions = map[string]bool{
+	"opened": true, "reopened": true, "synchronize": true, "synchronized": true, // GitHub, Gitea
+	"open": true, "reopen": true, "update": true, // GitLab
+}
+
+// Разбор тела webhook. nil без ошибки - событие не должно запускать пайплайны
+// (ping, теги, удаление ветки, закрытие merge request)
+func parseGitEvent(provider, eventName string, body []byte) (*gitEvent, error) {
+	if provider == "gitlab" {
+		return parseGitLabEvent(body)
+	}
+	if eventName != "push" && eventName != "pull_request" {
+		return nil, nil
+	}
+
+	var payload githubWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Repository.FullName == "" {
+		return nil, fmt.Errorf("не указан repository.full_name")
+	}
+	event := &gitEvent{Provider: provider, Repository: payload.Repository.FullName}
+
+	if eventName == "pull_request" {
+		if payload.PullRequest == nil || !mergeRequestActions[payload.Action] {
+			return nil, nil
+		}
+		event.Kind = "merge_request"
+		event.Branch = payload.PullRequest.Head.Ref
+		event.CommitSHA = payload.PullRequest.Head.Sha
+		event.Author = firstNonEmpty(payload.PullRequest.User.Login, payload.PullRequest.User.Username)
+		return event, nil
+	}
+
+	branch, ok := strings.CutPrefix(payload.Ref, "refs/heads/")
+	if !ok || payload.Deleted || isZeroSHA(payload.After) {
+		return nil, nil
+	}
+	event.Kind = "push"
+	event.Branch = branch
+	event.CommitSHA = payload.After
+	event.Author = firstNonEmpty(payload.Pusher.Login, payload.Pusher.Username, payload.Pusher.Name)
+	if payload.HeadCommit != nil {
+		event.CommitSHA = firstNonEmpty(payload.HeadCommit.ID, event.CommitSHA)
+		event.Author = firstNonEmpty(payload.HeadCommit.Author.Username, payload.HeadCommit.Author.Name, event.Author)
+	}
+	return event, nil
+}
+
+func parseGitLabEvent(body []byte) (*gitEvent, error) {
+	var payload gitlabWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Project.PathWithNamespace == "" {
+		return nil, fmt.Errorf("не указан project.path_with_namespace")
+	}
+	event := &gitEvent{Provider: "gitlab", Repository: payload.Project.PathWithNamespace}
+
+	switch payload.ObjectKind {
+	case "push":
+		branch, ok := strings.CutPrefix(payload.Ref, "refs/heads/")
+		if !ok || isZeroSHA(payload.CheckoutSha) {
+			return nil, nil
+		}
+		event.Kind = "push"
+		event.Branch = branch
+		event.CommitSHA = payload.CheckoutSha
+		event.Author = firstNonEmpty(payload.UserUsername, payload.UserName)
+		for _, commit := range payload.Commits {
+			if commit.ID == payload.CheckoutSha && commit.Author.Name != "" {
+				event.Author = commit.Author.Name
+			}
+		}
+	case "merge_request":
+		if !mergeRequestActions[payload.ObjectAttributes.Action] {
+			return nil, nil
+		}
+		event.Kind = "merge_request"
+		event.Branch = payload.ObjectAttributes.SourceBranch
+		event.CommitSHA = payload.ObjectAttributes.LastCommit.ID
+		event.Author = firstNonEmpty(payload.User.Username, payload.ObjectAttributes.LastCommit.Author.Name)
+	default:
+		return nil, nil
+	}
+	return event, nil
+}
+
+// Удаление ветки приходит как push с нулевым SHA
+func isZeroSHA(sha string) bool {
+	return strings.Trim(sha, "0") == ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Создание и старт запуска определения по событию git; ветка, коммит и автор сохраняются в запуске
+func runTrigger(trigger *PipelineTrigger, event *gitEvent) (int, int, error) {
+	yamlData, version, err := loadDefinitionVersion(db, trigger.DefinitionID, 0, nil)
+	if err == sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("у определения %d нет версий", trigger.DefinitionID)
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	var pipelineID, runNumber int
+	err = withTx(func(tx *sql.Tx) error {
+		var err error
+		pipelineID, err = createPipelineRun(tx, yamlData, trigger.DefinitionID, version, true)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(`
+            UPDATE pipeline SET trigger_id = $1, branch = $2, commit_sha = $3, commit_author = $4
+            WHERE pipeline_id = $5 RETURNING run_number`,
+			trigger.TriggerID, event.Branch, event.CommitSHA, nilIfEmpty(event.Author), pipelineID).Scan(&runNumber)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sendPipelineUpdate(pipelineID)
+	if err := startPipelineExecution(pipelineID, false); err != nil {
+		return pipelineID, runNumber, err
+	}
+	return pipelineID, runNumber, nil
+}
+
+// Триггеры определения: GET /api/definition/{definition_id}/triggers
+func getDefinitionTriggersHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	triggers, err := loadTriggers(`WHERE definition_id = $1`, definitionID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for i := range triggers {
+		triggers[i].Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(triggers)
+}
+
+// Создание триггера: POST /api/definition/{definition_id}/triggers
+// {"repository": "team/app", "branch": "main", "events": ["push"], "secret": "..."}
+func createTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	definitionID, err := strconv.Atoi(mux.Vars(r)["definition_id"])
+	if err != nil {
+		http.Error(w, "Некорректный definition_id", http.StatusBadRequest)
+		return
+	}
+	var trigger PipelineTrigger
+	if err := json.NewDecoder(r.Body).Decode(&trigger); err != nil {
+		http.Error(w, "Неверные данные", http.StatusBadRequest)
+		return
+	}
+	trigger.DefinitionID = definitionID
+	if err := validateTrigger(&trigger); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = db.QueryRow(`
+        INSERT INTO pipeline_trigger (definition_id, repository, branch, events, secret)
+        SELECT definition_id, $2, $3, $4, $5 FROM pipeline_definition WHERE definition_id = $1
+        RETURNING trigger_id, enabled`,
+		definitionID, trigger.Repository, trigger.Branch, pqStringArray(trigger.Events), trigger.Secret).Scan(&trigger.TriggerID, &trigger.Enabled)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Определение не найдено", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка создания триггера", http.StatusInternalServerError)
+		return
+	}
+
+	trigger.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(trigger)
+}
+
+// Изменение триггера: POST /api/trigger/{trigger_id}/update с полями как при создании
+// и enabled; не переданные поля, в том числе secret, остаются прежними.
+// {"enabled": false} выключает триггер без удаления
+func updateTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	triggerID, err := strconv.Atoi(mux.Vars(r)["trigger_id"])
+	if err != nil {
+		http.Error(w, "Некорректный trigger_id", http.StatusBadRequest)
+		return
+	}
+	triggers, err := loadTriggers(`WHERE trigger_id = $1`, triggerID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if len(triggers) == 0 {
+		http.Error(w, "Триггер не найден", http.StatusNotFound)
+		return
+	}
+	trigger := triggers[0]
+	if err := json.NewDecoder(r.Body).Decode(&trigger); err != nil {
+		http.Error(w, "Неверные данные", http.StatusBadRequest)
+		return
+	}
+	trigger.TriggerID, trigger.DefinitionID, trigger.CreatedAt = triggers[0].TriggerID, triggers[0].DefinitionID, triggers[0].CreatedAt
+	if err := validateTrigger(&trigger); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`
+        UPDATE pipeline_trigger
+        SET repository = $1, branch = $2, events = $3, secret = $4, enabled = $5
+        WHERE trigger_id = $6`,
+		trigger.Repository, trigger.Branch, pqStringArray(trigger.Events), trigger.Secret, trigger.Enabled, triggerID)
+	if err != nil {
+		http.Error(w, "Ошибка изменения триггера", http.StatusInternalServerError)
+		return
+	}
+
+	trigger.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trigger)
+}
+
+// Проверка и нормализация полей триггера перед записью
+func validateTrigger(trigger *PipelineTrigger) error {
+	trigger.Repository = strings.Trim(strings.TrimSpace(trigger.Repository), "/")
+	if trigger.Repository == "" || trigger.Secret == "" {
+		return fmt.Errorf("Нужны поля repository и secret")
+	}
+	if trigger.Branch == "" {
+		trigger.Branch = "*"
+	}
+	if _, err := path.Match(trigger.Branch, ""); err != nil {
+		return fmt.Errorf("Некорректный шаблон ветки %q", trigger.Branch)
+	}
+	if len(trigger.Events) == 0 {
+		trigger.Events = []string{"push", "merge_request"}
+	}
+	for _, event := range trigger.Events {
+		if !gitTriggerEvents[event] {
+			return fmt.Errorf("Неизвестное событие %q: допустимы push и merge_request", event)
+		}
+	}
+	return nil
+}
+
+// Удаление триггера: DELETE /api/trigger/{trigger_id}; созданные им запуски остаются
+func deleteTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	triggerID, err := strconv.Atoi(mux.Vars(r)["trigger_id"])
+	if err != nil {
+		http.Error(w, "Некорректный trigger_id", http.StatusBadRequest)
+		return
+	}
+	result, err := db.Exec(`DELETE FROM pipeline_trigger WHERE trigger_id = $1`, triggerID)
+	if err != nil {
+		http.Error(w, "Ошибка удаления триггера", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Триггер не найден", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func loadTriggers(where string, args ...interface{}) ([]PipelineTrigger, error) {
+	rows, err := db.Query(`
+        SELECT trigger_id, definition_id, repository, branch, events, secret, enabled, created_at
+        FROM pipeline_trigger `+where+` ORDER BY trigger_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	triggers := []PipelineTrigger{}
+	for rows.Next() {
+		var trigger PipelineTrigger
+		var events pq.StringArray
+		var createdAt sql.NullTime
+		if err := rows.Scan(&trigger.TriggerID, &trigger.DefinitionID, &trigger.Repository, &trigger.Branch,
+			&events, &trigger.Secret, &trigger.Enabled, &createdAt); err != nil {
+			return nil, err
+		}
+		trigger.Events = []string(events)
+		trigger.CreatedAt = formatTime(createdAt)
+		triggers = append(triggers, trigger)
+	}
+	return triggers, rows.Err()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Подпись GitLab принимается только со свежим Webhook-Timestamp
+func TestVerifyGitSignatureGitLabTimestamp(t *testing.T) {
+	secret := "whsec_" + base64.StdEncoding.EncodeToString([]byte("secret"))
+	body := []byte(`{"object_kind":"push"}`)
+	signed := func(at time.Time) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte("msg_1." + timestamp + "."))
+		mac.Write(body)
+		header := http.Header{}
+		header.Set("Webhook-Id", "msg_1")
+		header.Set("Webhook-Timestamp", timestamp)
+		header.Set("Webhook-Signature", "v1,"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		return header
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"свежая", signed(time.Now()), true},
+		{"в пределах допуска", signed(time.Now().Add(-gitWebhookTolerance + time.Minute)), true},
+		{"старая", signed(time.Now().Add(-gitWebhookTolerance - time.Minute)), false},
+		{"из будущего", signed(time.Now().Add(gitWebhookTolerance + time.Minute)), false},
+	}
+	for _, tt := range tests {
+		if got := verifyGitSignature("gitlab", tt.header, body, secret); got != tt.want {
+			t.Errorf("%s: %v, ожидалось %v", tt.name, got, tt.want)
+		}
+	}
+
+	header := signed(time.Now())
+	header.Del("Webhook-Timestamp")
+	if verifyGitSignature("gitlab", header, body, secret) {
+		t.Error("подпись без Webhook-Timestamp принята")
+	}
+	header = signed(time.Now())
+	header.Set("Webhook-Timestamp", strconv.FormatInt(time.Now().Unix()+1, 10))
+	if verifyGitSignature("gitlab", header, body, secret) {
+		t.Error("подпись с подменённым Webhook-Timestamp принята")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Выдача токена пользователя: POST /api/user/{user_id}/token с заголовком X-Admin-Token,
+// равным переменной окружения ADMIN_TOKEN. Без ADMIN_TOKEN выдача отключена.
+// Новый токен заменяет прежний; в базе хранится только его SHA-256
+func issueUserTokenHandler(w http.ResponseWriter, r *http.Request) {
+	expected := os.Getenv("ADMIN_TOKEN")
+	if expected == "" {
+		http.Error(w, "Выдача токенов отключена: не задан ADMIN_TOKEN", http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(expected)) != 1 {
+		http.Error(w, "Неверный токен администратора", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Некорректный user_id", http.StatusBadRequest)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "Ошибка создания токена", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := db.Exec(`UPDATE "user" SET api_token_hash = $1 WHERE user_id = $2`, hashToken(token), userID)
+	if err != nil {
+		http.Error(w, "Ошибка сохранения токена", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		return
+	}
+	log.Printf("Выдан токен пользователю %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"token":   token,
+	})
+}
+
+// Пользователь по токену из заголовка Authorization: Bearer <token>.
+// Возвращает идентификатор и имя пользователя; при ошибке ответ уже отправлен
+func authenticateUser(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		http.Error(w, "Нужен токен пользователя в заголовке Authorization", http.StatusUnauthorized)
+		return 0, "", false
+	}
+
+	var userID int
+	var username string
+	err := db.QueryRow(`SELECT user_id, username FROM "user" WHERE api_token_hash = $1`, hashToken(token)).Scan(&userID, &username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Неверный токен пользователя", http.StatusUnauthorized)
+		return 0, "", false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, "", false
+	}
+	return userID, username, true
+}
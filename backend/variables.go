@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Подстановка ${VAR}; $${VAR} оставляет ${VAR} как есть
+var yamlVariablePattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Допустимое имя переменной пайплайна
+var yamlVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Префикс параметров запроса и формы, переопределяющих переменные: var.ENV=prod
+const variableOverridePrefix = "var."
+
+// Поля задачи, в которых подставляются переменные. В command и script неизвестные
+// ${VAR} остаются без изменений - это переменные окружения оболочки
+var yamlInterpolatedTaskFields = map[string]bool{
+	"name":        true,
+	"description": true,
+	"depends_on":  true,
+	"tags":        true,
+	"runs_on":     true,
+	"command":     false,
+	"script":      false,
+}
+
+// Переопределения переменных из параметров запроса и полей формы
+func variableOverrides(r *http.Request) map[string]string {
+	if err := r.ParseForm(); err != nil {
+		return nil
+	}
+	overrides := make(map[string]string)
+	for key, values := range r.Form {
+		if strings.HasPrefix(key, variableOverridePrefix) && len(values) > 0 {
+			overrides[strings.TrimPrefix(key, variableOverridePrefix)] = values[len(values)-1]
+		}
+	}
+	return overrides
+}
+
+// Подстановка переменных в узлы документа до декодирования, чтобы ошибки
+// указывали на строку исходного YAML. Переопределения заменяют значения в
+// pipeline.variables, поэтому в результате разбора видны фактические значения
+func (v *yamlValidator) interpolateVariables(document *yaml.Node, overrides map[string]string) {
+	pipeline := mappingValue(document, "pipeline")
+	if pipeline == nil {
+		return
+	}
+
+	values := make(map[string]string)
+	variables := mappingValue(pipeline, "variables")
+	if variables != nil && variables.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(variables.Content); i += 2 {
+			key, value := variables.Content[i], variables.Content[i+1]
+			if !yamlVariableName.MatchString(key.Value) {
+				v.add(key, "pipeline.variables."+key.Value, yamlErrInvalidValue,
+					fmt.Sprintf("некорректное имя переменной %q", key.Value))
+				continue
+			}
+			if override, ok := overrides[key.Value]; ok {
+				value.Value, value.Tag, value.Style = override, "!!str", 0
+			}
+			values[key.Value] = value.Value
+		}
+	}
+	for name := range overrides {
+		if _, ok := values[name]; !ok {
+			v.add(nil, "pipeline.variables."+name, yamlErrUnknownVariable,
+				fmt.Sprintf("переменная %q из параметра %s%s не объявлена в pipeline.variables", name, variableOverridePrefix, name))
+		}
+	}
+
+	tasks := mappingValue(pipeline, "tasks")
+	if tasks == nil || tasks.Kind != yaml.SequenceNode {
+		return
+	}
+	for i, task := range tasks.Content {
+		if task.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(task.Content); j += 2 {
+			field, value := task.Content[j].Value, task.Content[j+1]
+			strict, ok := yamlInterpolatedTaskFields[field]
+			if !ok {
+				continue
+			}
+			path := fmt.Sprintf("pipeline.tasks[%d].%s", i, field)
+			if value.Kind == yaml.SequenceNode {
+				for _, item := range value.Content {
+					v.interpolateNode(item, path, values, strict)
+				}
+			} else {
+				v.interpolateNode(value, path, values, strict)
+			}
+		}
+	}
+}
+
+func (v *yamlValidator) interpolateNode(node *yaml.Node, path string, values map[string]string, strict bool) {
+	if node.Kind != yaml.ScalarNode || !strings.Contains(node.Value, "${") {
+		return
+	}
+	var missing []string
+	node.Value, missing = expandVariables(node.Value, values)
+	if strict {
+		for _, name := range missing {
+			v.add(node, path, yamlErrUnknownVariable, fmt.Sprintf("переменная %q не объявлена в pipeline.variables", name))
+		}
+	}
+	node.Tag = "!!str"
+}
+
+// Подстановка ${VAR} в строку; возвращает также имена необъявленных переменных,
+// которые остаются без изменений
+func expandVariables(value string, values map[string]string) (string, []string) {
+	var missing []string
+	value = yamlVariablePattern.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		missing = append(missing, name)
+		return match
+	})
+	return value, missing
+}
+
+// Значения для колонок JSONB (pipeline.variables, task.matrix_values), NULL если значений нет
+func stringMapJSON(values map[string]string) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// Экранирование всех ${VAR} при экспорте уже подставленных значений: после
+// подстановки в строке остаются только литералы, и повторный импорт должен
+// вернуть их как есть, даже если такая переменная потом появится в variables
+func escapeVariables(value string) string {
+	return yamlVariablePattern.ReplaceAllStringFunc(value, func(match string) string {
+		return "$" + match
+	})
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// Сколько раз пытаться доставить событие, прежде чем считать доставку неудачной
+	webhookMaxAttempts = 6
+	// Пауза перед первым повтором, дальше удваивается: 10s, 20s, 40s...
+	webhookRetryDelay = 10 * time.Second
+	// Как часто проверять доставки, у которых подошло время повтора
+	webhookPollInterval = 5 * time.Second
+	// Одновременные запросы к получателям
+	webhookConcurrency = 4
+	// Сколько байт ответа получателя сохранять в журнале доставок
+	webhookResponseLimit = 2048
+)
+
+// События broadcast, на которые можно подписаться
+var webhookEvents = map[string]bool{
+	"update_task":     true,
+	"update_pipeline": true,
+	"delete_task":     true,
+	"delete_pipeline": true,
+}
+
+// Статусы задач и пайплайнов для фильтра подписки
+var webhookStatuses = map[string]bool{
+	"Pending": true, "Running": true, "WaitingForApproval": true, "Paused": true,
+	"Completed": true, "Failed": true, "TimedOut": true, "Skipped": true, "Cancelled": true,
+}
+
+var (
+	// События для исходящих webhook; канал с буфером, чтобы рассылка по WebSocket не ждала базу
+	webhookQueue = make(chan map[string]interface{}, 1000)
+	// Сигнал доставщику, что появились новые доставки
+	webhookWake = make(chan struct{}, 1)
+
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Подписка на события: пустой фильтр пропускает всё
+type WebhookSubscription struct {
+	SubscriptionID int      `json:"subscription_id"`
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret,omitempty"` // ключ подписи HMAC, в ответах не возвращается
+	Events         []string `json:"events"`
+	PipelineIDs    []int    `json:"pipeline_ids"`
+	Statuses       []string `json:"statuses"`
+	Enabled        bool     `json:"enabled"`
+	CreatedAt      string   `json:"created_at"`
+}
+
+// Запись журнала доставок
+type WebhookDelivery struct {
+	DeliveryID     int             `json:"delivery_id"`
+	SubscriptionID int             `json:"subscription_id"`
+	Event          string          `json:"event"`
+	PipelineID     *int            `json:"pipeline_id"`
+	Status         string          `json:"status"` // Pending, Delivered или Failed
+	Attempts       int             `json:"attempts"`
+	ResponseCode   *int            `json:"response_code"`
+	ResponseBody   string          `json:"response_body,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	RedeliveryOf   *int            `json:"redelivery_of,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+	DeliveredAt    string          `json:"delivered_at"`
+}
+
+// Передача события broadcast на доставку подписчикам; если очередь переполнена, событие теряется
+func queueWebhookEvent(message map[string]interface{}) {
+	select {
+	case webhookQueue <- message:
+	default:
+		log.Printf("Очередь webhook переполнена, событие %v не будет доставлено", message["action"])
+	}
+}
+
+// Фоновая горутина: события из очереди превращаются в записи журнала доставок
+// для всех подходящих подписок. update_pipeline и update_task рассылаются после
+// любого изменения (в том числе при каждом обновлении задачи пайплайна), поэтому
+// подписка с фильтром по статусам получает событие, только когда статус пайплайна
+// или задачи действительно сменился на один из указанных
+func runWebhookDispatcher() {
+	for message := range webhookQueue {
+		info, err := webhookEventInfo(message)
+		if err != nil {
+			log.Printf("Ошибка подготовки webhook %v: %v", message["action"], err)
+			continue
+		}
+		if !webhookEvents[info.Event] {
+			continue
+		}
+		statusChanged, err := webhookStatusChanged(info)
+		if err != nil {
+			log.Printf("Ошибка проверки смены статуса для webhook %s: %v", info.Event, err)
+			continue
+		}
+		result, err := db.Exec(`
+            INSERT INTO webhook_delivery (subscription_id, event, pipeline_id, payload)
+            SELECT subscription_id, $1, $2, $4 FROM webhook_subscription
+            WHERE enabled
+              AND (cardinality(events) = 0 OR $1 = ANY(events))
+              AND (cardinality(pipeline_ids) = 0 OR $2 = ANY(pipeline_ids))
+              AND (cardinality(statuses) = 0 OR ($5 AND $3 = ANY(statuses)))`,
+			info.Event, nilIfZero(info.PipelineID), info.Status, string(info.Payload), statusChanged)
+		if err != nil {
+			log.Printf("Ошибка создания доставок webhook: %v", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			wakeWebhookDelivery()
+		}
+	}
+}
+
+// Событие broadcast, подготовленное к доставке
+type webhookEvent struct {
+	Event      string
+	PipelineID int
+	TaskID     int // задача, чей статус несёт событие; 0 - статус пайплайна
+	Status     string
+	Payload    []byte
+}
+
+// Сменился ли статус с прошлого события того же пайплайна или задачи. Последний статус
+// хранится в самой записи (webhook_status): он переживает перезапуск сервера
+// и удаляется вместе с пайплайном или задачей
+func webhookStatusChanged(info webhookEvent) (bool, error) {
+	var result sql.Result
+	var err error
+	switch {
+	case info.Event == "delete_task" || info.Event == "delete_pipeline":
+		return true, nil
+	case info.TaskID > 0:
+		result, err = db.Exec(`
+            UPDATE task SET webhook_status = $1
+            WHERE task_id = $2 AND webhook_status IS DISTINCT FROM $1`, nilIfEmpty(info.Status), info.TaskID)
+	case info.PipelineID > 0:
+		result, err = db.Exec(`
+            UPDATE pipeline SET webhook_status = $1
+            WHERE pipeline_id = $2 AND webhook_status IS DISTINCT FROM $1`, nilIfEmpty(info.Status), info.PipelineID)
+	default:
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Событие, пайплайн и статус из сообщения broadcast. Сообщения бывают и структурами,
+// и map, поэтому разбираются после преобразования в JSON. Тело доставки:
+// {"event": ..., "pipeline_id": ..., "status": ..., "timestamp": ..., "data": <сообщение>}
+func webhookEventInfo(message map[string]interface{}) (webhookEvent, error) {
+	var info webhookEvent
+	data, err := json.Marshal(message)
+	if err != nil {
+		return info, err
+	}
+	var generic map[string]interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return info, err
+	}
+
+	event, _ := generic["action"].(string)
+	pipelineID := jsonInt(generic["pipeline_id"])
+	taskID := jsonInt(generic["task_id"])
+	status := ""
+	for _, key := range []string{"pipeline", "task"} {
+		object, ok := generic[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if pipelineID == 0 {
+			pipelineID = jsonInt(object["pipeline_id"])
+		}
+		if value, ok := object["status"].(string); ok && status == "" {
+			status = value
+		}
+		if key == "task" && taskID == 0 {
+			taskID = jsonInt(object["task_id"])
+		}
+		// В части сообщений update_task нет pipeline_id, он берётся из базы
+		if key == "task" && pipelineID == 0 && taskID > 0 {
+			db.QueryRow(`SELECT pipeline_id FROM task WHERE task_id = $1`, taskID).Scan(&pipelineID)
+		}
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":       event,
+		"pipeline_id": nilIfZero(pipelineID),
+		"status":      nilIfEmpty(status),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"data":        json.RawMessage(data),
+	})
+	info.Event, info.PipelineID, info.TaskID, info.Status, info.Payload = event, pipelineID, taskID, status, payload
+	return info, err
+}
+
+func jsonInt(value interface{}) int {
+	if number, ok := value.(float64); ok {
+		return int(number)
+	}
+	return 0
+}
+
+func wakeWebhookDelivery() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// Фоновая горутина доставки: отправляет ожидающие доставки, у которых подошло время
+func runWebhookDelivery() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		deliverPendingWebhooks()
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+func deliverPendingWebhooks() {
+	rows, err := db.Query(`
+        SELECT d.delivery_id, d.event, d.payload, d.attempts, s.url, COALESCE(s.secret, '')
+        FROM webhook_delivery d
+        JOIN webhook_subscription s ON s.subscription_id = d.subscription_id
+        WHERE d.status = 'Pending' AND d.next_attempt_at <= NOW()
+        ORDER BY d.delivery_id
+        LIMIT 100`)
+	if err != nil {
+		log.Printf("Ошибка при получении доставок webhook: %v", err)
+		return
+	}
+	type pendingDelivery struct {
+		ID       int
+		Event    string
+		Payload  []byte
+		Attempts int
+		URL      string
+		Secret   string
+	}
+	var deliveries []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			log.Printf("Ошибка при сканировании доставки webhook: %v", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+
+	slots := make(chan struct{}, webhookConcurrency)
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(d pendingDelivery) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			code, body, err := sendWebhook(d.URL, d.Secret, d.ID, d.Event, d.Payload)
+			recordWebhookAttempt(d.ID, d.Attempts+1, code, body, err)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// Отправка тела доставки. Подпись: X-Pipeline-Signature-256 = sha256=<HMAC-SHA256 тела в hex>
+func sendWebhook(target, secret string, deliveryID int, event string, payload []byte) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ci-cd-visualizer-webhook")
+	req.Header.Set("X-Pipeline-Event", event)
+	req.Header.Set("X-Pipeline-Delivery", strconv.Itoa(deliveryID))
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		req.Header.Set("X-Pipeline-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, string(body), fmt.Errorf("получатель ответил %s", resp.Status)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// Сохранение результата попытки: успех, повтор с удвоенной паузой или окончательная неудача
+func recordWebhookAttempt(deliveryID, attempts, code int, body string, sendErr error) {
+	status := "Delivered"
+	var errText interface{}
+	delay := time.Duration(0)
+	if sendErr != nil {
+		errText = sendErr.Error()
+		status = "Failed"
+		if attempts < webhookMaxAttempts {
+			status = "Pending"
+			delay = webhookRetryDelay << uint(attempts-1)
+		}
+	}
+	_, err := db.Exec(`
+        UPDATE webhook_delivery
+        SET status = $1, attempts = $2, response_code = $3, response_body = $4, error = $5,
+            next_attempt_at = NOW() + make_interval(secs => $6),
+            delivered_at = CASE WHEN $1 = 'Delivered' THEN NOW() ELSE NULL END
+        WHERE delivery_id = $7`,
+		status, attempts, nilIfZero(code), nilIfEmpty(body), errText, delay.Seconds(), deliveryID)
+	if err != nil {
+		log.Printf("Ошибка сохранения доставки webhook %d: %v", deliveryID, err)
+	}
+}
+
+// Подписки: GET /api/webhooks
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := loadWebhookSubscriptions()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// Создание подписки: POST /api/webhooks
+// {"url": "https://bot.example.com/hook", "secret": "...", "events": ["update_pipeline"], "pipeline_ids": [1], "statuses": ["Failed"]}
+// С statuses событие доставляется, только когда статус пайплайна или задачи сменился на указанный
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var subscription WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Неверные данные", http.StatusBadRequest)
+		return
+	}
+	if target, err := url.Parse(subscription.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "Нужен url с http:// или https://", http.StatusBadRequest)
+		return
+	}
+	for _, event := range subscription.Events {
+		if !webhookEvents[event] {
+			http.Error(w, fmt.Sprintf("Неизвестное событие %q", event), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, status := range subscription.Statuses {
+		if !webhookStatuses[status] {
+			http.Error(w, fmt.Sprintf("Неизвестный статус %q", status), http.StatusBadRequest)
+			return
+		}
+	}
+	if subscription.PipelineIDs == nil {
+		subscription.PipelineIDs = []int{}
+	}
+
+	var createdAt sql.NullTime
+	err := db.QueryRow(`
+        INSERT INTO webhook_subscription (url, secret, events, pipeline_ids, statuses)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING subscription_id, enabled, created_at`,
+		subscription.URL, nilIfEmpty(subscription.Secret), pqArray(subscription.Events),
+		pq.Array(subscription.PipelineIDs), pqArray(subscription.Statuses)).Scan(
+		&subscription.SubscriptionID, &subscription.Enabled, &createdAt)
+	if err != nil {
+		http.Error(w, "Ошибка создания подписки", http.StatusInternalServerError)
+		return
+	}
+	subscription.CreatedAt = formatTime(createdAt)
+	subscription.Secret = ""
+	if subscription.Events == nil {
+		subscription.Events = []string{}
+	}
+	if subscription.Statuses == nil {
+		subscription.Statuses = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// Удаление подписки вместе с журналом доставок: DELETE /api/webhook/{subscription_id}
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["subscription_id"])
+	if err != nil {
+		http.Error(w, "Некорректный subscription_id", http.StatusBadRequest)
+		return
+	}
+	result, err := db.Exec(`DELETE FROM webhook_subscription WHERE subscription_id = $1`, subscriptionID)
+	if err != nil {
+		http.Error(w, "Ошибка удаления подписки", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Подписка не найдена", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Журнал доставок подписки, новые первыми: GET /api/webhook/{subscription_id}/deliveries?status=Failed&limit=50
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["subscription_id"])
+	if err != nil {
+		http.Error(w, "Некорректный subscription_id", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > 500 {
+			http.Error(w, "limit должен быть от 1 до 500", http.StatusBadRequest)
+			return
+		}
+	}
+	status := r.URL.Query().Get("status")
+
+	rows, err := db.Query(`
+        SELECT delivery_id, subscription_id, event, pipeline_id, status, attempts, response_code,
+               COALESCE(response_body, ''), COALESCE(error, ''), redelivery_of, payload, created_at, delivered_at
+        FROM webhook_delivery
+        WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+        ORDER BY delivery_id DESC
+        LIMIT $3`, subscriptionID, status, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var pipelineID, responseCode, redeliveryOf sql.NullInt32
+		var payload []byte
+		var createdAt, deliveredAt sql.NullTime
+		if err := rows.Scan(&d.DeliveryID, &d.SubscriptionID, &d.Event, &pipelineID, &d.Status, &d.Attempts, &responseCode,
+			&d.ResponseBody, &d.Error, &redeliveryOf, &payload, &createdAt, &deliveredAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		d.PipelineID = nullIntPtr(pipelineID)
+		d.ResponseCode = nullIntPtr(responseCode)
+		d.RedeliveryOf = nullIntPtr(redeliveryOf)
+		d.Payload = payload
+		d.CreatedAt = formatTime(createdAt)
+		d.DeliveredAt = formatTime(deliveredAt)
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// Повторная доставка: POST /api/webhook-delivery/{delivery_id}/redeliver.
+// Создаёт новую доставку с тем же телом, исходная запись журнала не меняется
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.Atoi(mux.Vars(r)["delivery_id"])
+	if err != nil {
+		http.Error(w, "Некорректный delivery_id", http.StatusBadRequest)
+		return
+	}
+	var newID int
+	err = db.QueryRow(`
+        INSERT INTO webhook_delivery (subscription_id, event, pipeline_id, payload, redelivery_of)
+        SELECT subscription_id, event, pipeline_id, payload, delivery_id
+        FROM webhook_delivery WHERE delivery_id = $1
+        RETURNING delivery_id`, deliveryID).Scan(&newID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Доставка не найдена", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка повторной доставки", http.StatusInternalServerError)
+		return
+	}
+	wakeWebhookDelivery()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Доставка поставлена в очередь",
+		"delivery_id":   newID,
+		"redelivery_of": deliveryID,
+	})
+}
+
+func loadWebhookSubscriptions() ([]WebhookSubscription, error) {
+	rows, err := db.Query(`
+        SELECT subscription_id, url, events, pipeline_ids, statuses, enabled, created_at
+        FROM webhook_subscription ORDER BY subscription_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []WebhookSubscription{}
+	for rows.Next() {
+		var s WebhookSubscription
+		var events, statuses pq.StringArray
+		var pipelineIDs pq.Int64Array
+		var createdAt sql.NullTime
+		if err := rows.Scan(&s.SubscriptionID, &s.URL, &events, &pipelineIDs, &statuses, &s.Enabled, &createdAt); err != nil {
+			return nil, err
+		}
+		s.Events = []string(events)
+		s.Statuses = []string(statuses)
+		s.PipelineIDs = make([]int, len(pipelineIDs))
+		for i, id := range pipelineIDs {
+			s.PipelineIDs[i] = int(id)
+		}
+		s.CreatedAt = formatTime(createdAt)
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
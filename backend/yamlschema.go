@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Машиночитаемые коды ошибок валидации YAML
+const (
+	yamlErrSyntax            = "syntax_error"
+	yamlErrUnknownField      = "unknown_field"
+	yamlErrInvalidType       = "invalid_type"
+	yamlErrRequired          = "required"
+	yamlErrTooLong           = "too_long"
+	yamlErrInvalidValue      = "invalid_value"
+	yamlErrOutOfRange        = "out_of_range"
+	yamlErrInvalidDuration   = "invalid_duration"
+	yamlErrDuplicateTask     = "duplicate_task_name"
+	yamlErrUnknownAssignee   = "unknown_assignee"
+	yamlErrUnknownDependency = "unknown_dependency"
+	yamlErrUnknownVariable   = "unknown_variable"
+	yamlErrUnknownInclude    = "unknown_include"
+	yamlErrIncludeCycle      = "include_cycle"
+	yamlErrUnknownTemplate   = "unknown_template"
+	yamlErrTemplateCycle     = "template_cycle"
+)
+
+// Одна проблема в YAML: позиция в файле, путь к полю и код ошибки
+type YamlIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Ошибка валидации YAML со всеми найденными проблемами
+type YamlValidationError struct {
+	Issues []YamlIssue `json:"issues"`
+}
+
+func (e *YamlValidationError) Error() string {
+	messages := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		messages[i] = fmt.Sprintf("%d:%d %s: %s", issue.Line, issue.Column, issue.Path, issue.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Вид значения поля в схеме YAML
+type yamlFieldKind int
+
+const (
+	yamlString yamlFieldKind = iota
+	yamlInt
+	yamlScalar     // строка или число, например длительность "30s" или 30
+	yamlScalarList // список скаляров
+	yamlTaskList   // список задач
+	yamlScalarMap  // объект со скалярными значениями
+	yamlNameList   // строка или список строк
+	yamlIncludes   // список include: имя определения или {definition, version}
+	yamlTemplates  // объект с шаблонами задач
+	yamlMatrix     // оси matrix: имя оси - значение или список значений
+)
+
+// Допустимые поля секции pipeline
+var yamlPipelineSchema = map[string]yamlFieldKind{
+	"name":         yamlString,
+	"description":  yamlString,
+	"max_parallel": yamlInt,
+	"timeout":      yamlScalar,
+	"variables":    yamlScalarMap,
+	"include":      yamlIncludes,
+	"templates":    yamlTemplates,
+	"tasks":        yamlTaskList,
+}
+
+// Допустимые поля задачи
+var yamlTaskSchema = map[string]yamlFieldKind{
+	"name":                yamlString,
+	"description":         yamlString,
+	"status":              yamlString,
+	"progress_percentage": yamlInt,
+	"depends_on":          yamlScalarList,
+	"assignee":            yamlString,
+	"tags":                yamlScalarList,
+	"command":             yamlString,
+	"script":              yamlString,
+	"retries":             yamlInt,
+	"retry_delay":         yamlScalar,
+	"retry_on":            yamlScalarList,
+	"timeout":             yamlScalar,
+	"type":                yamlString,
+	"approval_level":      yamlString,
+	"extends":             yamlNameList,
+	"matrix":              yamlMatrix,
+	"when":                yamlString,
+	"runs_on":             yamlScalarList,
+	"matrix_group":        yamlString,
+	"matrix_values":       yamlScalarMap,
+}
+
+// Допустимые поля элемента include
+var yamlIncludeSchema = map[string]yamlFieldKind{
+	"definition": yamlString,
+	"version":    yamlInt,
+}
+
+// Статусы задач, которые допускает CHECK в таблице task
+var yamlTaskStatuses = map[string]bool{
+	"Pending":            true,
+	"Running":            true,
+	"WaitingForApproval": true,
+	"Completed":          true,
+	"Failed":             true,
+	"TimedOut":           true,
+	"Skipped":            true,
+	"Cancelled":          true,
+}
+
+// Максимальная длина имён пайплайна и задачи (VARCHAR(100))
+const yamlMaxNameLength = 100
+
+// Сбор проблем валидации с позициями узлов YAML
+type yamlValidator struct {
+	issues []YamlIssue
+	nodes  map[string]*yaml.Node // узлы по пути поля для привязки семантических ошибок к строке
+
+	pinnedIncludes   map[string]int // закреплённые версии include без version
+	resolvedIncludes map[string]int // версии, в которые разрешились include без version
+}
+
+func (v *yamlValidator) add(node *yaml.Node, path, code, message string) {
+	issue := YamlIssue{Path: path, Code: code, Message: message}
+	if node != nil {
+		issue.Line, issue.Column = node.Line, node.Column
+	}
+	v.issues = append(v.issues, issue)
+}
+
+// Добавление проблемы по пути поля; позиция берётся у ближайшего известного узла
+func (v *yamlValidator) addAt(path, code, message string) {
+	for p := path; p != ""; p = parentYamlPath(p) {
+		if node, ok := v.nodes[p]; ok {
+			v.add(node, path, code, message)
+			return
+		}
+	}
+	v.add(nil, path, code, message)
+}
+
+func parentYamlPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i > 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// Строка и колонка в сообщении об ошибке синтаксиса YAML
+var yamlLinePattern = regexp.MustCompile(`line (\d+)(?::(\d+))?`)
+
+// Параметры разбора YAML пайплайна
+type yamlParseOptions struct {
+	KnownUsers  map[string]bool   // существующие пользователи для проверки assignee (nil - не проверять)
+	Overrides   map[string]string // значения, заменяющие объявленные в pipeline.variables
+	Definitions dbQuerier         // источник определений для include (nil - include недоступен)
+	// Версии для include без version, закреплённые при сохранении версии определения;
+	// без закрепления подключается последняя версия
+	IncludeVersions map[string]int
+}
+
+// Разбор и строгая проверка YAML пайплайна до записи в базу данных.
+// Возвращает *YamlValidationError со всеми найденными проблемами сразу
+func parsePipelineYAML(content []byte, options yamlParseOptions) (*YamlPipeline, error) {
+	v := &yamlValidator{
+		nodes:            make(map[string]*yaml.Node),
+		pinnedIncludes:   options.IncludeVersions,
+		resolvedIncludes: make(map[string]int),
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		issue := YamlIssue{Code: yamlErrSyntax, Message: err.Error()}
+		if m := yamlLinePattern.FindStringSubmatch(err.Error()); m != nil {
+			issue.Line, _ = strconv.Atoi(m[1])
+			issue.Column, _ = strconv.Atoi(m[2])
+		}
+		return nil, &YamlValidationError{Issues: []YamlIssue{issue}}
+	}
+	if len(root.Content) == 0 {
+		return nil, &YamlValidationError{Issues: []YamlIssue{{Line: 1, Column: 1, Path: "pipeline", Code: yamlErrRequired, Message: "файл пуст"}}}
+	}
+
+	document := root.Content[0]
+	v.expandIncludes(document, options.Definitions)
+	matrixTasks := v.expandMatrix(document)
+	v.checkDocument(document)
+	v.interpolateVariables(document, options.Overrides)
+
+	// Ошибки типов уже собраны обходом схемы, декодируем то, что удалось
+	var yamlData YamlPipeline
+	if err := document.Decode(&yamlData); err != nil {
+		if _, ok := err.(*yaml.TypeError); !ok {
+			v.add(document, "", yamlErrInvalidType, err.Error())
+		}
+	}
+
+	v.assignMatrixGroups(document, &yamlData, matrixTasks)
+	if len(v.resolvedIncludes) > 0 {
+		yamlData.IncludeVersions = v.resolvedIncludes
+	}
+	v.checkPipeline(&yamlData, options.KnownUsers)
+
+	if len(v.issues) > 0 {
+		sort.SliceStable(v.issues, func(i, j int) bool {
+			if v.issues[i].Line != v.issues[j].Line {
+				return v.issues[i].Line < v.issues[j].Line
+			}
+			return v.issues[i].Column < v.issues[j].Column
+		})
+		return &yamlData, &YamlValidationError{Issues: v.issues}
+	}
+	return &yamlData, nil
+}
+
+// Проверка структуры документа: известные поля и типы значений
+func (v *yamlValidator) checkDocument(document *yaml.Node) {
+	if document.Kind != yaml.MappingNode {
+		v.add(document, "", yamlErrInvalidType, "ожидается объект с ключом pipeline")
+		return
+	}
+
+	var pipeline *yaml.Node
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		key, value := document.Content[i], document.Content[i+1]
+		if key.Value != "pipeline" {
+			v.add(key, key.Value, yamlErrUnknownField, fmt.Sprintf("неизвестное поле %q", key.Value))
+			continue
+		}
+		pipeline = value
+	}
+	if pipeline == nil {
+		v.add(document, "pipeline", yamlErrRequired, "отсутствует секция pipeline")
+		return
+	}
+	v.checkMapping(pipeline, "pipeline", yamlPipelineSchema)
+}
+
+// Проверка полей объекта по схеме
+func (v *yamlValidator) checkMapping(node *yaml.Node, path string, schema map[string]yamlFieldKind) {
+	v.nodes[path] = node
+	if node.Kind != yaml.MappingNode {
+		v.add(node, path, yamlErrInvalidType, "ожидается объект")
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		fieldPath := path + "." + key.Value
+		kind, ok := schema[key.Value]
+		if !ok {
+			v.add(key, fieldPath, yamlErrUnknownField, fmt.Sprintf("неизвестное поле %q", key.Value))
+			continue
+		}
+		v.nodes[fieldPath] = value
+		v.checkValue(value, fieldPath, kind)
+	}
+}
+
+// Проверка типа значения поля
+func (v *yamlValidator) checkValue(node *yaml.Node, path string, kind yamlFieldKind) {
+	if node.Tag == "!!null" {
+		return
+	}
+	switch kind {
+	case yamlString, yamlScalar:
+		if node.Kind != yaml.ScalarNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается строка")
+		}
+	case yamlInt:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			v.add(node, path, yamlErrInvalidType, "ожидается целое число")
+		}
+	case yamlScalarList:
+		if node.Kind != yaml.SequenceNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается список")
+			return
+		}
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			v.nodes[itemPath] = item
+			if item.Kind != yaml.ScalarNode {
+				v.add(item, itemPath, yamlErrInvalidType, "ожидается строка")
+			}
+		}
+	case yamlScalarMap:
+		if node.Kind != yaml.MappingNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается объект")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			itemPath := path + "." + node.Content[i].Value
+			v.nodes[itemPath] = node.Content[i+1]
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				v.add(node.Content[i+1], itemPath, yamlErrInvalidType, "ожидается строка")
+			}
+		}
+	case yamlNameList:
+		if node.Kind == yaml.ScalarNode {
+			return
+		}
+		v.checkValue(node, path, yamlScalarList)
+	case yamlIncludes:
+		if node.Kind != yaml.SequenceNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается список определений")
+			return
+		}
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if item.Kind == yaml.ScalarNode {
+				v.nodes[itemPath] = item
+				continue
+			}
+			v.checkMapping(item, itemPath, yamlIncludeSchema)
+			if mappingValue(item, "definition") == nil {
+				v.add(item, itemPath+".definition", yamlErrRequired, "имя подключаемого определения обязательно")
+			}
+		}
+	case yamlTemplates:
+		if node.Kind != yaml.MappingNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается объект с шаблонами задач")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkMapping(node.Content[i+1], path+"."+node.Content[i].Value, yamlTaskSchema)
+		}
+	case yamlMatrix:
+		if node.Kind != yaml.MappingNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается объект с осями matrix")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkValue(node.Content[i+1], path+"."+node.Content[i].Value, yamlNameList)
+		}
+	case yamlTaskList:
+		if node.Kind != yaml.SequenceNode {
+			v.add(node, path, yamlErrInvalidType, "ожидается список задач")
+			return
+		}
+		for i, item := range node.Content {
+			v.checkMapping(item, fmt.Sprintf("%s[%d]", path, i), yamlTaskSchema)
+		}
+	}
+}
+
+// Семантические проверки значений: обязательные поля, допустимые значения, ссылки
+func (v *yamlValidator) checkPipeline(yamlData *YamlPipeline, knownUsers map[string]bool) {
+	p := yamlData.Pipeline
+	v.checkName(p.Name, "pipeline.name", "имя пайплайна")
+	if p.MaxParallel < 0 {
+		v.addAt("pipeline.max_parallel", yamlErrOutOfRange, "max_parallel не может быть отрицательным")
+	}
+	v.checkDuration(p.Timeout, "pipeline.timeout")
+
+	taskIndex := make(map[string]int)
+	for i, t := range p.Tasks {
+		path := fmt.Sprintf("pipeline.tasks[%d]", i)
+		v.checkName(t.Name, path+".name", "имя задачи")
+		if first, exists := taskIndex[t.Name]; exists && t.Name != "" {
+			v.addAt(path+".name", yamlErrDuplicateTask, fmt.Sprintf("задача %q уже объявлена в pipeline.tasks[%d]", t.Name, first))
+		} else {
+			taskIndex[t.Name] = i
+		}
+
+		if t.Status != "" && !yamlTaskStatuses[t.Status] {
+			v.addAt(path+".status", yamlErrInvalidValue, fmt.Sprintf("неизвестный статус %q", t.Status))
+		}
+		if t.Progress < 0 || t.Progress > 100 {
+			v.addAt(path+".progress_percentage", yamlErrOutOfRange, "progress_percentage должен быть от 0 до 100")
+		}
+		if t.Retries < 0 {
+			v.addAt(path+".retries", yamlErrOutOfRange, "retries не может быть отрицательным")
+		}
+		v.checkDuration(t.RetryDelay, path+".retry_delay")
+		v.checkDuration(t.Timeout, path+".timeout")
+		if t.Type != "" && t.Type != "command" && t.Type != "approval" {
+			v.addAt(path+".type", yamlErrInvalidValue, fmt.Sprintf("неизвестный тип задачи %q, допустимы command и approval", t.Type))
+		}
+		if _, ok := permissionRank[t.ApprovalLevel]; t.ApprovalLevel != "" && !ok {
+			v.addAt(path+".approval_level", yamlErrInvalidValue, fmt.Sprintf("неизвестный уровень доступа %q", t.ApprovalLevel))
+		}
+		if t.When != "" {
+			v.checkCondition(t, p.Variables, path+".when")
+		}
+		if t.Assignee != "" && knownUsers != nil && !knownUsers[t.Assignee] {
+			v.addAt(path+".assignee", yamlErrUnknownAssignee, fmt.Sprintf("пользователь %q не найден", t.Assignee))
+		}
+	}
+
+	v.checkDependencies(p.Tasks, taskIndex)
+}
+
+// Проверка условия when: синтаксис, объявленные переменные и задачи из depends_on
+func (v *yamlValidator) checkCondition(t YamlTask, variables map[string]string, path string) {
+	condition, err := parseCondition(t.When)
+	if err != nil {
+		v.addAt(path, yamlErrInvalidValue, fmt.Sprintf("некорректное условие %q: %v", t.When, err))
+		return
+	}
+	for _, name := range condition.Variables {
+		if _, ok := variables[name]; !ok {
+			v.addAt(path, yamlErrUnknownVariable, fmt.Sprintf("переменная %q не объявлена в pipeline.variables", name))
+		}
+	}
+	for _, name := range condition.Tasks {
+		if !containsString(t.DependsOn, name) {
+			v.addAt(path, yamlErrUnknownDependency, fmt.Sprintf("status(%q): задача не указана в depends_on", name))
+		}
+	}
+}
+
+func (v *yamlValidator) checkName(name, path, what string) {
+	if strings.TrimSpace(name) == "" {
+		v.addAt(path, yamlErrRequired, what+" обязательно")
+	} else if len([]rune(name)) > yamlMaxNameLength {
+		v.addAt(path, yamlErrTooLong, fmt.Sprintf("%s длиннее %d символов", what, yamlMaxNameLength))
+	}
+}
+
+func (v *yamlValidator) checkDuration(value, path string) {
+	if d, err := parseYamlDuration(value); err != nil {
+		v.addAt(path, yamlErrInvalidDuration, fmt.Sprintf("некорректная длительность %q, ожидается \"30s\", \"5m\" или число секунд", value))
+	} else if d < 0 {
+		v.addAt(path, yamlErrOutOfRange, "длительность не может быть отрицательной")
+	}
+}
+
+// Проверка ссылок depends_on и графа зависимостей. Задачам присваиваются
+// временные идентификаторы по их позиции в файле
+func (v *yamlValidator) checkDependencies(tasks []YamlTask, taskIndex map[string]int) {
+	g := newTaskGraph(0)
+	for i, t := range tasks {
+		g.addNode(graphNode{TaskID: i + 1, Name: t.Name, Order: i + 1})
+	}
+	for i, t := range tasks {
+		for j, depName := range t.DependsOn {
+			depIndex, ok := taskIndex[depName]
+			if !ok {
+				v.addAt(fmt.Sprintf("pipeline.tasks[%d].depends_on[%d]", i, j), yamlErrUnknownDependency,
+					fmt.Sprintf("задача %q ссылается на несуществующую задачу %q", t.Name, depName))
+				continue
+			}
+			g.addEdge(dependencyEdge{TaskID: i + 1, DependsOnID: depIndex + 1})
+		}
+	}
+
+	if err := g.validate(); err != nil {
+		for _, issue := range err.(*GraphValidationError).Issues {
+			path := "pipeline.tasks"
+			if len(issue.TaskIDs) > 0 {
+				path = fmt.Sprintf("pipeline.tasks[%d].depends_on", issue.TaskIDs[0]-1)
+			}
+			v.addAt(path, issue.Code, issue.Message)
+		}
+	}
+}
+
+// Список пользователей для проверки assignee
+func loadKnownUsers(q dbQuerier) (map[string]bool, error) {
+	rows, err := q.Query(`SELECT username FROM "user"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]bool)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		users[username] = true
+	}
+	return users, rows.Err()
+}
+
+// Ответ с ошибками валидации YAML: 400 и JSON со списком проблем
+func writeYamlValidationError(w http.ResponseWriter, err *YamlValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Ошибка валидации YAML",
+		"issues": err.Issues,
+	})
+}
@@ -39,6 +39,14 @@ function PipelineGraph({ pipelines, onDeleteTask }) {
         return 'red';
       case 'Completed':
         return 'green'; 
+      case 'TimedOut':
+        return 'darkorange';
+      case 'Skipped':
+        return 'silver';
+      case 'Cancelled':
+        return 'dimgray';
+      case 'WaitingForApproval':
+        return 'gold';
       default:
         return 'lightgray'; // Цвет по умолчанию
     }
@@ -82,6 +90,24 @@ function PipelineGraph({ pipelines, onDeleteTask }) {
               'pie-2-background-size': 'data(pie2Value)',
             },
           },
+          {
+            // группа задач, развёрнутых из одной задачи matrix
+            selector: ':parent',
+            style: {
+              'background-color': '#f5f5f5',
+              'background-opacity': 0.6,
+              'border-color': 'data(bgColor)',
+              'border-width': 2,
+              label: 'data(label)',
+              color: '#333',
+              'text-valign': 'top',
+              'text-halign': 'center',
+            },
+          },
+          {
+            selector: 'node.collapsed-child',
+            style: { display: 'none' },
+          },
           {
             selector: 'edge',
             style: {
@@ -110,6 +136,7 @@ function PipelineGraph({ pipelines, onDeleteTask }) {
       cyRef.current.on('mouseover', 'node', (event) => {
   const node = event.target;
   const taskInfo = node.data('taskInfo');
+  if (!taskInfo) return;
   const renderedPosition = node.renderedPosition();
 
   setTooltip({
@@ -132,7 +159,17 @@ function PipelineGraph({ pipelines, onDeleteTask }) {
 
       // Переход на страницу деталей задачи при двойном клике на узел
       cyRef.current.on('dblclick', 'node', (event) => {
-        const taskId = event.target.id().replace('task-', '');
+        const node = event.target;
+        // Двойной клик по группе matrix сворачивает или разворачивает её задачи
+        if (node.isParent() || node.data('isGroup')) {
+          const collapsed = !node.data('collapsed');
+          node.data('collapsed', collapsed);
+          cyRef.current
+            .nodes(`[parentGroup = "${node.id()}"]`)
+            .forEach((child) => (collapsed ? child.addClass('collapsed-child') : child.removeClass('collapsed-child')));
+          return;
+        }
+        const taskId = node.id().replace('task-', '');
         router.push(`/TaskDetails?taskId=${taskId}`);
       });
     }
@@ -236,6 +273,26 @@ const updateGraph = () => {
     // Получаем позицию последнего узла в пайплайне
     let lastNodePosition = getLastNodePosition(pipeline.tasks, pipelineYOffset);
 
+    // Группы задач matrix отображаются составными узлами
+    const taskGroups = {};
+    for (const group of pipeline.groups || []) {
+      const groupId = `group-${pipeline.pipeline_id}-${group.name}`;
+      currentNodeIds.add(groupId);
+      for (const id of group.task_ids) {
+        taskGroups[id] = groupId;
+      }
+      const groupLabel = `${group.name} (${group.task_ids.length}) - ${group.status}`;
+      const groupNode = cyRef.current.getElementById(groupId);
+      if (groupNode.length === 0) {
+        cyRef.current.add({
+          group: 'nodes',
+          data: { id: groupId, label: groupLabel, bgColor: getStatusColor(group.status), isGroup: true },
+        });
+      } else {
+        groupNode.data({ label: groupLabel, bgColor: getStatusColor(group.status) });
+      }
+    }
+
     for (const task of pipeline.tasks) {
       if (!task) continue;
 
@@ -258,6 +315,8 @@ const updateGraph = () => {
           group: 'nodes',
           data: {
             id: taskId,
+            parent: taskGroups[task.task_id],
+            parentGroup: taskGroups[task.task_id],
             label: `${task.name} - ${task.status}`,
             bgColor: getStatusColor(task.status),
             taskInfo: {
@@ -14,6 +14,49 @@ function TaskDetails() {
   const { taskId } = router.query; // Извлечение ID задачи из URL
   const [taskDetails, setTaskDetails] = useState(null);
   const [socket, setSocket] = useState(null); // Состояние для хранения WebSocket соединения
+  const [userToken, setUserToken] = useState(''); // Токен пользователя для подтверждения задач
+  const [approvalComment, setApprovalComment] = useState('');
+  const [approvalError, setApprovalError] = useState('');
+
+  // Токен выдаёт администратор (см. README), он хранится в браузере между визитами
+  useEffect(() => {
+    setUserToken(localStorage.getItem('userToken') || '');
+  }, []);
+
+  // Загрузка данных о задаче
+  const loadTaskDetails = () => {
+    fetch(`http://localhost:8080/api/task/${taskId}`)
+      .then((response) => response.json())
+      .then((data) => {
+        //форматируем данные
+        data.start_time = formatTime(data.start_time);
+        data.end_time = formatTime(data.end_time);
+        setTaskDetails(data); // Сохраняем данные о задаче в состояние
+      })
+      .catch((error) => console.error("Ошибка загрузки данных о задаче:", error));
+  };
+
+  // Подтверждение или отклонение задачи от имени владельца токена
+  const decideApproval = (decision) => {
+    setApprovalError('');
+    localStorage.setItem('userToken', userToken);
+    fetch(`http://localhost:8080/api/task/${taskId}/${decision}`, {
+      method: 'POST',
+      headers: {
+        'Authorization': `Bearer ${userToken}`,
+        'Content-Type': 'application/x-www-form-urlencoded',
+      },
+      body: new URLSearchParams({ comment: approvalComment }),
+    })
+      .then(async (response) => {
+        if (!response.ok) {
+          throw new Error((await response.text()).trim());
+        }
+        setApprovalComment('');
+        loadTaskDetails();
+      })
+      .catch((error) => setApprovalError(error.message));
+  };
 
 
 // Хук для загрузки данных о задаче и настройки WebSocket соединения
@@ -66,15 +109,7 @@ function TaskDetails() {
 
     if (taskId) {
       // Загружаем данные о задаче, если ID задачи существует
-      fetch(`http://localhost:8080/api/task/${taskId}`)
-        .then((response) => response.json())
-        .then((data) => {
-          //форматируем данные
-          data.start_time = formatTime(data.start_time);
-          data.end_time = formatTime(data.end_time);
-          setTaskDetails(data); // Сохраняем данные о задаче в состояние
-        })
-        .catch((error) => console.error("Ошибка загрузки данных о задаче:", error));
+      loadTaskDetails();
 
       setSocket(createWebSocket());
     }
@@ -95,6 +130,8 @@ function TaskDetails() {
     <h1>Детальная информация о задаче: {taskDetails.name}</h1>
     <p><strong>Описание:</strong> {taskDetails.description}</p>
     <p className={`task-status ${taskDetails.status.toLowerCase()}`}><strong>Статус:</strong> {taskDetails.status}</p>
+    {taskDetails.status_reason && <p><strong>Причина:</strong> {taskDetails.status_reason}</p>}
+    {taskDetails.condition && <p><strong>Условие запуска:</strong> <code>{taskDetails.condition}</code></p>}
     <p><strong>Исполнитель:</strong> {taskDetails.assignedUser}</p>
     <p><strong>Принадлежит пайплайну:</strong> {taskDetails.pipelineName}</p>
     <p><strong>Время начала:</strong> {taskDetails.start_time}</p>
@@ -102,6 +139,57 @@ function TaskDetails() {
     <p><strong>Время выполнения:</strong> {taskDetails.duration}</p>
     <p><strong>Ошибки:</strong> <span className="error-count">{taskDetails.error_count}</span></p>
     <p><strong>Предупреждения:</strong> <span className="warning-count">{taskDetails.warning_count}</span></p>
+    {/* История попыток выполнения задачи */}
+    {taskDetails.attempts && taskDetails.attempts.length > 0 && (
+      <div className="task-attempts">
+        <h2>Попытки выполнения</h2>
+        <ul>
+          {taskDetails.attempts.map((attempt) => (
+            <li key={attempt.attempt_number}>
+              #{attempt.attempt_number}: {attempt.status}, {attempt.start_time} — {attempt.end_time}
+              {attempt.exit_code !== null && `, код выхода ${attempt.exit_code}`}
+              {attempt.error_message && ` (${attempt.error_message})`}
+            </li>
+          ))}
+        </ul>
+      </div>
+    )}
+    {/* Решения по задаче-подтверждению */}
+    {taskDetails.approvals && taskDetails.approvals.length > 0 && (
+      <div className="task-approvals">
+        <h2>Подтверждения</h2>
+        <ul>
+          {taskDetails.approvals.map((approval, index) => (
+            <li key={index}>
+              {approval.decision === 'Approved' ? 'Подтверждено' : 'Отклонено'}: {approval.username}, {approval.decided_at}
+              {approval.comment && ` (${approval.comment})`}
+            </li>
+          ))}
+        </ul>
+      </div>
+    )}
+    {/* Решение по задаче, которая ждёт подтверждения */}
+    {taskDetails.task_type === 'approval' && ['Pending', 'WaitingForApproval'].includes(taskDetails.status) && (
+      <div className="task-approval-form">
+        <h2>Решение</h2>
+        <input
+          type="password"
+          placeholder="Токен пользователя"
+          value={userToken}
+          onChange={(e) => setUserToken(e.target.value)}
+        />
+        <textarea
+          placeholder="Комментарий"
+          value={approvalComment}
+          onChange={(e) => setApprovalComment(e.target.value)}
+        />
+        <div>
+          <button onClick={() => decideApproval('approve')} disabled={!userToken}>Подтвердить</button>
+          <button onClick={() => decideApproval('reject')} disabled={!userToken}>Отклонить</button>
+        </div>
+        {approvalError && <p className="approval-error">{approvalError}</p>}
+      </div>
+    )}
     <a href="/" className="back-button">Назад к задачам</a>
   </div>
 );
@@ -548,6 +548,9 @@ export default function HomePage() {
                 <button onClick={() => updatePipelineStatus(pipeline.pipeline_id, 'Completed', pipeline.name)}>Завершить</button>
                 <button onClick={() => updatePipelineStatus(pipeline.pipeline_id, 'Failed', pipeline.name)}>Остановить</button>
                 <button onClick={() => deletePipeline(pipeline.pipeline_id)}>Удалить пайплайн</button>
+                <a href={`${process.env.NEXT_PUBLIC_API_URL}/api/pipeline/${pipeline.pipeline_id}/export.yaml`} download>
+                  <button>Экспорт YAML</button>
+                </a>
 
                 {/* Блок выбора задачи и исполнителя */}
                 <div className="assign-task-section">
@@ -12,19 +12,92 @@ CREATE TABLE "user" (
     user_id SERIAL PRIMARY KEY,
     username VARCHAR(50) NOT NULL UNIQUE,
     role_id INT REFERENCES user_role(role_id) ON DELETE SET NULL,
+    api_token_hash VARCHAR(64) UNIQUE,  -- SHA-256 токена для подтверждения задач, NULL - токен не выдан
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Таблица пайплайнов
+-- Таблица определений пайплайнов (шаблонов, из которых создаются запуски)
+CREATE TABLE pipeline_definition (
+    definition_id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Таблица версий YAML определений пайплайнов
+CREATE TABLE pipeline_definition_version (
+    version_id SERIAL PRIMARY KEY,
+    definition_id INT REFERENCES pipeline_definition(definition_id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    yaml TEXT NOT NULL,
+    include_versions JSONB,  -- версии include без version на момент сохранения: {"имя определения": версия}
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (definition_id, version)
+);
+
+-- Сохранённые версии неизменяемы: изменение YAML создаёт новую версию
+CREATE FUNCTION forbid_definition_version_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'Версия % определения % неизменяема', OLD.version, OLD.definition_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER definition_version_immutable
+    BEFORE UPDATE ON pipeline_definition_version
+    FOR EACH ROW EXECUTE FUNCTION forbid_definition_version_update();
+
+-- Расписания запусков определений (cron)
+CREATE TABLE pipeline_schedule (
+    schedule_id SERIAL PRIMARY KEY,
+    definition_id INT NOT NULL REFERENCES pipeline_definition(definition_id) ON DELETE CASCADE,
+    cron VARCHAR(100) NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    overlap_policy VARCHAR(20) NOT NULL DEFAULT 'skip' CHECK (overlap_policy IN ('skip', 'queue', 'cancel-previous')),
+    catchup_policy VARCHAR(20) NOT NULL DEFAULT 'latest' CHECK (catchup_policy IN ('none', 'latest', 'all')),
+    variables JSONB,            -- переопределения переменных YAML для запусков по расписанию
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    last_checked_at TIMESTAMPTZ, -- до какого момента срабатывания уже обработаны
+    last_error TEXT,            -- ошибка последнего срабатывания (например, YAML не прошёл проверку)
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Триггеры: webhook из git-репозитория (GitHub, GitLab, Gitea) запускает определение
+CREATE TABLE pipeline_trigger (
+    trigger_id SERIAL PRIMARY KEY,
+    definition_id INT NOT NULL REFERENCES pipeline_definition(definition_id) ON DELETE CASCADE,
+    repository VARCHAR(255) NOT NULL,       -- owner/repo
+    branch VARCHAR(255) NOT NULL DEFAULT '*', -- шаблон ветки: main, release/*, * - любая
+    events TEXT[] NOT NULL DEFAULT '{push,merge_request}',
+    secret TEXT NOT NULL,                   -- секрет для проверки подписи webhook
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Таблица пайплайнов (запусков определений)
 CREATE TABLE pipeline (
     pipeline_id SERIAL PRIMARY KEY,
     name VARCHAR(100) NOT NULL,
     description TEXT,
     created_by INT REFERENCES "user"(user_id) ON DELETE SET NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    status VARCHAR(20) DEFAULT 'Pending' CHECK (status IN ('Pending', 'Running', 'Completed', 'Failed')),
+    status VARCHAR(20) DEFAULT 'Pending' CHECK (status IN ('Pending', 'Running', 'Completed', 'Failed', 'TimedOut', 'Paused', 'Cancelled')),
+    status_reason TEXT,  -- причина итогового статуса (например, превышен таймаут)
     start_time TIMESTAMP,
-    end_time TIMESTAMP
+    end_time TIMESTAMP,
+    max_parallel INT CHECK (max_parallel > 0),     -- лимит параллельных задач, NULL - без ограничения
+    timeout_seconds INT CHECK (timeout_seconds > 0), -- таймаут выполнения пайплайна, NULL - без ограничения
+    definition_id INT REFERENCES pipeline_definition(definition_id) ON DELETE SET NULL, -- NULL у пайплайнов, созданных вручную
+    definition_version INT,  -- версия определения, из которой создан запуск
+    run_number INT,          -- номер запуска в рамках определения
+    variables JSONB,         -- значения переменных YAML, с которыми создан запуск
+    schedule_id INT REFERENCES pipeline_schedule(schedule_id) ON DELETE SET NULL, -- расписание, создавшее запуск
+    scheduled_for TIMESTAMPTZ, -- время срабатывания расписания, за которое создан запуск
+    trigger_id INT REFERENCES pipeline_trigger(trigger_id) ON DELETE SET NULL, -- триггер webhook, создавший запуск
+    branch VARCHAR(255),       -- ветка, коммит и автор события git, запустившего пайплайн
+    commit_sha VARCHAR(64),
+    commit_author VARCHAR(255),
+    webhook_status VARCHAR(20), -- статус из последнего события webhook, чтобы слать только его смены
+    UNIQUE (definition_id, run_number)
 );
 
 -- Таблица задач
@@ -33,14 +106,28 @@ CREATE TABLE task (
     pipeline_id INT REFERENCES pipeline(pipeline_id) ON DELETE CASCADE,
     name VARCHAR(100) NOT NULL,
     description TEXT,
-    status VARCHAR(20) CHECK (status IN ('Pending', 'Running', 'Completed', 'Failed')),
+    status VARCHAR(20) CHECK (status IN ('Pending', 'Running', 'WaitingForApproval', 'Completed', 'Failed', 'TimedOut', 'Skipped', 'Cancelled')),
+    status_reason TEXT,  -- причина итогового статуса (таймаут, пропуск из-за зависимости)
+    task_type VARCHAR(20) DEFAULT 'command' NOT NULL CHECK (task_type IN ('command', 'approval')),
+    approval_level VARCHAR(20) CHECK (approval_level IN ('Admin', 'Developer', 'Viewer')), -- кто может подтвердить, NULL - Admin
+    matrix_group VARCHAR(100), -- имя задачи matrix, из которой развёрнута задача
+    matrix_values JSONB,       -- значения осей matrix для этой задачи
+    condition TEXT,            -- условие when, NULL - задача выполняется после успешных зависимостей
+    runs_on TEXT[],            -- метки агента, который должен выполнить команду; NULL - выполняет сервер
     start_time TIMESTAMP,
     end_time TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     assigned_to INT REFERENCES "user"(user_id) ON DELETE SET NULL,
     "order" INTEGER DEFAULT 0,
     progress_percentage INT DEFAULT 0 CHECK (progress_percentage >= 0 AND progress_percentage <= 100),
-    tags TEXT[]
+    tags TEXT[],
+    command TEXT,   -- команда оболочки, которую выполняет движок
+    exit_code INT,  -- код выхода последнего запуска команды
+    retries INT DEFAULT 0 CHECK (retries >= 0),                         -- число повторов после неудачи
+    retry_delay_seconds INT DEFAULT 0 CHECK (retry_delay_seconds >= 0), -- пауза перед первым повтором
+    retry_on TEXT[],                                                    -- коды выхода / шаблоны вывода для повтора
+    timeout_seconds INT CHECK (timeout_seconds > 0),                    -- таймаут выполнения задачи, NULL - без ограничения
+    webhook_status VARCHAR(20)                                          -- статус из последнего события webhook
 );
 
 
@@ -52,6 +139,29 @@ CREATE TABLE task_dependency (
     PRIMARY KEY (task_id, depends_on_task_id)
 );
 
+-- Таблица попыток выполнения задач
+CREATE TABLE task_attempt (
+    attempt_id SERIAL PRIMARY KEY,
+    task_id INT REFERENCES task(task_id) ON DELETE CASCADE,
+    attempt_number INT NOT NULL,
+    status VARCHAR(20) CHECK (status IN ('Running', 'Completed', 'Failed', 'TimedOut', 'Cancelled')),
+    start_time TIMESTAMP,
+    end_time TIMESTAMP,
+    exit_code INT,
+    error_message TEXT,
+    UNIQUE (task_id, attempt_number)
+);
+
+-- Таблица решений по задачам-подтверждениям
+CREATE TABLE task_approval (
+    approval_id SERIAL PRIMARY KEY,
+    task_id INT REFERENCES task(task_id) ON DELETE CASCADE,
+    decision VARCHAR(20) CHECK (decision IN ('Approved', 'Rejected')),
+    decided_by INT REFERENCES "user"(user_id) ON DELETE SET NULL,
+    decided_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    comment TEXT
+);
+
 -- Таблица логов задач
 CREATE TABLE task_log (
     log_id SERIAL PRIMARY KEY,
@@ -93,12 +203,76 @@ CREATE TABLE access_control (
     permission_level VARCHAR(20) CHECK (permission_level IN ('Admin', 'Developer', 'Viewer'))
 );
 
+-- Подписки исходящих webhook на события пайплайнов и задач; пустой фильтр пропускает всё
+CREATE TABLE webhook_subscription (
+    subscription_id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT,                              -- ключ подписи HMAC-SHA256, NULL - без подписи
+    events TEXT[] NOT NULL DEFAULT '{}',      -- update_task, update_pipeline, delete_task, delete_pipeline
+    pipeline_ids INT[] NOT NULL DEFAULT '{}',
+    statuses TEXT[] NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Журнал доставок исходящих webhook
+CREATE TABLE webhook_delivery (
+    delivery_id SERIAL PRIMARY KEY,
+    subscription_id INT NOT NULL REFERENCES webhook_subscription(subscription_id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    pipeline_id INT,                          -- без внешнего ключа: журнал сохраняется после удаления пайплайна
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'Pending' CHECK (status IN ('Pending', 'Delivered', 'Failed')),
+    attempts INT NOT NULL DEFAULT 0,
+    response_code INT,
+    response_body TEXT,
+    error TEXT,
+    redelivery_of INT REFERENCES webhook_delivery(delivery_id) ON DELETE SET NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP
+);
+
+-- Агенты, которые забирают задачи с runs_on и выполняют их на своих машинах
+CREATE TABLE agent (
+    agent_id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    labels TEXT[] NOT NULL DEFAULT '{}',
+    token_hash VARCHAR(64) NOT NULL,  -- SHA-256 токена, выданного при регистрации
+    last_seen TIMESTAMPTZ,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Задания для агентов: одна попытка выполнения задачи с runs_on
+CREATE TABLE agent_job (
+    job_id SERIAL PRIMARY KEY,
+    task_id INT NOT NULL REFERENCES task(task_id) ON DELETE CASCADE,
+    labels TEXT[] NOT NULL DEFAULT '{}',  -- агент должен иметь все эти метки
+    command TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'Queued' CHECK (status IN ('Queued', 'Leased', 'Completed', 'Failed', 'Cancelled', 'Expired')),
+    agent_id INT REFERENCES agent(agent_id) ON DELETE SET NULL,
+    lease_expires_at TIMESTAMPTZ,         -- продлевается heartbeat агента
+    exit_code INT,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP
+);
+
 -- Индексы для оптимизации запросов
 CREATE INDEX idx_pipeline_status ON pipeline(status);
+CREATE INDEX idx_pipeline_definition ON pipeline(definition_id);
+CREATE INDEX idx_pipeline_schedule ON pipeline(schedule_id);
+CREATE INDEX idx_pipeline_trigger_repository ON pipeline_trigger(LOWER(repository));
 CREATE INDEX idx_task_status ON task(status);
 CREATE INDEX idx_task_pipeline ON task(pipeline_id);
 CREATE INDEX idx_task_assigned_to ON task(assigned_to);
 CREATE INDEX idx_task_log_time ON task_log(log_time);
+CREATE INDEX idx_task_log_task ON task_log(task_id, log_id);
+CREATE INDEX idx_webhook_delivery_pending ON webhook_delivery(next_attempt_at) WHERE status = 'Pending';
+CREATE INDEX idx_webhook_delivery_subscription ON webhook_delivery(subscription_id);
+CREATE INDEX idx_agent_job_queued ON agent_job(job_id) WHERE status = 'Queued';
+CREATE INDEX idx_agent_job_agent ON agent_job(agent_id) WHERE status = 'Leased';
 
 -- Начальные данные для ролей пользователей
 INSERT INTO user_role (role_name, description) VALUES
@@ -120,6 +294,13 @@ INSERT INTO "user" (username, role_id) VALUES
     ('devops_user', 6),        -- DevOps
     ('support_user', 7);       -- Support
 
+-- Начальные права доступа: запись без pipeline_id действует на все пайплайны
+INSERT INTO access_control (user_id, pipeline_id, permission_level) VALUES
+    (1, NULL, 'Admin'),        -- admin_user
+    (2, NULL, 'Developer'),    -- developer_user
+    (3, NULL, 'Viewer'),       -- viewer_user
+    (6, NULL, 'Admin');        -- devops_user
+
 -- Пример данных для пайплайнов
 INSERT INTO pipeline (name, description, created_by, status, start_time, end_time) VALUES
     ('Развертывание веб-приложения', 'Пайплайн для развертывания нового веб-приложения', 1, 'Pending', CURRENT_TIMESTAMP, NULL);